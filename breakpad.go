@@ -0,0 +1,311 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file reads Breakpad text symbol files, as written by dump_syms,
+// described at
+//   https://chromium.googlesource.com/breakpad/breakpad/+/master/docs/symbol_files.md
+// Addresses in a .sym file are relative to the module's load address, so
+// the symbols are relocated using the module's mapping in the profile.
+
+type breakpadModule struct {
+	os, arch, id, name string
+	syms               *Symbols
+}
+
+// readBreakpadHeader reads just the MODULE line of a .sym file.
+func readBreakpadHeader(path string) (*breakpadModule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := mustReadLine(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return parseBreakpadModule(string(line))
+}
+
+func parseBreakpadModule(line string) (*breakpadModule, error) {
+	fields := strings.SplitN(line, " ", 5)
+	if len(fields) != 5 || fields[0] != "MODULE" {
+		return nil, fmt.Errorf("bad MODULE line %q", line)
+	}
+	return &breakpadModule{os: fields[1], arch: fields[2], id: fields[3], name: fields[4]}, nil
+}
+
+// ReadBreakpad parses a whole .sym file, including FUNC sizes and the
+// line records that follow each FUNC.
+func ReadBreakpad(r *bufio.Reader) (*breakpadModule, error) {
+	line, err := mustReadLine(r)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := parseBreakpadModule(string(line))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[int]string)
+	var funcs, publics []Symbol
+	cur := -1 // Index of the FUNC that line records belong to.
+	for {
+		line, err := mustReadLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		text := string(line)
+		keyword := text
+		if i := strings.IndexByte(text, ' '); i >= 0 {
+			keyword = text[:i]
+		}
+		switch keyword {
+		case "FILE":
+			fields := strings.SplitN(text, " ", 3)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("bad FILE line %q", text)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			files[n] = fields[2]
+		case "FUNC":
+			// FUNC [m] address size parameter_size name
+			fields := strings.SplitN(text, " ", 5)
+			if len(fields) > 1 && fields[1] == "m" {
+				fields = strings.SplitN(text[len("FUNC m "):], " ", 4)
+			} else {
+				fields = fields[1:]
+			}
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("bad FUNC line %q", text)
+			}
+			addr, err := strconv.ParseUint(fields[0], 16, 64)
+			if err != nil {
+				return nil, err
+			}
+			size, err := strconv.ParseUint(fields[1], 16, 64)
+			if err != nil {
+				return nil, err
+			}
+			funcs = append(funcs, Symbol{addr: addr, size: size, name: fields[3]})
+			cur = len(funcs) - 1
+		case "PUBLIC":
+			// PUBLIC [m] address parameter_size name
+			fields := strings.SplitN(text, " ", 4)
+			if len(fields) > 1 && fields[1] == "m" {
+				fields = strings.SplitN(text[len("PUBLIC m "):], " ", 3)
+			} else {
+				fields = fields[1:]
+			}
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("bad PUBLIC line %q", text)
+			}
+			addr, err := strconv.ParseUint(fields[0], 16, 64)
+			if err != nil {
+				return nil, err
+			}
+			publics = append(publics, Symbol{addr: addr, name: fields[2]})
+			cur = -1
+		case "INLINE", "INLINE_ORIGIN":
+			// Inlining is described between a FUNC and its line
+			// records, which still follow.
+		case "MODULE", "INFO", "STACK":
+			cur = -1
+		default:
+			// A line record: address size line filenum.
+			if cur < 0 {
+				return nil, fmt.Errorf("unexpected line %q", text)
+			}
+			if funcs[cur].file != "" {
+				continue // Only the function's first line is kept.
+			}
+			fields := strings.Split(text, " ")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("bad line record %q", text)
+			}
+			lineno, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			filenum, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, err
+			}
+			funcs[cur].file = files[filenum]
+			funcs[cur].line = lineno
+		}
+	}
+
+	// PUBLIC records carry no size; they extend to the next symbol.
+	// Functions covered by a FUNC record are already described better.
+	all := funcs
+	funcTable := NewSymbols(append([]Symbol{}, funcs...))
+	for _, pub := range publics {
+		if funcTable.Find(pub.addr) < 0 {
+			all = append(all, pub)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].addr < all[j].addr })
+	for i := range all {
+		if all[i].size == 0 && i+1 < len(all) {
+			all[i].size = all[i+1].addr - all[i].addr
+		}
+	}
+	mod.syms = NewSymbols(all)
+	return mod, nil
+}
+
+// breakpadID computes the Breakpad module id of an ELF file from its
+// build-id note, or returns "" if it can't be determined.
+func breakpadID(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	id := elfBuildID(f)
+	if len(id) == 0 {
+		return ""
+	}
+	// The id is the first 16 bytes of the build id treated as a GUID,
+	// whose first three fields are little-endian, plus an age of 0.
+	var guid [16]byte
+	copy(guid[:], id)
+	guid[0], guid[1], guid[2], guid[3] = guid[3], guid[2], guid[1], guid[0]
+	guid[4], guid[5] = guid[5], guid[4]
+	guid[6], guid[7] = guid[7], guid[6]
+	return fmt.Sprintf("%X0", guid[:])
+}
+
+// breakpadCandidates lists the .sym files under path that may describe
+// the module named name.  path is either a .sym file or a symbol store
+// directory laid out as name/id/name.sym.
+func breakpadCandidates(path, name, id string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	// Same naming as Breakpad's SimpleSymbolSupplier.
+	symName := strings.TrimSuffix(name, ".pdb") + ".sym"
+	if id != "" {
+		return []string{filepath.Join(path, name, id, symName)}, nil
+	}
+	return filepath.Glob(filepath.Join(path, name, "*", symName))
+}
+
+// findBreakpad returns the .sym file under path for the module named
+// name with the given id, or "" if there's none.  Without an id, as when
+// the module's file isn't available locally, the file is only trusted
+// if it's the one build of the module there is.
+func findBreakpad(path, name, id string) (string, error) {
+	candidates, err := breakpadCandidates(path, name, id)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	var ids []string
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		header, err := readBreakpadHeader(candidate)
+		if err != nil || header.name != name || (id != "" && header.id != id) {
+			continue
+		}
+		if found == "" {
+			found = candidate
+		}
+		if !seen[header.id] {
+			seen[header.id] = true
+			ids = append(ids, header.id)
+		}
+	}
+	if len(ids) > 1 {
+		log.Printf("%s: symbols for builds %s of %s, but no way to tell which was profiled", path, strings.Join(ids, ", "), name)
+		return "", nil
+	}
+	return found, nil
+}
+
+// LoadBreakpadSyms loads the Breakpad symbols for every module mapped in
+// the profile, matching .sym files to modules by name and, when the
+// module's file is available locally, build id.
+func LoadBreakpadSyms(paths []string, maps Maps) (*Symbols, error) {
+	// Load address of each module, from its first mapping.
+	bases := make(map[string]uint64)
+	var modules []string
+	for _, e := range maps {
+		if e.offset != 0 || e.path == "" || e.path[0] == '[' {
+			continue
+		}
+		if _, seen := bases[e.path]; !seen {
+			bases[e.path] = e.start
+			modules = append(modules, e.path)
+		}
+	}
+
+	var sets []*Symbols
+	for _, module := range modules {
+		name := filepath.Base(module)
+		id := breakpadID(module)
+		for _, path := range paths {
+			candidate, err := findBreakpad(path, name, id)
+			if err != nil {
+				return nil, err
+			}
+			if candidate == "" {
+				continue
+			}
+			f, err := os.Open(candidate)
+			if err != nil {
+				return nil, err
+			}
+			mod, err := ReadBreakpad(bufio.NewReader(f))
+			f.Close()
+			if err != nil {
+				log.Printf("%s: %s", candidate, err)
+				continue
+			}
+			log.Printf("loaded %d breakpad syms for %s from %s", mod.syms.Len(), module, candidate)
+			mod.syms.Relocate(bases[module])
+			sets = append(sets, mod.syms)
+			break
+		}
+	}
+	return MergeSyms(sets...), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const breakpadSym = `MODULE Linux x86_64 0123456789ABCDEF0123456789ABCDEF0 app
+INFO CODE_ID 0123456789ABCDEF
+FILE 0 /src/app/main.cc
+FILE 1 /src/app/widget.h
+INLINE_ORIGIN 0 base::Widget::Size() const
+FUNC 1000 80 0 main
+INLINE 0 12 1 0 1010 10
+1000 10 10 0
+1010 10 30 1
+1020 60 12 0
+PUBLIC 1040 0 main_alias
+FUNC m 1100 20 0 _ZN4base6Widget3RunEv
+1100 20 7 1
+PUBLIC 1200 0 _start
+STACK CFI INIT 1000 80 .cfa: $rsp 8 +
+`
+
+func TestReadBreakpad(t *testing.T) {
+	mod, err := ReadBreakpad(bufio.NewReader(strings.NewReader(breakpadSym)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.os != "Linux" || mod.arch != "x86_64" || mod.id != "0123456789ABCDEF0123456789ABCDEF0" || mod.name != "app" {
+		t.Errorf("module %+v", mod)
+	}
+	for _, test := range []struct {
+		addr uint64
+		name string
+		file string
+		line int
+	}{
+		{0x1000, "main", "/src/app/main.cc", 10},
+		// Within main, which a PUBLIC record doesn't override.
+		{0x1040, "main", "/src/app/main.cc", 10},
+		{0x1110, "_ZN4base6Widget3RunEv", "/src/app/widget.h", 7},
+	} {
+		sym := mod.syms.Lookup(test.addr)
+		if sym == nil {
+			t.Errorf("%#x: no symbol", test.addr)
+			continue
+		}
+		if sym.name != test.name || sym.file != test.file || sym.line != test.line {
+			t.Errorf("%#x: got %s at %s:%d, want %s at %s:%d", test.addr, sym.name, sym.file, sym.line, test.name, test.file, test.line)
+		}
+	}
+
+	// Line records must follow a FUNC.
+	bad := "MODULE Linux x86_64 0 app\nPUBLIC 1000 0 f\n1000 10 1 0\n"
+	if _, err := ReadBreakpad(bufio.NewReader(strings.NewReader(bad))); err == nil {
+		t.Errorf("want an error for a stray line record")
+	}
+}
+
+func TestFindBreakpad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(id string) string {
+		path := filepath.Join(dir, "app", id, "app.sym")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("MODULE Linux x86_64 "+id+" app\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first := write("AAAA0")
+
+	if got, err := findBreakpad(dir, "app", ""); err != nil || got != first {
+		t.Errorf("one build: got %q, %v", got, err)
+	}
+	if got, err := findBreakpad(dir, "app", "AAAA0"); err != nil || got != first {
+		t.Errorf("by id: got %q, %v", got, err)
+	}
+	if got, err := findBreakpad(dir, "app", "BBBB0"); err != nil || got != "" {
+		t.Errorf("other id: got %q, %v", got, err)
+	}
+
+	// Without an id, there's no telling builds apart.
+	second := write("BBBB0")
+	if got, err := findBreakpad(dir, "app", ""); err != nil || got != "" {
+		t.Errorf("two builds: got %q, %v", got, err)
+	}
+	if got, err := findBreakpad(dir, "app", "BBBB0"); err != nil || got != second {
+		t.Errorf("by id: got %q, %v", got, err)
+	}
+
+	if _, err := findBreakpad(filepath.Join(dir, "missing"), "app", ""); err == nil {
+		t.Errorf("want an error for a missing path")
+	}
+}
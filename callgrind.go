@@ -0,0 +1,114 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file writes the graph in the callgrind format that KCachegrind
+// and QCachegrind browse, described at
+// https://valgrind.org/docs/manual/cl-format.html.  Each metric is an
+// event, functions' self costs are what they allocated themselves, and
+// calls cost what was allocated beneath them.  Calls are counted by the
+// allocations made through them.
+
+// callgrindNames numbers the names of one kind, objects, files or
+// functions, so that each is written out in full only the first time.
+type callgrindNames map[string]int
+
+func (c callgrindNames) name(x string) string {
+	if id, ok := c[x]; ok {
+		return fmt.Sprintf("(%d)", id)
+	}
+	id := len(c) + 1
+	c[x] = id
+	return fmt.Sprintf("(%d) %s", id, x)
+}
+
+// callgrindCosts formats stats as a cost line's costs, one per metric.
+func callgrindCosts(stats *Stats) string {
+	costs := make([]string, len(metrics))
+	for i, m := range metrics {
+		costs[i] = fmt.Sprint(stats.Get(m))
+	}
+	return strings.Join(costs, " ")
+}
+
+// source returns the library n is in, and its source file and line, or
+// "???", callgrind's unknown, and 0.
+func (s *state) source(n *Node) (object, file string, line int) {
+	object, file = "???", "???"
+	if n.addr >= inlineAddrBase {
+		return
+	}
+	if e := s.Profile.maps.Search(n.addr); e != nil {
+		object = e.path
+	}
+	if sym := s.syms.Lookup(n.addr); sym != nil && len(sym.file) > 0 {
+		file, line = sym.file, sym.line
+	}
+	return
+}
+
+// Callgrind writes the graph of the shown stacks in callgrind format.
+func (s *state) Callgrind(w io.Writer) {
+	g := s.Graph
+	fmt.Fprintf(w, "# callgrind format\nversion: 1\ncreator: hp\npositions: line\n")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "event: %s\n", m)
+	}
+	fmt.Fprintf(w, "events: %s\n", strings.Join(metricNames, " "))
+	fmt.Fprintf(w, "summary: %s\n", callgrindCosts(&s.Shown))
+
+	nodes := make([]*Node, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].addr < nodes[j].addr })
+	callees := make(map[*Node][]*Node)
+	for e := range g.edges {
+		callees[e.src] = append(callees[e.src], e.dst)
+	}
+
+	objects, files, functions := make(callgrindNames), make(callgrindNames), make(callgrindNames)
+	name := func(n *Node) string {
+		if len(n.name) == 0 {
+			return fmt.Sprintf("0x%x", n.addr)
+		}
+		return s.fullName(n.name)
+	}
+	for _, n := range nodes {
+		object, file, line := s.source(n)
+		fmt.Fprintf(w, "\nob=%s\nfl=%s\nfn=%s\n", objects.name(object), files.name(file), functions.name(name(n)))
+		fmt.Fprintf(w, "%d %s\n", line, callgrindCosts(&n.cur))
+
+		cs := callees[n]
+		sort.Slice(cs, func(i, j int) bool { return cs[i].addr < cs[j].addr })
+		for _, c := range cs {
+			stats := g.edges[edge{n, c}]
+			calls := stats.AllocObjects
+			if calls < 1 {
+				calls = 1
+			}
+			cobject, cfile, cline := s.source(c)
+			fmt.Fprintf(w, "cob=%s\ncfl=%s\ncfn=%s\n", objects.name(cobject), files.name(cfile), functions.name(name(c)))
+			fmt.Fprintf(w, "calls=%d %d\n%d %s\n", calls, cline, line, callgrindCosts(stats))
+		}
+	}
+}
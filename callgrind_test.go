@@ -0,0 +1,91 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCallgrind(t *testing.T) {
+	s := flameState("")
+	s.syms = NewSymbols([]Symbol{
+		{addr: 0x1000, size: 0x100, name: "main", file: "app.cc", line: 10},
+		{addr: 0x1200, size: 0x100, name: "_Z5parseRKSt6vectorIiSaIiEE", file: "parse.cc", line: 42},
+	})
+	for _, stack := range s.Profile.stacks {
+		stack.Stats.AllocObjects = 2
+		stack.Stats.AllocBytes = 2 * stack.Stats.InuseBytes
+	}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	s.Callgrind(&out)
+	want := `# callgrind format
+version: 1
+creator: hp
+positions: line
+event: inuse_space
+event: inuse_objects
+event: alloc_space
+event: alloc_objects
+events: inuse_space inuse_objects alloc_space alloc_objects
+summary: 1000 4 2000 8
+
+ob=(1) /bin/app
+fl=(1) app.cc
+fn=(1) main
+10 0 0 0 0
+cob=(1)
+cfl=(2) ???
+cfn=(2) base::Widget::Run()
+calls=4 0
+10 500 2 1000 4
+cob=(1)
+cfl=(3) parse.cc
+cfn=(3) parse(std::vector<int, std::allocator<int> > const&)
+calls=4 42
+10 500 2 1000 4
+
+ob=(1)
+fl=(2)
+fn=(2)
+0 400 1 800 2
+cob=(2) /lib/libc.so.6
+cfl=(2)
+cfn=(4) malloc
+calls=2 0
+0 100 1 200 2
+
+ob=(1)
+fl=(3)
+fn=(3)
+42 0 0 0 0
+cob=(2)
+cfl=(2)
+cfn=(4)
+calls=4 0
+42 500 2 1000 4
+
+ob=(2)
+fl=(2)
+fn=(4)
+0 600 3 1200 6
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// This file remembers demangled names, so that labels rendered again
+// and again, as from the web UI, are demangled once.  With
+// -demangle-cache they're kept on disk across runs too, as lines of
+//   mangled name, tab, demangled name
+// after a header identifying the hp binary whose demanglers made them.
+
+var demangleCacheMagic = "hpdemangled1"
+
+// How many names a worker demangles between taking the lock.
+const demangleBatchSize = 256
+
+// A DemangleCache is a Demangler remembering what its backend made of
+// each name.  It is safe for concurrent use, as long as the backend is.
+type DemangleCache struct {
+	backend Demangler
+	mu      sync.RWMutex
+	names   map[string]string
+	// Whether names has entries that aren't on disk.
+	dirty bool
+	// Parse trees, or nil for names the backend couldn't break up.
+	// These aren't kept on disk.
+	trees map[string]*DemangledName
+}
+
+func NewDemangleCache(backend Demangler) *DemangleCache {
+	return &DemangleCache{backend: backend, names: make(map[string]string), trees: make(map[string]*DemangledName)}
+}
+
+func (c *DemangleCache) Demangle(name string) (string, error) {
+	c.mu.RLock()
+	out, ok := c.names[name]
+	c.mu.RUnlock()
+	if ok {
+		return out, nil
+	}
+	out, err := c.backend.Demangle(name)
+	if err != nil {
+		// Failures aren't remembered; SchemeDemangler has none.
+		return out, err
+	}
+	c.mu.Lock()
+	c.names[name] = out
+	c.dirty = true
+	c.mu.Unlock()
+	return out, nil
+}
+
+// DemangleTree breaks name into its parts, if the backend is a
+// TreeDemangler that can.
+func (c *DemangleCache) DemangleTree(name string) (*DemangledName, error) {
+	c.mu.RLock()
+	t, ok := c.trees[name]
+	c.mu.RUnlock()
+	if !ok {
+		if backend, isTree := c.backend.(TreeDemangler); isTree {
+			t, _ = backend.DemangleTree(name)
+		}
+		c.mu.Lock()
+		c.trees[name] = t
+		c.mu.Unlock()
+	}
+	if t == nil {
+		return nil, fmt.Errorf("no parse tree for '%s'", name)
+	}
+	return t, nil
+}
+
+// DemangleAll demangles the names not already cached, in batches spread
+// over a worker per CPU.
+func (c *DemangleCache) DemangleAll(names []string) {
+	var todo []string
+	seen := make(map[string]bool)
+	c.mu.RLock()
+	for _, name := range names {
+		if _, ok := c.names[name]; !ok && !seen[name] {
+			seen[name] = true
+			todo = append(todo, name)
+		}
+	}
+	c.mu.RUnlock()
+
+	batches := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				outs, errs := demangleBatch(c.backend, batch)
+				c.mu.Lock()
+				for j, name := range batch {
+					if errs[j] == nil {
+						c.names[name] = outs[j]
+						c.dirty = true
+					}
+				}
+				c.mu.Unlock()
+			}
+		}()
+	}
+	for len(todo) > 0 {
+		n := len(todo)
+		if n > demangleBatchSize {
+			n = demangleBatchSize
+		}
+		batches <- todo[:n]
+		todo = todo[n:]
+	}
+	close(batches)
+	wg.Wait()
+}
+
+func demangleCachePath() string {
+	if !*flag_demangle_cache {
+		return ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hp", "demangled")
+}
+
+// demanglerStamp identifies the running hp binary, so that names
+// demangled by another build of it aren't trusted.
+func demanglerStamp() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %d", exe, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// Load adds the names cached at path, if it was written by this hp.
+func (c *DemangleCache) Load(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	r.Buffer(nil, 1<<20)
+	if !r.Scan() || r.Text() != demangleCacheMagic || !r.Scan() || r.Text() != demanglerStamp() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for r.Scan() {
+		name, out, ok := strings.Cut(r.Text(), "\t")
+		if !ok {
+			log.Printf("ignoring demangle cache %s: bad line %q", path, r.Text())
+			return
+		}
+		if _, ok := c.names[name]; !ok {
+			c.names[name] = out
+		}
+	}
+}
+
+// Save writes the cache to path, if it has anything new.
+func (c *DemangleCache) Save(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if path == "" || !c.dirty {
+		return
+	}
+	stamp := demanglerStamp()
+	if stamp == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("not caching demangled names: %s", err)
+		return
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "demangled")
+	if err != nil {
+		log.Printf("not caching demangled names: %s", err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s\n%s\n", demangleCacheMagic, stamp)
+	for name, out := range c.names {
+		if strings.ContainsAny(name, "\t\n") || strings.Contains(out, "\n") {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", name, out)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		log.Printf("not caching demangled names: %s", err)
+		os.Remove(f.Name())
+		return
+	}
+	c.dirty = false
+}
@@ -0,0 +1,104 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingDemangler demangles through NewDemangler, counting calls.
+type countingDemangler struct {
+	calls int64
+	d     Demangler
+}
+
+func (c *countingDemangler) Demangle(name string) (string, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.d.Demangle(name)
+}
+
+func TestDemangleCache(t *testing.T) {
+	backend := &countingDemangler{d: NewDemangler()}
+	c := NewDemangleCache(backend)
+	names := []string{"_Z1fv", "_ZN3foo3barEi", "?Foo@Bar@@QEAAXH@Z", "main"}
+	for i := 0; i < 3; i++ {
+		for _, name := range names {
+			want, _ := NewDemangler().Demangle(name)
+			if got, err := c.Demangle(name); err != nil || got != want {
+				t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+			}
+		}
+	}
+	if backend.calls != int64(len(names)) {
+		t.Errorf("backend called %d times for %d names", backend.calls, len(names))
+	}
+}
+
+func TestDemangleCacheConcurrent(t *testing.T) {
+	var names []string
+	for i := 0; i < 2000; i++ {
+		names = append(names, fmt.Sprintf("_Z%d%sv", len(fmt.Sprint("f", i)), fmt.Sprint("f", i)))
+	}
+	backend := &countingDemangler{d: NewDemangler()}
+	c := NewDemangleCache(backend)
+	c.DemangleAll(append(names, names...))
+	if backend.calls != int64(len(names)) {
+		t.Errorf("DemangleAll called backend %d times for %d names", backend.calls, len(names))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, name := range names {
+				if got, _ := c.Demangle(name); got != fmt.Sprint("f", i, "()") {
+					t.Errorf("%s: got %q", name, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if backend.calls != int64(len(names)) {
+		t.Errorf("backend called %d times for %d names", backend.calls, len(names))
+	}
+}
+
+func TestDemangleCacheSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hp", "demangled")
+	c := NewDemangleCache(NewDemangler())
+	c.DemangleAll([]string{"_Z1fv", "_ZN3foo3barEi"})
+	c.Save(path)
+
+	backend := &countingDemangler{d: NewDemangler()}
+	loaded := NewDemangleCache(backend)
+	loaded.Load(path)
+	for name, want := range map[string]string{"_Z1fv": "f()", "_ZN3foo3barEi": "foo::bar(int)"} {
+		if got, _ := loaded.Demangle(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if backend.calls != 0 {
+		t.Errorf("backend called %d times for cached names", backend.calls)
+	}
+	if loaded.dirty {
+		t.Errorf("cache loaded from disk is dirty")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file lines up the stacks of a -base profile with those of the
+// profile being looked at.  The two needn't share an address layout, so
+// frames are matched by function name rather than by address.
+
+// Functions only the base profile has get addresses counting up from
+// here, below those of inlined functions.
+const baseAddrBase = 1 << 62
+
+// RebaseStacks rewrites the addresses in base's stacks, whose function
+// names are baseNames, to the canonical addresses of the same functions
+// in names, adding to names those functions it doesn't have.  Addresses
+// with no name are kept as they are.
+func RebaseStacks(base []*Stack, baseNames, names map[uint64]string) {
+	addrs := make(map[string]uint64)
+	for addr, name := range names {
+		addrs[name] = addr
+	}
+	nextAddr := uint64(baseAddrBase)
+	newAddr := func() uint64 {
+		for {
+			addr := nextAddr
+			nextAddr++
+			if _, used := names[addr]; !used {
+				return addr
+			}
+		}
+	}
+
+	rebased := make(map[uint64]uint64)
+	for _, stack := range base {
+		for i, addr := range stack.Stack {
+			to, ok := rebased[addr]
+			if !ok {
+				if name, named := baseNames[addr]; named {
+					to, ok = addrs[name]
+					if !ok {
+						to = newAddr()
+						addrs[name] = to
+						names[to] = name
+					}
+				} else {
+					to = addr
+				}
+				rebased[addr] = to
+			}
+			stack.Stack[i] = to
+		}
+	}
+}
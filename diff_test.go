@@ -0,0 +1,94 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRebaseStacks(t *testing.T) {
+	names := map[uint64]string{0x100: "main", 0x200: "malloc", 0x300: "Run"}
+	// The base was loaded at another address, and doesn't call Run but
+	// does call Old.
+	baseNames := map[uint64]string{0x1100: "main", 0x1200: "malloc", 0x1400: "Old"}
+	base := []*Stack{
+		{Stats: &Stats{}, Stack: []uint64{0x1200, 0x1400, 0x1100}},
+		{Stats: &Stats{}, Stack: []uint64{0x1200, 0x999, 0x1100}},
+	}
+	RebaseStacks(base, baseNames, names)
+
+	want := [][]uint64{{0x200, baseAddrBase, 0x100}, {0x200, 0x999, 0x100}}
+	for i, stack := range base {
+		if !reflect.DeepEqual(stack.Stack, want[i]) {
+			t.Errorf("stack %d: got %x, want %x", i, stack.Stack, want[i])
+		}
+	}
+	if names[baseAddrBase] != "Old" || len(names) != 4 {
+		t.Errorf("names after rebasing: %v", names)
+	}
+}
+
+func TestAnalyzeDiff(t *testing.T) {
+	s := testState(&params{NodeKeepCount: 100},
+		map[uint64]string{1: "malloc", 2: "grow", 3: "added", 4: "main", 5: "removed"},
+		testStack(300<<10, 1, 2, 4),
+		testStack(100<<10, 1, 3, 4),
+	)
+	s.Base = &Profile{stacks: []*Stack{
+		testStack(100<<10, 1, 2, 4),
+		testStack(200<<10, 1, 5, 4),
+	}}
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	g := s.Graph
+	for _, test := range []struct {
+		addr         uint64
+		cum, baseCum int
+		label, color string
+	}{
+		{1, 100 << 10, 300 << 10, "+100k of +100k (+33.3% from base)", "red"},
+		{2, 200 << 10, 100 << 10, "+0k of +200k (+200.0% from base)", "red"},
+		{3, 100 << 10, 0, "+0k of +100k (new)", "red"},
+		{5, -200 << 10, 200 << 10, "+0k of -200k (-100.0% from base)", "darkgreen"},
+	} {
+		n := g.nodes[test.addr]
+		if n.cum.InuseBytes != test.cum || n.baseCum.InuseBytes != test.baseCum {
+			t.Errorf("%s: cum %d, base %d; want %d, %d", n.name, n.cum.InuseBytes, n.baseCum.InuseBytes, test.cum, test.baseCum)
+		}
+		if got := s.SizeLabel(n); got != test.label {
+			t.Errorf("%s: label %q, want %q", n.name, got, test.label)
+		}
+		if got := s.diffColor(n.cum.InuseBytes); !strings.Contains(got, "color="+test.color) {
+			t.Errorf("%s: color %q, want %s", n.name, got, test.color)
+		}
+	}
+	if got := g.edges[edge{g.nodes[5], g.nodes[1]}].InuseBytes; got != -200<<10 {
+		t.Errorf("removed -> malloc: %d, want %d", got, -200<<10)
+	}
+	// Shrinkage counts as much as growth in picking nodes to show.
+	if want := []int{200 << 10, 200 << 10, 100 << 10, 100 << 10, 100 << 10}; !reflect.DeepEqual(g.NodeSizes, want) {
+		t.Errorf("node sizes %v, want %v", g.NodeSizes, want)
+	}
+
+	var out bytes.Buffer
+	s.GraphViz(&out)
+	if !strings.Contains(out.String(), "5 -> 1 [label=\" -200\",color=darkgreen") {
+		t.Errorf("no shrinking edge in\n%s", out.String())
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// This file picks out the stacks to graph.  With -focus, only stacks
+// with a frame whose demangled name matches it are kept, and with
+// -ignore, stacks with a frame matching that are dropped.
+
+// compileFilter compiles a -focus or -ignore regexp, or returns nil for
+// an empty one.
+func compileFilter(flag, expr string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s regexp: %s", flag, err)
+	}
+	return re, nil
+}
+
+// FilterStacks returns those of stacks that pass focus and ignore,
+// either of which may be nil, and the total of those that don't.
+func (s *state) FilterStacks(stacks []*Stack, focus, ignore *regexp.Regexp) (kept []*Stack, dropped Stats) {
+	if focus == nil && ignore == nil {
+		return stacks, dropped
+	}
+	// Most frames are in many stacks, so match each address once.
+	type match struct{ focus, ignore bool }
+	matches := make(map[uint64]match)
+	matchAddr := func(addr uint64) match {
+		m, ok := matches[addr]
+		if !ok {
+			name, _ := splitCloneSuffix(s.names[addr])
+			name, _ = s.demangler.Demangle(name)
+			m = match{focus != nil && focus.MatchString(name), ignore != nil && ignore.MatchString(name)}
+			matches[addr] = m
+		}
+		return m
+	}
+
+	for _, stack := range stacks {
+		focused, ignored := focus == nil, false
+		for _, addr := range stack.Stack {
+			m := matchAddr(addr)
+			focused = focused || m.focus
+			if m.ignore {
+				ignored = true
+				break
+			}
+		}
+		if focused && !ignored {
+			kept = append(kept, stack)
+		} else {
+			dropped.Add(stack.Stats)
+		}
+	}
+	return kept, dropped
+}
+
+// Analyze builds the graph of the stacks that pass the filters in
+// s.Params, or of how they changed from the base profile's that do.
+func (s *state) Analyze() error {
+	focus, err := compileFilter("focus", s.Params.Focus)
+	if err != nil {
+		return err
+	}
+	ignore, err := compileFilter("ignore", s.Params.Ignore)
+	if err != nil {
+		return err
+	}
+	stacks, dropped := s.FilterStacks(s.Profile.stacks, focus, ignore)
+	if len(stacks) < len(s.Profile.stacks) {
+		log.Printf("filtered out %d stacks holding %s", len(s.Profile.stacks)-len(stacks), s.Params.Metric.Format(dropped.Get(s.Params.Metric), false))
+	}
+
+	s.Shown = Stats{}
+	for _, stack := range stacks {
+		s.Shown.Add(stack.Stats)
+	}
+	s.Filtered = dropped
+	s.stacks = stacks
+	s.Graph = &graph{
+		nodes:  make(map[uint64]*Node),
+		edges:  make(map[edge]*Stats),
+		metric: s.Params.Metric,
+	}
+	if s.Base != nil {
+		base, _ := s.FilterStacks(s.Base.stacks, focus, ignore)
+		s.Graph.AnalyzeDiff(stacks, base, s.names)
+	} else {
+		s.Graph.Analyze(stacks, s.names)
+	}
+	return nil
+}
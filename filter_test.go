@@ -0,0 +1,96 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// filterState returns a state with a profile of three stacks, leaf
+// first, through the functions named.
+func filterState() *state {
+	s := testState(&params{},
+		map[uint64]string{
+			1: "malloc",
+			2: "_ZN4base6Widget3RunEv",
+			3: "_ZN3net6Socket4ReadEv.cold",
+			4: "main",
+			5: "_ZN4base6Thread4MainEv",
+		},
+		testStack(100, 1, 2, 4),
+		testStack(200, 1, 3, 4),
+		testStack(400, 1, 3, 5),
+	)
+	s.Profile.Header = &Stats{InuseObjects: 3, InuseBytes: 700}
+	return s
+}
+
+func TestFilterStacks(t *testing.T) {
+	for _, test := range []struct {
+		focus, ignore string
+		shown         []int
+		dropped       int
+	}{
+		{"", "", []int{100, 200, 400}, 0},
+		{"net::", "", []int{200, 400}, 100},
+		{`^base::`, "", []int{100, 400}, 200},
+		{"", "Thread", []int{100, 200}, 400},
+		{`Socket::Read\(\)$`, "main", []int{400}, 300},
+		{"nothing", "", nil, 700},
+	} {
+		s := filterState()
+		s.Params.Focus, s.Params.Ignore = test.focus, test.ignore
+		if err := s.Analyze(); err != nil {
+			t.Errorf("%q, %q: %s", test.focus, test.ignore, err)
+			continue
+		}
+		focus, _ := compileFilter("focus", test.focus)
+		ignore, _ := compileFilter("ignore", test.ignore)
+		stacks, dropped := s.FilterStacks(s.Profile.stacks, focus, ignore)
+		var shown []int
+		total := 0
+		for _, stack := range stacks {
+			shown = append(shown, stack.Stats.InuseBytes)
+			total += stack.Stats.InuseBytes
+		}
+		if !reflect.DeepEqual(shown, test.shown) || dropped.InuseBytes != test.dropped {
+			t.Errorf("%q, %q: shown %v, dropped %d; want %v, %d", test.focus, test.ignore, shown, dropped.InuseBytes, test.shown, test.dropped)
+		}
+		if s.Shown.InuseBytes != total || s.Filtered.InuseBytes != test.dropped {
+			t.Errorf("%q, %q: totals %d shown, %d filtered; want %d, %d", test.focus, test.ignore, s.Shown.InuseBytes, s.Filtered.InuseBytes, total, test.dropped)
+		}
+		// malloc, the leaf of every stack, holds all that's shown.
+		if total > 0 {
+			if n := s.Graph.nodes[1]; n == nil || n.cum.InuseBytes != total || s.Graph.NodeSizes[0] != total {
+				t.Errorf("%q, %q: malloc's node %+v, sizes %v; want %d", test.focus, test.ignore, n, s.Graph.NodeSizes, total)
+			}
+		} else if len(s.Graph.nodes) != 0 {
+			t.Errorf("%q, %q: got nodes for no stacks", test.focus, test.ignore)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	s := filterState()
+	s.Params.Focus = "("
+	if err := s.Analyze(); err == nil {
+		t.Errorf("bad focus: want an error")
+	}
+	s.Params.Focus, s.Params.Ignore = "", "[z-a]"
+	if err := s.Analyze(); err == nil {
+		t.Errorf("bad ignore: want an error")
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file writes the shown stacks as flame graphs: towers of frames
+// with the outermost caller at the bottom and the allocating function on
+// top, each as wide as what it holds, stacks sharing callers merged.
+// They come as folded stacks, one line per distinct stack of
+//   outermost;...;allocating function value
+// as Brendan Gregg's flamegraph.pl reads, or as an interactive SVG.
+
+// addrLabel is the Label of the function at addr.
+func (s *state) addrLabel(addr uint64) string {
+	n := s.Graph.nodes[addr]
+	if n == nil {
+		n = &Node{addr: addr, name: s.names[addr]}
+	}
+	return s.Label(n)
+}
+
+// flameName is the name of the function at addr in a flame graph.
+func (s *state) flameName(addr uint64) string {
+	// Semicolons separate frames in folded stacks.
+	return strings.Replace(s.addrLabel(addr), ";", ":", -1)
+}
+
+// Folded writes the shown stacks in folded form, measured by
+// s.Params.Metric and sorted.
+func (s *state) Folded(w io.Writer) {
+	m := s.Params.Metric
+	folded := make(map[string]int)
+	names := make(map[uint64]string)
+	for _, stack := range s.stacks {
+		value := stack.Stats.Get(m)
+		if value <= 0 {
+			continue
+		}
+		frames := make([]string, len(stack.Stack))
+		for i, addr := range stack.Stack {
+			name, ok := names[addr]
+			if !ok {
+				name = s.flameName(addr)
+				names[addr] = name
+			}
+			frames[len(frames)-1-i] = name
+		}
+		folded[strings.Join(frames, ";")] += value
+	}
+
+	lines := make([]string, 0, len(folded))
+	for line := range folded {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s %d\n", line, folded[line])
+	}
+}
+
+// A flameFrame is a function in a flame graph, above the frames of its
+// callers.
+type flameFrame struct {
+	addr    uint64
+	name    string
+	library string
+	value   int
+	// Keyed by address.
+	children map[uint64]*flameFrame
+}
+
+// flameTree merges the shown stacks into a tree of frames, under a root
+// holding everything.  Frames take the library of the mapping holding
+// their address, or of their caller if there's none, as for functions
+// inlined into it.
+func (s *state) flameTree() *flameFrame {
+	m := s.Params.Metric
+	root := &flameFrame{name: "all", children: make(map[uint64]*flameFrame)}
+	for _, stack := range s.stacks {
+		value := stack.Stats.Get(m)
+		if value <= 0 {
+			continue
+		}
+		root.value += value
+		f := root
+		for i := len(stack.Stack) - 1; i >= 0; i-- {
+			addr := stack.Stack[i]
+			child := f.children[addr]
+			if child == nil {
+				child = &flameFrame{addr: addr, name: s.flameName(addr), library: f.library, children: make(map[uint64]*flameFrame)}
+				if e := s.Profile.maps.Search(addr); e != nil {
+					child.library = e.path
+				}
+				f.children[addr] = child
+			}
+			child.value += value
+			f = child
+		}
+	}
+	return root
+}
+
+// sorted returns f's callees in name order, as flamegraph.pl lays them
+// out.
+func (f *flameFrame) sorted() []*flameFrame {
+	children := make([]*flameFrame, 0, len(f.children))
+	for _, child := range f.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].name != children[j].name {
+			return children[i].name < children[j].name
+		}
+		return children[i].addr < children[j].addr
+	})
+	return children
+}
+
+func (f *flameFrame) depth() int {
+	d := 0
+	for _, child := range f.children {
+		if cd := child.depth() + 1; cd > d {
+			d = cd
+		}
+	}
+	return d
+}
+
+// flameColor picks a warm fill for a frame, its hue set by its library
+// and its shade varying a little with its name.
+func flameColor(library, name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(library))
+	hue := h.Sum32() % 60
+	h = fnv.New32a()
+	h.Write([]byte(name))
+	light := 50 + h.Sum32()%20
+	if len(library) == 0 {
+		return fmt.Sprintf("hsl(0, 0%%, %d%%)", light+10)
+	}
+	return fmt.Sprintf("hsl(%d, 80%%, %d%%)", hue, light)
+}
+
+// Layout of flame graph SVGs, in pixels.
+const (
+	flameWidth       = 1200
+	flamePad         = 10
+	flameTop         = 40
+	flameFrameHeight = 16
+	flameCharWidth   = 6.6
+	// Frames narrower than this aren't drawn.
+	flameMinWidth = 0.1
+)
+
+// fitFlameName cuts name down to what fits in a frame width pixels wide.
+func fitFlameName(name string, width float64) string {
+	chars := int((width - 6) / flameCharWidth)
+	if chars < 3 {
+		return ""
+	}
+	if len(name) <= chars {
+		return name
+	}
+	return name[:chars-2] + ".."
+}
+
+// FlameGraph writes the shown stacks as an SVG flame graph.  Clicking a
+// frame zooms in on it, and frames can be searched for by regexp.
+func (s *state) FlameGraph(w io.Writer) {
+	m := s.Params.Metric
+	root := s.flameTree()
+	depth := root.depth()
+	height := flameTop + (depth+1)*flameFrameHeight + flamePad
+
+	fmt.Fprintf(w, `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" onload="init()">
+<style>
+text { font-family: Verdana, sans-serif; font-size: 11px; fill: black; }
+g.f text { pointer-events: none; }
+g.f:hover rect { stroke: black; stroke-width: 0.5; }
+#title { font-size: 16px; }
+.button { cursor: pointer; }
+</style>
+<rect x="0" y="0" width="%d" height="%d" fill="#fafaf0"/>
+<text id="title" x="%d" y="24" text-anchor="middle">%s</text>
+<text id="unzoom" class="button" x="%d" y="24" style="display: none" onclick="zoom(frames[0])">Reset zoom</text>
+<text id="search" class="button" x="%d" y="24" text-anchor="end" onclick="search()">Search</text>
+<text id="matched" x="%d" y="%d" text-anchor="end"></text>
+`, flameWidth, height, flameWidth, height, flameWidth, height,
+		flameWidth/2, html.EscapeString(fmt.Sprintf("%s of %s", m.Format(root.value, false), m)),
+		flamePad, flameWidth-flamePad, flameWidth-flamePad, height-2)
+
+	var draw func(f *flameFrame, x, d int)
+	draw = func(f *flameFrame, x, d int) {
+		frac := float64(f.value) / float64(root.value)
+		if frac*(flameWidth-2*flamePad) < flameMinWidth {
+			return
+		}
+		left := float64(x) / float64(root.value)
+		px := flamePad + left*(flameWidth-2*flamePad)
+		pw := frac * (flameWidth - 2*flamePad)
+		y := height - flamePad - (d+1)*flameFrameHeight
+		name := html.EscapeString(f.name)
+		fill := flameColor(f.library, f.name)
+		fmt.Fprintf(w, `<g class="f" data-x="%g" data-w="%g" data-d="%d" data-n="%s" data-c="%s" onclick="zoom(this.frame)">`,
+			left, frac, d, name, fill)
+		title := fmt.Sprintf("%s (%s, %.2f%%)", f.name, m.Format(f.value, false), frac*100)
+		if len(f.library) > 0 {
+			title += " in " + f.library
+		}
+		fmt.Fprintf(w, "<title>%s</title>", html.EscapeString(title))
+		fmt.Fprintf(w, `<rect x="%.2f" y="%d" width="%.2f" height="%d" fill="%s" rx="2"/>`, px, y, pw, flameFrameHeight-1, fill)
+		fmt.Fprintf(w, `<text x="%.2f" y="%d">%s</text></g>`+"\n", px+3, y+flameFrameHeight-4, html.EscapeString(fitFlameName(f.name, pw)))
+		for _, child := range f.sorted() {
+			draw(child, x, d+1)
+			x += child.value
+		}
+	}
+	if root.value > 0 {
+		draw(root, 0, 0)
+	}
+
+	fmt.Fprintf(w, `<script><![CDATA[
+var W = %d, P = %d, charWidth = %g, matchColor = "rgb(230, 0, 230)";
+var frames = [];
+function init() {
+  var gs = document.querySelectorAll("g.f");
+  for (var i = 0; i < gs.length; i++) {
+    var g = gs[i];
+    var f = {
+      g: g, rect: g.querySelector("rect"), text: g.querySelector("text"),
+      x: parseFloat(g.getAttribute("data-x")), w: parseFloat(g.getAttribute("data-w")),
+      d: parseInt(g.getAttribute("data-d")), name: g.getAttribute("data-n"), fill: g.getAttribute("data-c")
+    };
+    g.frame = f;
+    frames.push(f);
+  }
+}
+function fit(f, x, w) {
+  var px = P + x * (W - 2 * P), pw = w * (W - 2 * P);
+  f.rect.setAttribute("x", px);
+  f.rect.setAttribute("width", pw);
+  f.text.setAttribute("x", px + 3);
+  var chars = Math.floor((pw - 6) / charWidth);
+  f.text.textContent = chars < 3 ? "" : f.name.length <= chars ? f.name : f.name.substring(0, chars - 2) + "..";
+}
+var eps = 1e-9;
+function zoom(z) {
+  for (var i = 0; i < frames.length; i++) {
+    var f = frames[i];
+    if (f.d >= z.d && f.x >= z.x - eps && f.x + f.w <= z.x + z.w + eps) {
+      f.g.style.display = "";
+      f.g.style.opacity = 1;
+      fit(f, (f.x - z.x) / z.w, f.w / z.w);
+    } else if (f.d < z.d && f.x <= z.x + eps && f.x + f.w >= z.x + z.w - eps) {
+      // What called the zoomed-in frame.
+      f.g.style.display = "";
+      f.g.style.opacity = 0.5;
+      fit(f, 0, 1);
+    } else {
+      f.g.style.display = "none";
+    }
+  }
+  document.getElementById("unzoom").style.display = z.d == 0 ? "none" : "";
+}
+function search() {
+  var term = prompt("Search for frames matching (regexp):", "");
+  if (term === null) {
+    return;
+  }
+  var re = null;
+  if (term !== "") {
+    try {
+      re = new RegExp(term);
+    } catch (e) {
+      alert(e);
+      return;
+    }
+  }
+  var matched = [];
+  for (var i = 0; i < frames.length; i++) {
+    var f = frames[i];
+    var m = re !== null && re.test(f.name);
+    f.rect.setAttribute("fill", m ? matchColor : f.fill);
+    if (m) {
+      matched.push(f);
+    }
+  }
+  // Total what matches, not counting frames over other matches twice.
+  matched.sort(function(a, b) { return a.x - b.x || a.d - b.d; });
+  var total = 0, end = -1;
+  for (var i = 0; i < matched.length; i++) {
+    var f = matched[i];
+    if (f.x + f.w > end) {
+      total += f.x + f.w - Math.max(f.x, end);
+      end = f.x + f.w;
+    }
+  }
+  document.getElementById("matched").textContent = re === null ? "" : "Matched: " + (total * 100).toFixed(1) + "%%";
+}
+]]></script>
+</svg>
+`, flameWidth, flamePad, flameCharWidth)
+}
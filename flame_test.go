@@ -0,0 +1,130 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+// flameState returns an analyzed state whose stacks, leaf first, run
+// through an executable and a library.
+func flameState(focus string) *state {
+	s := testState(&params{NodeKeepCount: 100, Simplify: simplifyNoTemplates, Focus: focus},
+		map[uint64]string{
+			0x1000: "main",
+			0x1100: "_ZN4base6Widget3RunEv",
+			0x1200: "_Z5parseRKSt6vectorIiSaIiEE",
+			0x7000: "malloc",
+		},
+		testStack(100, 0x7000, 0x1100, 0x1000),
+		testStack(200, 0x7000, 0x1200, 0x1000),
+		testStack(300, 0x7000, 0x1200, 0x1000),
+		testStack(400, 0x1100, 0x1000),
+	)
+	s.Profile.maps = testMaps
+	if err := s.Analyze(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestFolded(t *testing.T) {
+	for _, test := range []struct {
+		focus, want string
+	}{
+		{"", `main;base::Widget::Run 400
+main;base::Widget::Run;malloc 100
+main;parse;malloc 500
+`},
+		{"parse", `main;parse;malloc 500
+`},
+	} {
+		var out bytes.Buffer
+		flameState(test.focus).Folded(&out)
+		if out.String() != test.want {
+			t.Errorf("focus %q: got\n%swant\n%s", test.focus, out.String(), test.want)
+		}
+	}
+}
+
+func TestFlameGraph(t *testing.T) {
+	s := flameState("")
+	var out bytes.Buffer
+	s.FlameGraph(&out)
+
+	// It must be well-formed, and have a frame for each function in
+	// each of the stacks it's reached by, plus one for everything.
+	type frame struct{ name, fill string }
+	var frames []frame
+	d := xml.NewDecoder(&out)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("bad SVG: %s", err)
+		}
+		if e, ok := tok.(xml.StartElement); ok && e.Name.Local == "g" {
+			var f frame
+			for _, a := range e.Attr {
+				switch a.Name.Local {
+				case "data-n":
+					f.name = a.Value
+				case "data-c":
+					f.fill = a.Value
+				}
+			}
+			frames = append(frames, f)
+		}
+	}
+	var names []string
+	fills := make(map[string]string)
+	for _, f := range frames {
+		names = append(names, f.name)
+		fills[f.name] = f.fill
+	}
+	if got, want := strings.Join(names, ","), "all,main,base::Widget::Run,malloc,parse,malloc"; got != want {
+		t.Errorf("frames %s, want %s", got, want)
+	}
+	// Frames are coloured by library: grey for none, and hues differing
+	// between the executable and libc.
+	if !strings.HasPrefix(fills["all"], "hsl(0, 0%") {
+		t.Errorf("root's fill %q isn't grey", fills["all"])
+	}
+	hue := func(fill string) string { return strings.SplitN(fill, ",", 2)[0] }
+	if hue(fills["main"]) != hue(fills["parse"]) || hue(fills["main"]) == hue(fills["malloc"]) {
+		t.Errorf("fills %v don't follow libraries", fills)
+	}
+}
+
+func TestFitFlameName(t *testing.T) {
+	for _, test := range []struct {
+		width float64
+		want  string
+	}{
+		{1000, "std::vector::push_back"},
+		{6 + 10*flameCharWidth, "std::vec.."},
+		{6 + 2*flameCharWidth, ""},
+	} {
+		if got := fitFlameName("std::vector::push_back", test.width); got != test.want {
+			t.Errorf("%g pixels: %q, want %q", test.width, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"log"
+	"sort"
+)
+
+// This file symbolizes Go binaries using the runtime's pc/line table
+// (.gopclntab), which unlike the ELF symbol table knows source positions
+// and, since Go 1.20, which calls were inlined at each pc.  The inline
+// tree isn't exposed by debug/gosym, so it is decoded directly following
+// the layout in runtime/symtab.go and runtime/symtabinl.go.
+
+const (
+	go120PCLnTabMagic = 0xfffffff1
+
+	pcdataInlTreeIndex = 2
+	funcdataInlTree    = 3
+
+	inlinedCallSize = 16
+)
+
+// goInlineTable answers which functions were inlined at a given pc.
+type goInlineTable struct {
+	order   binary.ByteOrder
+	pclntab []byte
+	minLC   uint32
+	ptrSize int
+
+	textStart   uint64
+	funcnametab []byte
+	cutab       []byte
+	filetab     []byte
+	pctab       []byte
+	functab     []byte
+	nfunc       int
+
+	// Contents of the image starting at go:func.*, which funcdata
+	// offsets are relative to, and its address.
+	gofunc     []byte
+	gofuncAddr uint64
+}
+
+func (t *goInlineTable) uintptr(b []byte) uint64 {
+	if t.ptrSize == 4 {
+		return uint64(t.order.Uint32(b))
+	}
+	return t.order.Uint64(b)
+}
+
+// goFuncAddr returns the address of go:func.*, or 0, from f's symbols.
+func goFuncAddr(syms []elf.Symbol) uint64 {
+	for _, sym := range syms {
+		if sym.Name == "go:func.*" {
+			return sym.Value
+		}
+	}
+	return 0
+}
+
+// newGoInlineTable parses the pclntab header, returning nil if the
+// binary's format predates inline tree support or lacks go:func.*, at
+// gofunc.
+func newGoInlineTable(f *elf.File, pclntab []byte, text, gofunc uint64) *goInlineTable {
+	if gofunc == 0 {
+		return nil
+	}
+	if len(pclntab) < 8 {
+		return nil
+	}
+	t := &goInlineTable{order: f.ByteOrder, pclntab: pclntab}
+	if t.order.Uint32(pclntab) != go120PCLnTabMagic {
+		return nil
+	}
+	t.minLC = uint32(pclntab[6])
+	t.ptrSize = int(pclntab[7])
+
+	header := func(n int) uint64 {
+		return t.uintptr(pclntab[8+n*t.ptrSize:])
+	}
+	t.nfunc = int(header(0))
+	t.textStart = header(2)
+	if t.textStart == 0 {
+		// Left for the runtime to fill in, as debug/gosym also assumes.
+		t.textStart = text
+	}
+	t.funcnametab = pclntab[header(3):]
+	t.cutab = pclntab[header(4):]
+	t.filetab = pclntab[header(5):]
+	t.pctab = pclntab[header(6):]
+	t.functab = pclntab[header(7):]
+
+	for _, sect := range f.Sections {
+		if sect.Type != elf.SHT_PROGBITS || gofunc < sect.Addr || gofunc >= sect.Addr+sect.Size {
+			continue
+		}
+		data, err := sect.Data()
+		if err != nil {
+			return nil
+		}
+		t.gofunc = data[gofunc-sect.Addr:]
+		t.gofuncAddr = gofunc
+		return t
+	}
+	return nil
+}
+
+// read returns size bytes at offset off from go:func.*.
+func (t *goInlineTable) read(off, size uint64) []byte {
+	if off+size > uint64(len(t.gofunc)) {
+		return nil
+	}
+	return t.gofunc[off : off+size]
+}
+
+// cstring returns the NUL-terminated string at the start of b.
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func (t *goInlineTable) funcName(nameOff int32) string {
+	return cstring(t.funcnametab[nameOff:])
+}
+
+// findFunc returns the _func record containing pc.
+func (t *goInlineTable) findFunc(pc uint64) []byte {
+	if pc < t.textStart {
+		return nil
+	}
+	off := uint32(pc - t.textStart)
+	i := sort.Search(t.nfunc, func(i int) bool {
+		return t.order.Uint32(t.functab[i*8:]) > off
+	})
+	if i == 0 {
+		return nil
+	}
+	funcoff := t.order.Uint32(t.functab[(i-1)*8+4:])
+	return t.functab[funcoff:]
+}
+
+func readVarint(p []byte) (uint32, []byte) {
+	var v, shift uint32
+	for i, b := range p {
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p[i+1:]
+		}
+		shift += 7
+	}
+	return v, nil
+}
+
+// pcvalue decodes the value of a pc-value table at targetpc, or -1.
+func (t *goInlineTable) pcvalue(off uint32, entry, targetpc uint64) int32 {
+	p := t.pctab[off:]
+	val := int32(-1)
+	pc := entry
+	for first := true; ; first = false {
+		uvdelta, rest := readVarint(p)
+		if rest == nil || (uvdelta == 0 && !first) {
+			return -1
+		}
+		if uvdelta&1 != 0 {
+			uvdelta = ^(uvdelta >> 1)
+		} else {
+			uvdelta >>= 1
+		}
+		val += int32(uvdelta)
+		pcdelta, rest := readVarint(rest)
+		pc += uint64(pcdelta * t.minLC)
+		if targetpc < pc {
+			return val
+		}
+		p = rest
+	}
+}
+
+// inlinedCalls returns the _func record containing pc, its entry, and
+// the inlinedCall records of the calls inlined at pc, innermost first.
+func (t *goInlineTable) inlinedCalls(pc uint64) (fn []byte, entry uint64, calls [][]byte) {
+	fn = t.findFunc(pc)
+	if fn == nil {
+		return nil, 0, nil
+	}
+	const funcSize = 44 // sizeof(runtime._func) in Go 1.20+.
+	entry = t.textStart + uint64(t.order.Uint32(fn[0:]))
+	npcdata := t.order.Uint32(fn[28:])
+	nfuncdata := uint32(fn[43])
+	if npcdata <= pcdataInlTreeIndex || nfuncdata <= funcdataInlTree {
+		return fn, entry, nil
+	}
+	inlIndexOff := t.order.Uint32(fn[funcSize+4*pcdataInlTreeIndex:])
+	inlTreeOff := t.order.Uint32(fn[funcSize+4*npcdata+4*funcdataInlTree:])
+	if inlIndexOff == 0 || inlTreeOff == ^uint32(0) {
+		return fn, entry, nil
+	}
+
+	for idx := t.pcvalue(inlIndexOff, entry, pc); idx >= 0; idx = t.pcvalue(inlIndexOff, entry, pc) {
+		call := t.read(uint64(inlTreeOff)+uint64(idx)*inlinedCallSize, inlinedCallSize)
+		if call == nil {
+			break
+		}
+		calls = append(calls, call)
+		pc = entry + uint64(t.order.Uint32(call[8:]))
+	}
+	return fn, entry, calls
+}
+
+// Inlined returns the functions inlined at pc, innermost first, not
+// including the physical function containing pc.
+func (t *goInlineTable) Inlined(pc uint64) []string {
+	_, _, calls := t.inlinedCalls(pc)
+	var names []string
+	for _, call := range calls {
+		names = append(names, t.funcName(int32(t.order.Uint32(call[4:]))))
+	}
+	return names
+}
+
+// position returns the source position of pc in the function fn, as
+// the innermost function inlined at pc sees it.
+func (t *goInlineTable) position(fn []byte, entry, pc uint64) srcLine {
+	var pos srcLine
+	if off := t.order.Uint32(fn[20:]); off != 0 {
+		if fileno := t.pcvalue(off, entry, pc); fileno >= 0 {
+			i := (uint64(t.order.Uint32(fn[32:])) + uint64(fileno)) * 4
+			if i+4 <= uint64(len(t.cutab)) {
+				if fileOff := t.order.Uint32(t.cutab[i:]); uint64(fileOff) < uint64(len(t.filetab)) {
+					pos.file = cstring(t.filetab[fileOff:])
+				}
+			}
+		}
+	}
+	if off := t.order.Uint32(fn[24:]); off != 0 {
+		if line := t.pcvalue(off, entry, pc); line >= 0 {
+			pos.line = int(line)
+		}
+	}
+	return pos
+}
+
+// Lines returns the source position of pc in each function inlined
+// there, innermost first, and then in the physical function.
+func (t *goInlineTable) Lines(pc uint64) []srcLine {
+	fn, entry, calls := t.inlinedCalls(pc)
+	if fn == nil {
+		return nil
+	}
+	// Each inlined call records the pc of its call site, which has the
+	// position of the call in the function it was inlined into.
+	lines := []srcLine{t.position(fn, entry, pc)}
+	for _, call := range calls {
+		parentPC := entry + uint64(t.order.Uint32(call[8:]))
+		lines = append(lines, t.position(fn, entry, parentPC))
+	}
+	return lines
+}
+
+// loadGoSyms returns symbols for the Go functions in f, with source
+// positions, or nil if f isn't a Go binary.  elfsyms are f's symbols.
+func loadGoSyms(f *elf.File, elfsyms []elf.Symbol) []Symbol {
+	pclnSect := f.Section(".gopclntab")
+	textSect := f.Section(".text")
+	if pclnSect == nil || textSect == nil {
+		return nil
+	}
+	pclntab, err := pclnSect.Data()
+	check(err)
+	var symtab []byte
+	if sect := f.Section(".gosymtab"); sect != nil {
+		symtab, err = sect.Data()
+		check(err)
+	}
+	table, err := gosym.NewTable(symtab, gosym.NewLineTable(pclntab, textSect.Addr))
+	if err != nil {
+		log.Printf("reading Go symbols: %s", err)
+		return nil
+	}
+
+	var inl inliner
+	if t := newGoInlineTable(f, pclntab, textSect.Addr, goFuncAddr(elfsyms)); t != nil {
+		inl = t
+	} else {
+		log.Printf("no Go inline tree available")
+	}
+
+	syms := make([]Symbol, 0, len(table.Funcs))
+	for i := range table.Funcs {
+		fn := &table.Funcs[i]
+		if fn.End <= fn.Entry {
+			continue
+		}
+		file, line, _ := table.PCToLine(fn.Entry)
+		syms = append(syms, Symbol{
+			addr: fn.Entry, size: fn.End - fn.Entry, name: fn.Name,
+			file: file, line: line, inl: inl,
+		})
+	}
+	return syms
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// goSymsProg calls leaf through inlined, which the compiler inlines into
+// main.
+const goSymsProg = `package main
+
+//go:noinline
+func leaf() []byte {
+	return make([]byte, 64)
+}
+
+func inlined() []byte {
+	return leaf()
+}
+
+func main() {
+	println(len(inlined()))
+}
+`
+
+func TestLoadGoSyms(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "prog.go")
+	if err := os.WriteFile(src, []byte(goSymsProg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "prog")
+	cmd := exec.Command(goTool, "build", "-o", bin, src)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %s\n%s", err, out)
+	}
+
+	f, err := elf.Open(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	elfsyms, err := readElfSymbols(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms := NewSymbols(loadGoSyms(f, elfsyms))
+	var mainSym *Symbol
+	for i := 0; i < syms.Len(); i++ {
+		if sym := syms.At(i); sym.name == "main.main" {
+			mainSym = sym
+		}
+	}
+	if mainSym == nil {
+		t.Fatal("no main.main")
+	}
+	if mainSym.file != src || mainSym.line != 12 {
+		t.Errorf("main.main at %s:%d, want %s:12", mainSym.file, mainSym.line, src)
+	}
+
+	// The cache reattaches the inlining from the pclntab.
+	var cache bytes.Buffer
+	if err := encodeSymbolCache(&cache, syms); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := decodeSymbolCache(f, cache.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the return address of the call to leaf.
+	want := []srcLine{{src, 9}, {src, 13}}
+	found := false
+	for pc := mainSym.addr + 1; pc <= mainSym.addr+mainSym.size; pc++ {
+		if !reflect.DeepEqual(syms.Lookup(pc-1).Inlined(pc), []string{"main.inlined"}) {
+			continue
+		}
+		found = true
+		if got := syms.Lookup(pc - 1).Lines(pc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#x: got lines %v, want %v", pc, got, want)
+		}
+		if got := cached.Lookup(pc - 1).Lines(pc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%#x: got lines %v from the cache, want %v", pc, got, want)
+		}
+	}
+	if !found {
+		t.Errorf("main.inlined wasn't inlined into main.main")
+	}
+}
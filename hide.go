@@ -0,0 +1,73 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// This file decides which frames to strip from the top of stacks, so
+// that what allocators allocate is charged to the code calling them
+// rather than to malloc and operator new.
+
+// Allocator entry points and internals, as demangled names.
+var defaultHidePatterns = []string{
+	// glibc.
+	`^(__libc_)?(malloc|calloc|realloc|reallocarray|free|memalign|posix_memalign|aligned_alloc|valloc|pvalloc)$`,
+	`^(_int_malloc|_int_realloc|_int_memalign|sysmalloc|tcache_init|malloc_hook_ini|realloc_hook_ini)$`,
+	// libstdc++ and libc++.
+	`^operator (new|delete)(\[\])?\(`,
+	`^std::(__new_allocator|allocator|allocator_traits|__allocated_ptr)<.*>::(allocate|construct)\(`,
+	`^__gnu_cxx::new_allocator<.*>::(allocate|construct)\(`,
+	`^std::__libcpp_allocate\(`,
+	// tcmalloc, and gperftools' heap profiler.
+	`^(tc_|tcmalloc::)`,
+	`^\(anonymous namespace\)::(do_malloc|do_calloc|do_realloc|do_memalign|do_malloc_or_cpp_alloc|cpp_alloc|retry_malloc|nop_oom_handler)\b`,
+	`^(MallocHook::|NewHook\(|RecordAlloc\()`,
+	// jemalloc.
+	`^(je_|imalloc|ialloc|iralloc|ipalloc|arena_malloc|tcache_alloc_|mallocx$|rallocx$|do_rallocx)`,
+}
+
+// compileHide returns a regexp matching the names of frames to hide,
+// the defaults if defaults is set and extra if it isn't empty, or nil
+// if there's nothing to hide.
+func compileHide(defaults bool, extra string) (*regexp.Regexp, error) {
+	var patterns []string
+	if defaults {
+		patterns = append(patterns, defaultHidePatterns...)
+	}
+	if len(extra) > 0 {
+		if _, err := regexp.Compile(extra); err != nil {
+			return nil, fmt.Errorf("bad -hide regexp: %s", err)
+		}
+		patterns = append(patterns, extra)
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	return regexp.MustCompile("(?:" + strings.Join(patterns, ")|(?:") + ")"), nil
+}
+
+// hideFrames strips the frames that hidden says to from the top of
+// stack, leaving at least its outermost one.
+func hideFrames(stack []uint64, hidden func(addr uint64) bool) []uint64 {
+	i := 0
+	for i < len(stack)-1 && hidden(stack[i]) {
+		i++
+	}
+	return stack[i:]
+}
@@ -0,0 +1,116 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultHidePatterns(t *testing.T) {
+	re, err := compileHide(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		hide bool
+	}{
+		{"malloc", true},
+		{"__libc_calloc", true},
+		{"_int_malloc", true},
+		{"realloc", true},
+		{"operator new(unsigned long)", true},
+		{"operator new[](unsigned long, std::align_val_t)", true},
+		{"std::__new_allocator<int>::allocate(unsigned long, void const*)", true},
+		{"__gnu_cxx::new_allocator<char>::allocate(unsigned long, void const*)", true},
+		{"std::allocator_traits<std::allocator<int> >::allocate(std::allocator<int>&, unsigned long)", true},
+		{"tc_new", true},
+		{"tcmalloc::ThreadCache::Allocate(unsigned long, unsigned int)", true},
+		{"(anonymous namespace)::do_malloc_or_cpp_alloc(unsigned long)", true},
+		{"MallocHook::InvokeNewHookSlow(void const*, unsigned long)", true},
+		{"je_malloc", true},
+		{"imalloc_body", true},
+
+		{"mallocator", false},
+		{"my_malloc", false},
+		{"Widget::operator new(unsigned long)", false},
+		{"std::vector<int, std::allocator<int> >::push_back(int&&)", false},
+		{"(anonymous namespace)::do_something()", false},
+		{"main", false},
+		{"", false},
+	} {
+		if got := re.MatchString(test.name); got != test.hide {
+			t.Errorf("%q: hidden %v, want %v", test.name, got, test.hide)
+		}
+	}
+}
+
+func TestCompileHide(t *testing.T) {
+	if re, err := compileHide(false, ""); re != nil || err != nil {
+		t.Errorf("nothing to hide: got %v, %v", re, err)
+	}
+	re, err := compileHide(false, `^Arena::`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.MatchString("Arena::Alloc(int)") || re.MatchString("malloc") {
+		t.Errorf("-hide without defaults: got %v", re)
+	}
+	re, err = compileHide(true, `^Arena::`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.MatchString("Arena::Alloc(int)") || !re.MatchString("malloc") {
+		t.Errorf("-hide with defaults: got %v", re)
+	}
+	if _, err := compileHide(true, "("); err == nil {
+		t.Errorf("bad -hide: want an error")
+	}
+}
+
+func TestCleanupStacksHide(t *testing.T) {
+	syms := NewSymbols([]Symbol{
+		{addr: 0x100, size: 0x10, name: "malloc"},
+		{addr: 0x200, size: 0x10, name: "_Znwm"},
+		{addr: 0x300, size: 0x10, name: "_ZN6Widget4MakeEv"},
+		{addr: 0x400, size: 0x10, name: "main"},
+	})
+	stacks := []*Stack{
+		{Stats: &Stats{}, Stack: []uint64{0x104, 0x208, 0x304, 0x404}},
+		{Stats: &Stats{}, Stack: []uint64{0x104, 0x404}},
+		// Nothing but allocators, as when they allocate for themselves.
+		{Stats: &Stats{}, Stack: []uint64{0x104, 0x204}},
+		// Frames without symbols aren't hidden.
+		{Stats: &Stats{}, Stack: []uint64{0x900, 0x104}},
+	}
+	hide, _ := compileHide(true, "")
+	d := NewDemangler()
+	CleanupStacks(stacks, syms, true, func(name string) bool {
+		name, _ = d.Demangle(name)
+		return hide.MatchString(name)
+	})
+	for i, want := range [][]uint64{
+		{0x304, 0x404},
+		{0x404},
+		// operator new, known by the first address seen in it.
+		{0x208},
+		{0x900, 0x104},
+	} {
+		if !reflect.DeepEqual(stacks[i].Stack, want) {
+			t.Errorf("stack %d: got %x, want %x", i, stacks[i].Stack, want)
+		}
+	}
+}
@@ -20,28 +20,67 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 	"runtime"
 	"io"
 	"sort"
+	"strings"
 )
 
 var flag_http *string = flag.String("http", "", "http service address (e.g. ':8000')")
 var flag_profile *bool = flag.Bool("profile", false, "whether to profile hp itself")
 var flag_syms *string = flag.String("syms", "", "load symbols from file instead of binary")
-var flags_builtin_demangle *bool = flag.Bool("builtin-demangler", false, "whether to use built-in linux demangler")
+var flag_syms_format *string = flag.String("syms-format", "auto", "format of the -syms file: 'hp' (hex address, decimal size, name), 'nm' (nm -S output), 'perf' (a perf JIT map) or 'auto' to tell from the file")
+var flag_symbol_cache *bool = flag.Bool("symbol-cache", false, "cache symbol tables on disk, keyed by build id, so later runs load them faster")
+var flag_breakpad *string = flag.String("breakpad", "", "comma-separated Breakpad .sym files or symbol store directories")
+var flag_cppfilt *bool = flag.Bool("cppfilt", false, "fall back to c++filt for the C++ names the built-in demangler can't demangle")
+var flag_demangle_cache *bool = flag.Bool("demangle-cache", false, "remember demangled names on disk across runs")
+var flag_simplify *string = flag.String("simplify", "notemplates", "how much of C++ names to show: 'full', 'noparams' or 'notemplates'")
+var flag_rules *string = flag.String("rules", "", "file of 'regexp => replacement' rewrites for demangled names")
+var flag_group *string = flag.String("group", "none", "box functions by their 'namespace' (outermost scope) or 'class' (whole enclosing scope), or 'none'")
+var flag_focus *string = flag.String("focus", "", "only show stacks with a function whose demangled name matches this regexp")
+var flag_ignore *string = flag.String("ignore", "", "leave out stacks with a function whose demangled name matches this regexp")
+var flag_hide_allocators *bool = flag.Bool("hide-allocators", true, "charge what malloc, operator new and other allocators allocate to their callers")
+var flag_hide *string = flag.String("hide", "", "regexp of more functions to charge to their callers, matched against demangled names")
+var flag_base *string = flag.String("base", "", "profile to subtract, showing what changed since it")
+var flag_metric *string = flag.String("metric", "inuse_space", "what to measure functions by: 'inuse_space', 'inuse_objects', 'alloc_space' or 'alloc_objects'")
+var flag_nodecount *int = flag.Int("nodecount", 100, "how many of the biggest functions to show")
+var flag_text *bool = flag.Bool("text", false, "print a table of the biggest functions instead of a graph")
+var flag_cum *bool = flag.Bool("cum", false, "sort the -text table by cumulative rather than flat size")
+var flag_folded *bool = flag.Bool("folded", false, "print stacks in the folded form flame graph tools read instead of a graph")
+var flag_flame *bool = flag.Bool("flame", false, "write an SVG flame graph instead of a graph")
+var flag_callgrind *bool = flag.Bool("callgrind", false, "write callgrind format, for KCachegrind, instead of a graph")
+var flag_speedscope *bool = flag.Bool("speedscope", false, "write a speedscope file instead of a graph")
+var flag_json *bool = flag.Bool("json", false, "write the whole analysis as JSON instead of a graph")
+var flag_pprof *string = flag.String("pprof", "", "write the symbolized profile to this file as a gzipped profile.proto, for pprof")
+var flag_clones *string = flag.String("clones", "merge", "show compiler-split fragments like .cold and .part.N 'merge'd into their function or 'split' out")
 
 type state struct {
 	Profile   *Profile
-	demangler Demangler
+	// The profile to diff against, with -base, its stacks rebased onto
+	// Profile's addresses.
+	Base      *Profile
+	// Symbols for Profile.
+	syms      *Symbols
+	demangler *DemangleCache
+	rules     []rewriteRule
+	// Function names by address.
+	names     map[uint64]string
+	// The stacks that pass the filters, and their graph.
+	stacks    []*Stack
 	Graph     *graph
 	Params    *params
+	// Totals of the stacks graphed and of those filtered out.
+	Shown, Filtered Stats
 }
 
 type Node struct {
 	addr     uint64
 	name     string
 	cur, cum Stats
+	// In diffs, what cum was in the base profile.
+	baseCum  Stats
 }
 type edge struct {
 	src, dst *Node
@@ -49,22 +88,87 @@ type edge struct {
 type graph struct {
 	nodes map[uint64]*Node
 	NodeSizes []int
-	edges map[edge]int
+	edges map[edge]*Stats
+	// What NodeSizes measure.
+	metric metric
+	// Whether sizes are differences from a base profile, and so may be
+	// negative.
+	diff  bool
 }
 
 type params struct {
 	NodeKeepCount int
+	Metric        metric
+	Simplify      simplifyLevel
+	Group         groupBy
+	// Regexps for the stacks to show, or "".
+	Focus, Ignore string
 }
 
-func CleanupStacks(stacks []*Stack, syms Symbols) map[uint64]string {
+// How to group functions in the graph.
+type groupBy int
+
+const (
+	groupNone groupBy = iota
+	// By the outermost scope of their names, usually a namespace.
+	groupNamespace
+	// By the whole scope enclosing them, usually a class.
+	groupClass
+)
+
+var groupBys = []groupBy{groupNone, groupNamespace, groupClass}
+
+var groupByNames = []string{"none", "namespace", "class"}
+
+func (g groupBy) String() string {
+	return groupByNames[g]
+}
+
+func parseGroupBy(s string) (groupBy, error) {
+	for _, g := range groupBys {
+		if g.String() == s {
+			return g, nil
+		}
+	}
+	return 0, fmt.Errorf("bad grouping %q; want one of %s", s, strings.Join(groupByNames, ", "))
+}
+
+// Nodes for functions that were inlined and so have no address of their
+// own get addresses counting up from here.
+const inlineAddrBase = 1 << 63
+
+// CleanupStacks maps the addresses in stacks to one canonical address
+// per function, returning the function names.  If mergeClones is set,
+// compiler-split fragments of a function count as the function itself.
+// Functions that hide, if not nil, is true of are stripped from the top
+// of stacks, so their callers are charged with what they allocated.
+func CleanupStacks(stacks []*Stack, syms *Symbols, mergeClones bool, hide func(name string) bool) map[uint64]string {
 	// Map of symbol name -> address for that symbol.
 	addrs := make(map[string]uint64)
 	// Same map, in reverse.
 	names := make(map[uint64]string)
+	nextInlineAddr := uint64(inlineAddrBase)
+	hidden := make(map[uint64]bool)
+	isHidden := func(addr uint64) bool {
+		h, known := hidden[addr]
+		if !known {
+			name, ok := names[addr]
+			h = ok && hide(name)
+			hidden[addr] = h
+		}
+		return h
+	}
 
 	for _, stack := range stacks {
 		var last uint64
 		var newstack []uint64
+		push := func(addr uint64) {
+			if addr == last {
+				return
+			}
+			newstack = append(newstack, addr)
+			last = addr
+		}
 		for _, addr := range stack.Stack {
 
 			// Map address to symbol, then symbol back to a canonical
@@ -72,7 +176,23 @@ func CleanupStacks(stacks []*Stack, syms Symbols) map[uint64]string {
 			// function end up as a single node.
 			sym := syms.Lookup(addr)
 			if sym != nil {
+				// Functions inlined here become frames of their own,
+				// called by the function they were inlined into.
+				for _, name := range sym.Inlined(addr) {
+					inlAddr, known := addrs[name]
+					if !known {
+						inlAddr = nextInlineAddr
+						nextInlineAddr++
+						addrs[name] = inlAddr
+						names[inlAddr] = name
+					}
+					push(inlAddr)
+				}
+
 				name := sym.name
+				if mergeClones {
+					name, _ = splitCloneSuffix(name)
+				}
 
 				new_addr, known := addrs[name]
 				if known {
@@ -84,11 +204,10 @@ func CleanupStacks(stacks []*Stack, syms Symbols) map[uint64]string {
 				names[addr] = name
 			}
 
-			if addr == last {
-				continue
-			}
-			newstack = append(newstack, addr)
-			last = addr
+			push(addr)
+		}
+		if hide != nil {
+			newstack = hideFrames(newstack, isHidden)
 		}
 		stack.Stack = newstack
 	}
@@ -105,27 +224,92 @@ func (s *state) Label(n *Node) string {
 			label += fmt.Sprintf(" [%s]", e.path)
 		}
 	} else {
-		var err error
-		label, err = s.demangler.Demangle(label)
-		check(err)
-		label = RemoveTypes(label)
-		if len(label) > 60 {
-			label = label[:60] + "..."
+		name, clones := splitCloneSuffix(label)
+		if tree, err := s.demangler.DemangleTree(name); err == nil {
+			label = tree.Simplify(s.Params.Simplify, s.rules)
+		} else if demangled, _ := s.demangler.Demangle(name); demangled != name {
+			label = Simplify(demangled, s.Params.Simplify, s.rules)
+		} else {
+			// What can't be demangled comes back as is.  Names like
+			// Go's "main.(*state).Label" aren't C++, so there are no
+			// params or templates to cut from them.
+			label = Rewrite(name, s.rules)
+		}
+		for _, clone := range clones {
+			label += " [clone " + clone + "]"
 		}
 	}
 	return label
 }
 
+// Group returns the name of the group n is in, or "" if it isn't in one.
+// Only names the demangler can break into parts are grouped.
+func (s *state) Group(n *Node) string {
+	if s.Params.Group == groupNone || len(n.name) == 0 {
+		return ""
+	}
+	name, _ := splitCloneSuffix(n.name)
+	tree, err := s.demangler.DemangleTree(name)
+	if err != nil {
+		return ""
+	}
+	scope := tree.Scope()
+	if len(scope) == 0 {
+		return ""
+	}
+	if s.Params.Group == groupNamespace {
+		scope = scope[:1]
+	}
+	return simplifyParts(scope, s.Params.Simplify, s.rules)
+}
+
 func (s *state) SizeLabel(n *Node) string {
-	cur := n.cur.InuseBytes
-	cum := n.cum.InuseBytes
-	frac := float32(cum) / float32(s.Profile.Header.InuseBytes)
-	return fmt.Sprintf("%dk of %dk (%.1f%% of total)", cur/1024, cum/1024, frac * 100.0)
+	m := s.Params.Metric
+	cur := n.cur.Get(m)
+	cum := n.cum.Get(m)
+	if s.Graph.diff {
+		change := "new"
+		if base := n.baseCum.Get(m); base != 0 {
+			change = fmt.Sprintf("%+.1f%% from base", float32(cum) / float32(base) * 100.0)
+		}
+		return fmt.Sprintf("%s of %s (%s)", m.Format(cur, true), m.Format(cum, true), change)
+	}
+	var frac float32
+	if total := s.Shown.Get(m); total != 0 {
+		frac = float32(cum) / float32(total)
+	}
+	return fmt.Sprintf("%s of %s (%.1f%% of total)", m.Format(cur, false), m.Format(cum, false), frac * 100.0)
 }
 
 func (g *graph) Analyze(stacks []*Stack, names map[uint64]string) {
-	// Accumulate stats into nodes and edges.
+	g.add(stacks, names, false)
+	g.sizeNodes()
+}
+
+// AnalyzeDiff graphs the change from the base stacks to stacks, which
+// must use the same addresses for the same functions.
+func (g *graph) AnalyzeDiff(stacks, base []*Stack, names map[uint64]string) {
+	g.diff = true
+	g.add(stacks, names, false)
+	g.add(base, names, true)
+	g.sizeNodes()
+}
+
+// add accumulates stacks' stats into nodes and edges, or subtracts them
+// if they're from the base profile.  A function that recurs within a
+// stack counts that stack once in its cumulative stats, and so does a
+// call that recurs, so nothing exceeds the total.
+func (g *graph) add(stacks []*Stack, names map[uint64]string, base bool) {
+	seenNodes := make(map[*Node]bool)
+	seenEdges := make(map[edge]bool)
 	for _, stack := range stacks {
+		clear(seenNodes)
+		clear(seenEdges)
+		stats := stack.Stats
+		if base {
+			stats = &Stats{}
+			stats.Sub(stack.Stats)
+		}
 		var last *Node
 		for _, addr := range stack.Stack {
 			if last != nil && addr == last.addr {
@@ -139,20 +323,33 @@ func (g *graph) Analyze(stacks []*Stack, names map[uint64]string) {
 			}
 
 			if last == nil {
-				node.cur.Add(stack.Stats)
-			} else {
-				g.edges[edge{node, last}] += stack.Stats.InuseBytes
+				node.cur.Add(stats)
+			} else if e := (edge{node, last}); !seenEdges[e] {
+				seenEdges[e] = true
+				if g.edges[e] == nil {
+					g.edges[e] = &Stats{}
+				}
+				g.edges[e].Add(stats)
+			}
+			if !seenNodes[node] {
+				seenNodes[node] = true
+				node.cum.Add(stats)
+				if base {
+					node.baseCum.Add(stack.Stats)
+				}
 			}
-			node.cum.Add(stack.Stats)
 
 			last = node
 		}
 	}
+}
 
-	// Collect node sizes.
+// sizeNodes collects the sizes of nodes, biggest first.  In diffs that's
+// the size of their change, either way.
+func (g *graph) sizeNodes() {
 	nodeSizes := make([]int, 0, len(g.nodes))
 	for _, n := range g.nodes {
-		size := n.cum.InuseBytes
+		size := abs(n.cum.Get(g.metric))
 		if size > 0 {
 			nodeSizes = append(nodeSizes, size)
 		}
@@ -169,17 +366,40 @@ func (g *graph) Analyze(stacks []*Stack, names map[uint64]string) {
 	g.NodeSizes = nodeSizes
 }
 
-func (s *state) GraphViz(w io.Writer) {
-	g := s.Graph
+// dotEscape quotes s for use inside a GraphViz string.
+func dotEscape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return strings.Replace(s, "\"", "\\\"", -1)
+}
 
-	fmt.Fprintf(w, "digraph G {\n")
-	fmt.Fprintf(w, "nodesep = 0.2\n")
-	fmt.Fprintf(w, "ranksep = 0.3\n")
-	if runtime.GOOS == "darwin" {
-		fmt.Fprintf(w, "node [fontname = Menlo]\n")
+// dotLabel wraps name onto lines for a GraphViz label.
+func dotLabel(name string) string {
+	lines := wrapLabel(name, 60)
+	for i, line := range lines {
+		lines[i] = dotEscape(line)
 	}
-	fmt.Fprintf(w, "node [fontsize=9]\n")
-	fmt.Fprintf(w, "edge [fontsize=9]\n")
+	return strings.Join(lines, "\\n")
+}
+
+// diffColor returns GraphViz attributes coloring growth by size bytes
+// red and shrinkage green, in diffs.
+func (s *state) diffColor(size int) string {
+	switch {
+	case !s.Graph.diff || size == 0:
+		return ""
+	case size > 0:
+		return ",color=red,fontcolor=red"
+	}
+	return ",color=darkgreen,fontcolor=darkgreen"
+}
+
+// selectGraph picks the nodes and edges to draw under s.Params: the
+// biggest nodes, and the edges between them that are big or are the
+// only way into a node, biggest first.  Nodes left with no edges aren't
+// drawn.
+func (s *state) selectGraph() (nodes map[*Node]bool, edges []edge) {
+	g := s.Graph
+	m := s.Params.Metric
 
 	// Select top N nodes.
 	keptNodes := make(map[*Node]bool)
@@ -187,9 +407,10 @@ func (s *state) GraphViz(w io.Writer) {
 	if s.Params.NodeKeepCount < len(g.NodeSizes) {
 		nodeSizeThreshold = g.NodeSizes[s.Params.NodeKeepCount]
 	}
-	log.Printf("keeping %d nodes with cumulative >= %dk", s.Params.NodeKeepCount, nodeSizeThreshold/1024)
+	log.Printf("keeping %d nodes with cumulative >= %s", s.Params.NodeKeepCount, m.Format(nodeSizeThreshold, false))
 	for _, n := range g.nodes {
-		if n.cum.InuseBytes >= nodeSizeThreshold {
+		// Stacks that only hold other metrics make nodes of size 0.
+		if size := abs(n.cum.Get(m)); size > 0 && size >= nodeSizeThreshold {
 			keptNodes[n] = true
 		}
 	}
@@ -201,49 +422,137 @@ func (s *state) GraphViz(w io.Writer) {
 			edgelist = append(edgelist, e)
 		}
 	}
-	Sort(edgelist, func(e interface{}) int { return -g.edges[e.(edge)] })
+	Sort(edgelist, func(e interface{}) int { return -abs(g.edges[e.(edge)].Get(m)) })
 
 	indegree := make(map[*Node]int)
 	outdegree := make(map[*Node]int)
 	for _, e := range edgelist {
 		edge := e.(edge)
-		size := g.edges[edge]
+		size := g.edges[edge].Get(m)
 
 		if indegree[edge.dst] == 0 {
 			// Keep at least one edge for each dest.
-		} else if size/1024 < 30 {
+		} else if abs(size)/m.Unit() < 30 {
 			continue
 		}
 		outdegree[edge.src]++
 		indegree[edge.dst]++
-		fmt.Fprintf(w, "%d -> %d [label=\" %d\"]\n", edge.src.addr, edge.dst.addr, g.edges[edge]/1024)
+		edges = append(edges, edge)
 	}
 
 	total := 0
 	missing := 0
+	nodes = make(map[*Node]bool)
 	for n, _ := range keptNodes {
 		if indegree[n] == 0 && outdegree[n] == 0 {
-			log.Printf("no edges for %x (%dk)", n.addr, n.cum.InuseBytes/1024)
-			missing += n.cum.InuseBytes
+			log.Printf("no edges for %x (%s)", n.addr, m.Format(n.cum.Get(m), false))
+			missing += n.cum.Get(m)
 			continue
 		}
-		total += n.cur.InuseBytes
-		label := s.Label(n) + "\\n" + s.SizeLabel(n)
-		fmt.Fprintf(w, "%d [label=\"%s\",shape=box,href=\"%d\"]\n", n.addr, label, n.addr)
+		total += n.cur.Get(m)
+		nodes[n] = true
+	}
+	log.Printf("total not shown: %s", m.Format(missing, false))
+	log.Printf("total kept nodes: %s", m.Format(total, false))
+	return nodes, edges
+}
+
+func (s *state) GraphViz(w io.Writer) {
+	g := s.Graph
+	m := s.Params.Metric
+
+	fmt.Fprintf(w, "digraph G {\n")
+	fmt.Fprintf(w, "nodesep = 0.2\n")
+	fmt.Fprintf(w, "ranksep = 0.3\n")
+	if runtime.GOOS == "darwin" {
+		fmt.Fprintf(w, "node [fontname = Menlo]\n")
+	}
+	fmt.Fprintf(w, "node [fontsize=9]\n")
+	fmt.Fprintf(w, "edge [fontsize=9]\n")
+
+	nodes, edges := s.selectGraph()
+	for _, edge := range edges {
+		size := g.edges[edge].Get(m)
+		fmt.Fprintf(w, "%d -> %d [label=\" %d\"%s]\n", edge.src.addr, edge.dst.addr, size/m.Unit(), s.diffColor(size))
+	}
+
+	groups := make(map[string][]*Node)
+	for n, _ := range nodes {
+		label := dotLabel(s.Label(n)) + "\\n" + s.SizeLabel(n)
+		fmt.Fprintf(w, "%d [label=\"%s\",shape=box,href=\"%d\"%s]\n", n.addr, label, n.addr, s.diffColor(n.cum.Get(m)))
+		if group := s.Group(n); len(group) > 0 {
+			groups[group] = append(groups[group], n)
+		}
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for group, _ := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+	for i, group := range groupNames {
+		fmt.Fprintf(w, "subgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "label=\"%s\"\n", dotLabel(group))
+		for _, n := range groups[group] {
+			fmt.Fprintf(w, "%d\n", n.addr)
+		}
+		fmt.Fprintf(w, "}\n")
 	}
-	log.Printf("total not shown: %dk", missing/1024.0)
-	log.Printf("total kept nodes: %dk", total/1024.0)
 
 	fmt.Fprintf(w, "}\n")
 }
 
+// loadSymsFlag loads the -syms file in the -syms-format format.
+func loadSymsFlag() (*Symbols, error) {
+	format, err := parseSymsMapFormat(*flag_syms_format)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSymsMap(*flag_syms, format)
+}
+
+func loadProfile(path string) *Profile {
+	log.Printf("reading profile from %s", path)
+	f, err := os.Open(path)
+	check(err)
+	profile := ParseHeap(bufio.NewReader(f))
+	f.Close()
+	log.Printf("loaded %d stacks", len(profile.stacks))
+	return profile
+}
+
+// profileSyms adds to syms those for profile in particular: the ones
+// embedded in it, and those from -breakpad for the modules it maps.
+func profileSyms(syms *Symbols, profile *Profile) *Symbols {
+	if profile.syms.Len() > 0 {
+		log.Printf("using %d syms embedded in profile", profile.syms.Len())
+		syms = MergeSyms(syms, profile.syms)
+	}
+	if len(*flag_breakpad) > 0 {
+		log.Printf("reading breakpad symbols from %s", *flag_breakpad)
+		breakpadSyms, err := LoadBreakpadSyms(strings.Split(*flag_breakpad, ","), profile.maps)
+		if err != nil {
+			log.Fatalf("reading breakpad symbols: %s", err)
+		}
+		syms = MergeSyms(syms, breakpadSyms)
+	}
+	return syms
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [flags] binary profile\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] profile   (with -syms, -breakpad or a symbolized profile)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] symbolize binary [library...] profile > symbolized\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
+	if flag.Arg(0) == "symbolize" {
+		symbolizeMain(flag.Args()[1:])
+		return
+	}
+
 	if *flag_profile {
 		f, err := os.Create("goprof")
 		check(err)
@@ -251,9 +560,9 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	var symsPath, binaryPath, profilePath string
-	if len(*flag_syms) > 0 {
-		symsPath, profilePath = *flag_syms, flag.Arg(0)
+	var binaryPath, profilePath string
+	if flag.NArg() == 1 {
+		profilePath = flag.Arg(0)
 	} else {
 		binaryPath, profilePath = flag.Arg(0), flag.Arg(1)
 	}
@@ -261,6 +570,19 @@ func main() {
 	if len(profilePath) == 0 {
 		log.Fatalf("usage: %s binary profile", os.Args[0])
 	}
+	modes := 0
+	for _, set := range []bool{len(*flag_pprof) > 0, len(*flag_http) > 0, *flag_text, *flag_folded, *flag_flame, *flag_callgrind, *flag_json, *flag_speedscope} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatalf("more than one output mode; pick one of -pprof, -http, -text, -folded, -flame, -callgrind, -json and -speedscope")
+	}
+	if len(*flag_base) > 0 && (*flag_folded || *flag_flame || *flag_speedscope || len(*flag_pprof) > 0) {
+		// These write out stacks, and a difference of profiles has none.
+		log.Fatalf("-base can't be used with -folded, -flame, -speedscope or -pprof")
+	}
 
 	noLoad := false
 
@@ -270,67 +592,154 @@ func main() {
 			profChan <- nil
 			return
 		}
-		log.Printf("reading profile from %s", profilePath)
-		f, err := os.Open(profilePath)
-		check(err)
-		profile := ParseHeap(bufio.NewReader(f))
-		f.Close()
-		log.Printf("loaded %d stacks", len(profile.stacks))
-		profChan <- profile
+		profChan <- loadProfile(profilePath)
 	}()
 
-	symChan := make(chan Symbols)
-	if len(binaryPath) > 0 {
-		go func() {
+	baseChan := make(chan *Profile)
+	go func() {
+		if noLoad || len(*flag_base) == 0 {
+			baseChan <- nil
+			return
+		}
+		baseChan <- loadProfile(*flag_base)
+	}()
+
+	symChan := make(chan *Symbols)
+	go func() {
+		if noLoad {
+			symChan <- nil
+			return
+		}
+		var binarySyms, mapSyms *Symbols
+		if len(binaryPath) > 0 {
 			log.Printf("reading symbols from %s", binaryPath)
-			syms := LoadSyms(binaryPath)
-			log.Printf("loaded %d syms", len(syms))
-			symChan <- syms
-		}()
-	} else {
-		go func() {
-			if noLoad {
-				symChan <- nil
-				return
+			binarySyms = LoadSyms(binaryPath)
+			log.Printf("loaded %d syms", binarySyms.Len())
+		}
+		if len(*flag_syms) > 0 {
+			log.Printf("reading symbol map from %s", *flag_syms)
+			var err error
+			mapSyms, err = loadSymsFlag()
+			if err != nil {
+				log.Fatalf("reading symbol map: %s", err)
 			}
-			log.Printf("reading symbol map from %s", symsPath)
-			syms := LoadSymsMap(symsPath)
-			log.Printf("loaded %d syms", len(syms))
-			symChan <- syms
-		}()
-	}
+			log.Printf("loaded %d syms", mapSyms.Len())
+		}
+		symChan <- MergeSyms(binarySyms, mapSyms)
+	}()
 
-	syms := <-symChan
+	binarySyms := <-symChan
 	profile := <-profChan
+	base := <-baseChan
+	if len(binaryPath) == 0 && len(*flag_syms) == 0 && len(*flag_breakpad) == 0 && profile.syms.Len() == 0 {
+		log.Fatalf("usage: %s binary profile   (no symbols: pass a binary, -syms or -breakpad, or symbolize the profile)", os.Args[0])
+	}
+	syms := profileSyms(binarySyms, profile)
 
-	state := &state{
-		Profile: profile,
+	simplify, err := parseSimplifyLevel(*flag_simplify)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *flags_builtin_demangle {
-		state.demangler = NewLinuxDemangler(false)
-	} else {
-		state.demangler = NewCppFilt()
+	group, err := parseGroupBy(*flag_group)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metric, err := parseMetric(*flag_metric)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err := LoadRules(*flag_rules)
+	if err != nil {
+		log.Fatalf("reading rules: %s", err)
 	}
 
-	var names map[uint64]string
-	if noLoad {
-		syms = syms
-	} else {
-		names = CleanupStacks(state.Profile.stacks, syms)
+	demangler := NewDemangler()
+	if *flag_cppfilt {
+		cf, err := NewCppFilt(runtime.NumCPU())
+		if err != nil {
+			log.Fatalf("starting c++filt: %s", err)
+		}
+		demangler[schemeItanium] = FallbackDemangler{demangler[schemeItanium], cf}
+	}
+	state := &state{
+		Profile:   profile,
+		Base:      base,
+		syms:      syms,
+		demangler: NewDemangleCache(demangler),
+		rules:     rules,
 	}
+	state.demangler.Load(demangleCachePath())
 
-	state.Graph = &graph{
-		nodes: make(map[uint64]*Node),
-		edges: make(map[edge]int),
+	if !noLoad {
+		switch *flag_clones {
+		case "merge", "split":
+		default:
+			log.Fatalf("bad -clones %q; want 'merge' or 'split'", *flag_clones)
+		}
+		hideRe, err := compileHide(*flag_hide_allocators, *flag_hide)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var hide func(name string) bool
+		if hideRe != nil {
+			hide = func(name string) bool {
+				name, _ = splitCloneSuffix(name)
+				name, _ = state.demangler.Demangle(name)
+				return hideRe.MatchString(name)
+			}
+		}
+		state.names = CleanupStacks(state.Profile.stacks, syms, *flag_clones == "merge", hide)
+		if base != nil {
+			baseNames := CleanupStacks(base.stacks, profileSyms(binarySyms, base), *flag_clones == "merge", hide)
+			RebaseStacks(base.stacks, baseNames, state.names)
+		}
+
+		// Demangle everything Label might ask for now, in parallel.
+		mangled := make([]string, 0, len(state.names))
+		for _, name := range state.names {
+			name, _ = splitCloneSuffix(name)
+			mangled = append(mangled, name)
+		}
+		state.demangler.DemangleAll(mangled)
+		state.demangler.Save(demangleCachePath())
 	}
-	state.Graph.Analyze(profile.stacks, names)
+
 	state.Params = &params{
-		NodeKeepCount: 100,
+		NodeKeepCount: *flag_nodecount,
+		Metric:        metric,
+		Simplify:      simplify,
+		Group:         group,
+		Focus:         *flag_focus,
+		Ignore:        *flag_ignore,
+	}
+	if err := state.Analyze(); err != nil {
+		log.Fatal(err)
 	}
 
-	if len(*flag_http) > 0 {
+	if len(*flag_pprof) > 0 {
+		log.Printf("writing %s", *flag_pprof)
+		f, err := os.Create(*flag_pprof)
+		check(err)
+		err = state.WritePprof(f)
+		if err == nil {
+			err = f.Close()
+		}
+		check(err)
+	} else if len(*flag_http) > 0 {
 		log.Printf("serving on %s", *flag_http)
 		state.ServeHttp(*flag_http)
+	} else if *flag_text {
+		state.Text(os.Stdout, *flag_cum)
+	} else if *flag_folded {
+		state.Folded(os.Stdout)
+	} else if *flag_flame {
+		state.FlameGraph(os.Stdout)
+	} else if *flag_callgrind {
+		state.Callgrind(os.Stdout)
+	} else if *flag_json {
+		check(state.JSON(os.Stdout))
+	} else if *flag_speedscope {
+		check(state.Speedscope(os.Stdout, filepath.Base(profilePath)))
 	} else {
 		log.Printf("writing output...")
 		state.GraphViz(os.Stdout)
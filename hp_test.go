@@ -0,0 +1,142 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testStack returns a stack of one allocation of the given size through
+// addrs, leaf first.
+func testStack(bytes int, addrs ...uint64) *Stack {
+	return &Stack{Stats: &Stats{InuseObjects: 1, InuseBytes: bytes}, Stack: addrs}
+}
+
+// testState returns an unanalyzed state for a profile of stacks through
+// the functions named.
+func testState(params *params, names map[uint64]string, stacks ...*Stack) *state {
+	return &state{
+		Profile:   &Profile{stacks: stacks},
+		demangler: NewDemangleCache(NewDemangler()),
+		names:     names,
+		Params:    params,
+	}
+}
+
+// testMaps maps an executable at 0x1000 and libc at 0x7000.
+var testMaps = Maps{
+	{start: 0x1000, end: 0x2000, path: "/bin/app"},
+	{start: 0x7000, end: 0x8000, path: "/lib/libc.so.6"},
+}
+
+func TestLabelAndGroup(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{demangler: NewDemangleCache(NewDemangler()), rules: rules, Params: &params{}}
+	for _, test := range []struct {
+		name      string
+		simplify  simplifyLevel
+		group     groupBy
+		label, in string
+	}{
+		{"_ZNSt6vectorIiSaIiEE9push_backEOi", simplifyNoTemplates, groupClass, "std::vector::push_back", "std::vector"},
+		{"_ZNSt6vectorIiSaIiEE9push_backEOi", simplifyNoParams, groupNamespace, "std::vector<int, std::allocator<int> >::push_back", "std"},
+		{"_ZNSs4sizeEv", simplifyFull, groupClass, "std::string::size()", "std::string"},
+		{"_ZNSs4sizeEv", simplifyNoTemplates, groupClass, "std::string::size", "std::string"},
+		{"_ZNKSs4sizeEv", simplifyNoTemplates, groupClass, "std::string::size", "std::string"},
+		{"_ZNKSt7__cxx1112basic_stringIcSt11char_traitsIcESaIcEE4sizeEv", simplifyNoTemplates, groupNamespace, "std::string::size", "std"},
+		{"_ZNKSt7__cxx1112basic_stringIcSt11char_traitsIcESaIcEE4sizeEv", simplifyNoParams, groupClass, "std::string::size", "std::string"},
+		{"_ZN12_GLOBAL__N_13Foo3runERKSt6vectorIiSaIiEE", simplifyNoTemplates, groupClass, "(anonymous namespace)::Foo::run", "(anonymous namespace)::Foo"},
+		{"_ZN4base6Widget3RunEv.cold", simplifyNoParams, groupClass, "base::Widget::Run [clone .cold]", "base::Widget"},
+		{"_ZN4base6Widget3RunEv", simplifyNoParams, groupNone, "base::Widget::Run", ""},
+		{"_RNvCs1234_7mycrate3foo", simplifyNoTemplates, groupClass, "mycrate::foo", ""},
+		{"malloc", simplifyFull, groupClass, "malloc", ""},
+		{"main.(*state).Label", simplifyNoParams, groupClass, "main.(*state).Label", ""},
+		{"main.(*state).Label", simplifyNoTemplates, groupNamespace, "main.(*state).Label", ""},
+		{"main.Map[go.shape.int]", simplifyNoTemplates, groupNone, "main.Map[go.shape.int]", ""},
+	} {
+		s.Params.Simplify, s.Params.Group = test.simplify, test.group
+		n := &Node{name: test.name}
+		if got := s.Label(n); got != test.label {
+			t.Errorf("%s at %s: label %q, want %q", test.name, test.simplify, got, test.label)
+		}
+		if got := s.Group(n); got != test.in {
+			t.Errorf("%s by %s: group %q, want %q", test.name, test.group, got, test.in)
+		}
+	}
+}
+
+func TestAnalyzeRecursion(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stacks [][]uint64
+		cum    map[uint64]int
+		edges  map[[2]uint64]int
+	}{
+		{
+			"direct",
+			[][]uint64{{1, 2, 2, 2, 3}},
+			map[uint64]int{1: 100, 2: 100, 3: 100},
+			map[[2]uint64]int{{2, 1}: 100, {3, 2}: 100},
+		},
+		{
+			"mutual",
+			[][]uint64{{1, 2, 3, 2, 3, 4}},
+			map[uint64]int{1: 100, 2: 100, 3: 100, 4: 100},
+			map[[2]uint64]int{{2, 1}: 100, {3, 2}: 100, {2, 3}: 100, {4, 3}: 100},
+		},
+		{
+			"mutual and not",
+			[][]uint64{{1, 2, 3, 2, 3, 2, 4}, {1, 2, 4}},
+			map[uint64]int{1: 200, 2: 200, 3: 100, 4: 200},
+			map[[2]uint64]int{{2, 1}: 200, {3, 2}: 100, {2, 3}: 100, {4, 2}: 200},
+		},
+	} {
+		var stacks []*Stack
+		for _, addrs := range test.stacks {
+			stacks = append(stacks, testStack(100, addrs...))
+		}
+		g := &graph{nodes: make(map[uint64]*Node), edges: make(map[edge]*Stats)}
+		g.Analyze(stacks, nil)
+
+		cum := make(map[uint64]int)
+		for addr, n := range g.nodes {
+			cum[addr] = n.cum.InuseBytes
+		}
+		if !reflect.DeepEqual(cum, test.cum) {
+			t.Errorf("%s: cum %v, want %v", test.name, cum, test.cum)
+		}
+		edges := make(map[[2]uint64]int)
+		for e, size := range g.edges {
+			edges[[2]uint64{e.src.addr, e.dst.addr}] = size.InuseBytes
+		}
+		if !reflect.DeepEqual(edges, test.edges) {
+			t.Errorf("%s: edges %v, want %v", test.name, edges, test.edges)
+		}
+	}
+}
+
+func TestSizeLabelNothingShown(t *testing.T) {
+	s := testState(&params{NodeKeepCount: 100}, map[uint64]string{1: "malloc", 2: "main"}, testStack(0, 1, 2))
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.SizeLabel(s.Graph.nodes[2]), "0k of 0k (0.0% of total)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// This file writes the whole analysis as JSON, for scripts.  Stats are
+// objects keyed by pprof's names for the metrics, and addresses are hex
+// strings, as some are too big for JSON numbers to hold exactly.
+
+type jsonParams struct {
+	Metric    string `json:"metric"`
+	NodeCount int    `json:"node_count"`
+	Simplify  string `json:"simplify"`
+	Group     string `json:"group"`
+	Focus     string `json:"focus,omitempty"`
+	Ignore    string `json:"ignore,omitempty"`
+}
+
+type jsonNode struct {
+	Address string `json:"address"`
+	// The symbol's name as found, if any, and its demangled, simplified
+	// form as the graph shows it.
+	Symbol  string `json:"symbol,omitempty"`
+	Label   string `json:"label"`
+	Group   string `json:"group,omitempty"`
+	Library string `json:"library,omitempty"`
+	Cur     Stats  `json:"cur"`
+	Cum     Stats  `json:"cum"`
+	// In diffs, what cum was in the base profile.
+	BaseCum *Stats `json:"base_cum,omitempty"`
+	// Whether the graph shows it under the params.
+	Kept bool `json:"kept"`
+}
+
+type jsonEdge struct {
+	Caller string `json:"caller"`
+	Callee string `json:"callee"`
+	Weight Stats  `json:"weight"`
+	Kept   bool   `json:"kept"`
+}
+
+type jsonAnalysis struct {
+	Params jsonParams `json:"params"`
+	// The profile's totals, and those of the base profile in diffs.
+	Header     *Stats `json:"header"`
+	BaseHeader *Stats `json:"base_header,omitempty"`
+	// Whether sizes are differences from the base profile.
+	Diff     bool       `json:"diff"`
+	Shown    Stats      `json:"shown"`
+	Filtered Stats      `json:"filtered"`
+	Nodes    []jsonNode `json:"nodes"`
+	Edges    []jsonEdge `json:"edges"`
+}
+
+func jsonAddr(addr uint64) string {
+	return fmt.Sprintf("0x%x", addr)
+}
+
+// JSON writes the graph, every node and edge of it, marking those the
+// graph under s.Params shows as kept.
+func (s *state) JSON(w io.Writer) error {
+	g := s.Graph
+	keptNodes, keptEdges := s.selectGraph()
+	a := jsonAnalysis{
+		Params: jsonParams{
+			Metric:    s.Params.Metric.String(),
+			NodeCount: s.Params.NodeKeepCount,
+			Simplify:  s.Params.Simplify.String(),
+			Group:     s.Params.Group.String(),
+			Focus:     s.Params.Focus,
+			Ignore:    s.Params.Ignore,
+		},
+		Header:   s.Profile.Header,
+		Diff:     g.diff,
+		Shown:    s.Shown,
+		Filtered: s.Filtered,
+		Nodes:    []jsonNode{},
+		Edges:    []jsonEdge{},
+	}
+	if s.Base != nil {
+		a.BaseHeader = s.Base.Header
+	}
+
+	nodes := make([]*Node, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].addr < nodes[j].addr })
+	for _, n := range nodes {
+		node := jsonNode{
+			Address: jsonAddr(n.addr),
+			Symbol:  n.name,
+			Label:   s.Label(n),
+			Group:   s.Group(n),
+			Cur:     n.cur,
+			Cum:     n.cum,
+			Kept:    keptNodes[n],
+		}
+		if e := s.Profile.maps.Search(n.addr); e != nil && n.addr < inlineAddrBase {
+			node.Library = e.path
+		}
+		if g.diff {
+			baseCum := n.baseCum
+			node.BaseCum = &baseCum
+		}
+		a.Nodes = append(a.Nodes, node)
+	}
+
+	kept := make(map[edge]bool)
+	for _, e := range keptEdges {
+		kept[e] = true
+	}
+	edges := make([]edge, 0, len(g.edges))
+	for e := range g.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].src.addr != edges[j].src.addr {
+			return edges[i].src.addr < edges[j].src.addr
+		}
+		return edges[i].dst.addr < edges[j].dst.addr
+	})
+	for _, e := range edges {
+		a.Edges = append(a.Edges, jsonEdge{
+			Caller: jsonAddr(e.src.addr),
+			Callee: jsonAddr(e.dst.addr),
+			Weight: *g.edges[e],
+			Kept:   kept[e],
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
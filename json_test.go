@@ -0,0 +1,92 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	s := testState(&params{NodeKeepCount: 3, Simplify: simplifyNoTemplates, Group: groupClass},
+		map[uint64]string{
+			0x1000: "main",
+			0x1100: "_ZN4base6Widget3RunEv",
+			0x1200: "_ZN4base6Widget5ParseEv",
+			0x1300: "_ZN4base3OldEv",
+			0x7000: "malloc",
+		},
+		testStack(600, 0x7000, 0x1100, 0x1000),
+		testStack(300, 0x7000, 0x1200, 0x1000),
+		testStack(50, 0x7000, 0x1300, 0x1000),
+	)
+	s.Profile.Header = &Stats{InuseObjects: 3, InuseBytes: 950}
+	s.Profile.maps = testMaps
+	if err := s.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := s.JSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var a jsonAnalysis
+	if err := json.Unmarshal(out.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (jsonParams{Metric: "inuse_space", NodeCount: 3, Simplify: "notemplates", Group: "class"}); a.Params != want {
+		t.Errorf("params %+v, want %+v", a.Params, want)
+	}
+	if *a.Header != *s.Profile.Header || a.Shown.InuseBytes != 950 || a.Diff || a.BaseHeader != nil {
+		t.Errorf("totals %+v", a)
+	}
+
+	// The three biggest functions are kept, and the smallest's size is
+	// the threshold, so Parse is too.  Old isn't.
+	wantNodes := []jsonNode{
+		{"0x1000", "main", "main", "", "/bin/app", Stats{}, Stats{3, 950, 0, 0}, nil, true},
+		{"0x1100", "_ZN4base6Widget3RunEv", "base::Widget::Run", "base::Widget", "/bin/app", Stats{}, Stats{1, 600, 0, 0}, nil, true},
+		{"0x1200", "_ZN4base6Widget5ParseEv", "base::Widget::Parse", "base::Widget", "/bin/app", Stats{}, Stats{1, 300, 0, 0}, nil, true},
+		{"0x1300", "_ZN4base3OldEv", "base::Old", "base", "/bin/app", Stats{}, Stats{1, 50, 0, 0}, nil, false},
+		{"0x7000", "malloc", "malloc", "", "/lib/libc.so.6", Stats{3, 950, 0, 0}, Stats{3, 950, 0, 0}, nil, true},
+	}
+	if !reflect.DeepEqual(a.Nodes, wantNodes) {
+		t.Errorf("nodes\n%+v\nwant\n%+v", a.Nodes, wantNodes)
+	}
+	// Parse's call of malloc is too small to draw, as malloc has a
+	// bigger way in.
+	wantEdges := []jsonEdge{
+		{"0x1000", "0x1100", Stats{1, 600, 0, 0}, true},
+		{"0x1000", "0x1200", Stats{1, 300, 0, 0}, true},
+		{"0x1000", "0x1300", Stats{1, 50, 0, 0}, false},
+		{"0x1100", "0x7000", Stats{1, 600, 0, 0}, true},
+		{"0x1200", "0x7000", Stats{1, 300, 0, 0}, false},
+		{"0x1300", "0x7000", Stats{1, 50, 0, 0}, false},
+	}
+	if !reflect.DeepEqual(a.Edges, wantEdges) {
+		t.Errorf("edges\n%+v\nwant\n%+v", a.Edges, wantEdges)
+	}
+
+	// Stats are keyed by pprof's names.
+	var raw struct {
+		Shown map[string]int `json:"shown"`
+	}
+	json.Unmarshal(out.Bytes(), &raw)
+	if want := map[string]int{"inuse_objects": 3, "inuse_space": 950, "alloc_objects": 0, "alloc_space": 0}; !reflect.DeepEqual(raw.Shown, want) {
+		t.Errorf("shown %v, want %v", raw.Shown, want)
+	}
+}
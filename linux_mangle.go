@@ -15,270 +15,2272 @@
 package main
 
 import (
-	"io"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
-// This file implements a tiny subset of the C++ name mangling used on Linux,
+// This file implements the Itanium C++ ABI name mangling used on Linux,
 // described at
-//   http://sourcery.mentor.com/public/cxx-abi/abi.html#mangling
-// Most of the complexity of name mangling is in mangling types; we only
-// care about the raw function names and can ignore all that.
+//   https://itanium-cxx-abi.github.io/cxx-abi/abi.html#mangling
+// A mangled name is parsed into a tree of nodes, which is then printed
+// the same way c++filt (libiberty's cp-demangle.c) prints it.  Types are
+// printed in two halves, as in LLVM's demangler, so that declarators
+// like function pointers wrap around what's inside them:
+// "void (*" + inner + ")(int)".  Some rarely used expressions aren't
+// parsed yet; names with those are shown as they are, or with -cppfilt
+// handed to c++filt.
 
-type stringReader struct {
+type demangleError string
+
+func (e demangleError) Error() string { return string(e) }
+
+func fail(format string, args ...interface{}) {
+	panic(demangleError(fmt.Sprintf(format, args...)))
+}
+
+// A node is a parsed component of a mangled name.
+type node interface {
+	printLeft(p *printer)
+	printRight(p *printer)
+	// rhs is nonzero for declarators that print on both sides of what
+	// they are applied to: rhsFunction or rhsArray.
+	rhs(p *printer) int
+}
+
+const (
+	rhsNone = iota
+	rhsFunction
+	rhsArray
+)
+
+// leaf provides the trivial node methods for nodes that print in one piece.
+type leaf struct{}
+
+func (leaf) printRight(p *printer) {}
+func (leaf) rhs(p *printer) int    { return rhsNone }
+
+type printer struct {
+	buf strings.Builder
+	// The last byte written.  Like libiberty's, this isn't reset when
+	// output is taken back, which decides where "> >" gets its space.
+	lastByte byte
+	// Index into the argument packs being expanded.  Like libiberty's,
+	// it's left as it was after an expansion, and template parameters
+	// naming packs outside of one print that element.
+	packIndex int
+	// Whether a lambda's parameters are being printed, where template
+	// parameters are a generic lambda's "auto"s.
+	lambdaArg bool
+	scope
+}
+
+// scope is what template parameters refer to while printing.
+type scope struct {
+	// Arguments of the template function being printed.
+	params []node
+}
+
+// within calls f with the printer in scope sc.
+func (p *printer) within(sc scope, f func()) {
+	saved := p.scope
+	p.scope = sc
+	f()
+	p.scope = saved
+}
+
+func (p *printer) s(str string) {
+	if len(str) > 0 {
+		p.buf.WriteString(str)
+		p.lastByte = str[len(str)-1]
+	}
+}
+
+func (p *printer) last() byte { return p.lastByte }
+
+func (p *printer) print(n node) {
+	n.printLeft(p)
+	n.printRight(p)
+}
+
+// list prints nodes separated by commas.  Like libiberty, it takes
+// back a separator when nothing followed it, as after an empty pack
+// expansion.
+func (p *printer) list(nodes []node) {
+	if len(nodes) == 0 {
+		return
+	}
+	p.print(nodes[0])
+	if len(nodes) == 1 {
+		return
+	}
+	p.s(", ")
+	n := p.buf.Len()
+	p.list(nodes[1:])
+	if p.buf.Len() == n {
+		str := p.buf.String()
+		p.buf.Reset()
+		p.buf.WriteString(str[:n-2])
+	}
+}
+
+func printNode(n node) string {
+	p := &printer{}
+	p.print(n)
+	return p.buf.String()
+}
+
+// Names.
+
+type nameNode struct {
+	leaf
+	name string
+}
+
+func (n *nameNode) printLeft(p *printer) { p.s(n.name) }
+
+type qualifiedName struct {
+	leaf
+	scope, name node
+}
+
+func (n *qualifiedName) printLeft(p *printer) {
+	p.print(n.scope)
+	p.s("::")
+	p.print(n.name)
+}
+
+type templateArgs struct {
+	leaf
+	args []node
+}
+
+func (n *templateArgs) printLeft(p *printer) {
+	if p.last() == '<' {
+		p.s(" ") // As in "operator<< <char>".
+	}
+	p.s("<")
+	p.list(n.args)
+	if p.last() == '>' {
+		p.s(" ")
+	}
+	p.s(">")
+}
+
+type templateName struct {
+	leaf
+	name node
+	args *templateArgs
+}
+
+func (n *templateName) printLeft(p *printer) {
+	p.print(n.name)
+	p.print(n.args)
+}
+
+// argPack is a template argument pack, J...E.
+type argPack struct {
+	leaf
+	elems []node
+}
+
+func (n *argPack) printLeft(p *printer) { p.list(n.elems) }
+
+type ctorDtorName struct {
+	leaf
+	base string
+	dtor bool
+}
+
+func (n *ctorDtorName) printLeft(p *printer) {
+	if n.dtor {
+		p.s("~")
+	}
+	p.s(n.base)
+}
+
+type conversionOperator struct {
+	leaf
+	typ node
+}
+
+func (n *conversionOperator) printLeft(p *printer) {
+	p.s("operator ")
+	p.print(n.typ)
+}
+
+type abiTagged struct {
+	leaf
+	name node
+	tag  string
+}
+
+func (n *abiTagged) printLeft(p *printer) {
+	p.print(n.name)
+	p.s("[abi:" + n.tag + "]")
+}
+
+type localName struct {
+	leaf
+	encoding, entity node
+}
+
+func (n *localName) printLeft(p *printer) {
+	p.print(n.encoding)
+	p.s("::")
+	p.print(n.entity)
+}
+
+type lambdaName struct {
+	leaf
+	params []node
+	n      int
+}
+
+func (n *lambdaName) printLeft(p *printer) {
+	p.s("{lambda(")
+	saved := p.lambdaArg
+	p.lambdaArg = true
+	p.list(n.params)
+	p.lambdaArg = saved
+	p.s(fmt.Sprintf(")#%d}", n.n))
+}
+
+type unnamedType struct {
+	leaf
+	n int
+}
+
+func (n *unnamedType) printLeft(p *printer) {
+	p.s(fmt.Sprintf("{unnamed type#%d}", n.n))
+}
+
+// specialName covers "vtable for X", "guard variable for X" and so on.
+type specialName struct {
+	leaf
+	prefix string
+	child  node
+	suffix string
+}
+
+func (n *specialName) printLeft(p *printer) {
+	p.s(n.prefix)
+	p.print(n.child)
+	p.s(n.suffix)
+}
+
+type ctorVtable struct {
+	leaf
+	first, second node
+}
+
+func (n *ctorVtable) printLeft(p *printer) {
+	p.s("construction vtable for ")
+	p.print(n.first)
+	p.s("-in-")
+	p.print(n.second)
+}
+
+// Types.
+
+// postfixType is a type followed by a word, like "int const",
+// "double _Complex" or a vendor qualifier.
+type postfixType struct {
+	child   node
+	postfix string
+	// Whether, like a pointer, it parenthesizes the array or
+	// function type it applies to.
+	paren bool
+}
+
+func (n *postfixType) printLeft(p *printer) {
+	n.child.printLeft(p)
+	if n.paren {
+		switch declarator(p, n.child) {
+		case rhsArray:
+			p.s(" (")
+		case rhsFunction:
+			if p.last() != ' ' {
+				p.s(" ")
+			}
+			p.s("(")
+		}
+	}
+	postfix := n.postfix
+	if isCV(postfix) {
+		// Like c++filt, don't repeat qualifiers the type already has,
+		// as when a template argument is itself const.
+		for _, q := range strings.Fields(innerCV(p, n.child)) {
+			postfix = strings.Replace(postfix, " "+q, "", 1)
+		}
+	}
+	p.s(postfix)
+}
+
+func isCV(postfix string) bool {
+	for _, q := range strings.Fields(postfix) {
+		if q != "const" && q != "volatile" && q != "restrict" {
+			return false
+		}
+	}
+	return true
+}
+
+// innerCV returns the cv-qualifiers directly applied to n, looking
+// through template parameters and pack elements.
+func innerCV(p *printer, n node) string {
+	sc := p.scope
+	cv := ""
+	for {
+		switch t := n.(type) {
+		case *postfixType:
+			if !isCV(t.postfix) {
+				return cv
+			}
+			cv += t.postfix
+			n = t.child
+		case *templateParam:
+			if n = t.arg(p, sc.params); n == nil {
+				return cv
+			}
+			sc.params = nil
+		default:
+			return cv
+		}
+	}
+}
+
+func (n *postfixType) printRight(p *printer) {
+	if n.paren && declarator(p, n.child) != rhsNone {
+		p.s(")")
+	}
+	n.child.printRight(p)
+}
+
+func (n *postfixType) rhs(p *printer) int { return n.child.rhs(p) }
+
+// declarator returns the rhs kind of n itself, looking through
+// qualifiers but not through other pointers, which have already
+// parenthesized what they point to.
+func declarator(p *printer, n node) int {
+	sc := p.scope
+	for {
+		switch t := n.(type) {
+		case *postfixType:
+			if t.paren {
+				return rhsNone
+			}
+			n = t.child
+		case *templateParam:
+			if n = t.arg(p, sc.params); n == nil {
+				return rhsNone
+			}
+			sc.params = nil
+		case *functionType:
+			return rhsFunction
+		case *arrayType:
+			return rhsArray
+		default:
+			return rhsNone
+		}
+	}
+}
+
+type pointerType struct {
+	pointee node
+	op      string // "*", "&" or "&&"
+}
+
+// collapse applies the reference collapsing rules, so that a reference
+// to a reference type prints as a single reference.  It returns what
+// the reference finally refers to, and the scope to print that in.
+func (n *pointerType) collapse(p *printer) (pointee node, op string, sc scope) {
+	pointee, op, sc = n.pointee, n.op, p.scope
+	if op == "*" {
+		return
+	}
+	// Like c++filt, look through one template parameter, and collapse
+	// only one level: the referenced type prints as usual.
+	sub, subScope := pointee, sc
+	if t, ok := sub.(*templateParam); ok {
+		if arg := t.arg(p, sc.params); arg != nil {
+			sub, subScope.params = arg, nil
+		}
+	}
+	inner, ok := sub.(*pointerType)
+	if !ok || inner.op == "*" {
+		return
+	}
+	if inner.op == "&" || inner.op == op {
+		op = inner.op
+	}
+	return inner.pointee, op, subScope
+}
+
+func (n *pointerType) printLeft(p *printer) {
+	pointee, op, sc := n.collapse(p)
+	p.within(sc, func() {
+		pointee.printLeft(p)
+		switch declarator(p, pointee) {
+		case rhsArray:
+			p.s(" (")
+		case rhsFunction:
+			p.s("(")
+		}
+	})
+	p.s(op)
+}
+
+func (n *pointerType) printRight(p *printer) {
+	pointee, _, sc := n.collapse(p)
+	p.within(sc, func() {
+		if declarator(p, pointee) != rhsNone {
+			p.s(")")
+		}
+		pointee.printRight(p)
+	})
+}
+
+func (n *pointerType) rhs(p *printer) int { return n.pointee.rhs(p) }
+
+type functionType struct {
+	ret    node
+	params []node
+	cv     string
+	ref    string
+}
+
+func (n *functionType) printLeft(p *printer) {
+	n.ret.printLeft(p)
+	if n.ret.rhs(p) == rhsNone {
+		p.s(" ")
+	}
+}
+
+func (n *functionType) printRight(p *printer) {
+	p.s("(")
+	p.list(n.params)
+	p.s(")")
+	n.ret.printRight(p)
+	p.s(n.cv)
+	p.s(n.ref)
+}
+
+func (n *functionType) rhs(p *printer) int { return rhsFunction }
+
+type arrayType struct {
+	elem node
+	dim  node // May be nil.
+}
+
+func (n *arrayType) printLeft(p *printer) { n.elem.printLeft(p) }
+
+func (n *arrayType) printRight(p *printer) {
+	if p.last() != ']' {
+		p.s(" ")
+	}
+	p.s("[")
+	if n.dim != nil {
+		p.print(n.dim)
+	}
+	p.s("]")
+	n.elem.printRight(p)
+}
+
+func (n *arrayType) rhs(p *printer) int { return rhsArray }
+
+type memberPointer struct {
+	class, member node
+}
+
+func (n *memberPointer) printLeft(p *printer) {
+	n.member.printLeft(p)
+	switch declarator(p, n.member) {
+	case rhsArray:
+		p.s(" (")
+	case rhsFunction:
+		p.s("(")
+	default:
+		p.s(" ")
+	}
+	p.print(n.class)
+	p.s("::*")
+}
+
+func (n *memberPointer) printRight(p *printer) {
+	if declarator(p, n.member) != rhsNone {
+		p.s(")")
+	}
+	n.member.printRight(p)
+}
+
+func (n *memberPointer) rhs(p *printer) int { return n.member.rhs(p) }
+
+type packExpansion struct {
+	leaf
+	child node
+}
+
+// findPack returns the argument pack that an expansion of n expands,
+// searching as c++filt does, or nil.
+func findPack(params []node, n node) *argPack {
+	var children []node
+	switch n := n.(type) {
+	case *templateParam:
+		pack, _ := n.resolve(params).(*argPack)
+		return pack
+	case *argPack:
+		children = n.elems
+	case *templateArgs:
+		children = n.args
+	case *qualifiedName:
+		children = []node{n.scope, n.name}
+	case *templateName:
+		children = []node{n.name, n.args}
+	case *conversionOperator:
+		children = []node{n.typ}
+	case *localName:
+		children = []node{n.encoding, n.entity}
+	case *specialName:
+		children = []node{n.child}
+	case *ctorVtable:
+		children = []node{n.first, n.second}
+	case *postfixType:
+		children = []node{n.child}
+	case *pointerType:
+		children = []node{n.pointee}
+	case *functionType:
+		children = append([]node{n.ret}, n.params...)
+	case *arrayType:
+		children = []node{n.dim, n.elem}
+	case *memberPointer:
+		children = []node{n.class, n.member}
+	case *functionEncoding:
+		children = append([]node{n.name, n.ret}, n.params...)
+	case *literal:
+		children = []node{n.typ}
+	case *prefixExpr:
+		children = []node{n.operand}
+	case *postfixExpr:
+		children = []node{n.operand}
+	case *binaryExpr:
+		children = []node{n.left, n.right}
+	case *indexExpr:
+		children = []node{n.base, n.index}
+	case *conditionalExpr:
+		children = []node{n.cond, n.then, n.els}
+	case *callExpr:
+		children = append([]node{n.fn}, n.args...)
+	case *castExpr:
+		children = append([]node{n.typ}, n.args...)
+	case *wrapped:
+		children = []node{n.child}
+	case *sizeofPack:
+		children = []node{n.arg}
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if pack := findPack(params, child); pack != nil {
+			return pack
+		}
+	}
+	return nil
+}
+
+func (n *packExpansion) printLeft(p *printer) {
+	pack := findPack(p.params, n.child)
+	if pack == nil {
+		printOperand(p, n.child)
+		p.s("...")
+		return
+	}
+	for i := range pack.elems {
+		if i > 0 {
+			p.s(", ")
+		}
+		p.packIndex = i
+		p.print(n.child)
+	}
+}
+
+// templateParam is a reference to an argument of the enclosing template
+// function.  It's resolved when printed, as substitutions can carry it
+// from one function's scope to another's.
+type templateParam struct {
+	index int
+}
+
+func (n *templateParam) resolve(params []node) node {
+	if n.index < len(params) {
+		return params[n.index]
+	}
+	return nil
+}
+
+// arg returns the argument n refers to, which for a pack is the
+// element being expanded, or nil.
+func (n *templateParam) arg(p *printer, params []node) node {
+	arg := n.resolve(params)
+	if pack, ok := arg.(*argPack); ok {
+		if p.packIndex >= len(pack.elems) {
+			return nil
+		}
+		return pack.elems[p.packIndex]
+	}
+	return arg
+}
+
+// Template arguments are printed in the scope outside the function,
+// where malformed arguments referring to themselves aren't resolved.
+
+func (n *templateParam) printLeft(p *printer) {
+	if p.lambdaArg {
+		// c++filt numbers them as g++ does.
+		p.s(fmt.Sprintf("auto:%d", n.index+1))
+		return
+	}
+	if arg := n.arg(p, p.params); arg != nil {
+		p.within(scope{}, func() { arg.printLeft(p) })
+		return
+	}
+	fail("template parameter out of range")
+}
+
+func (n *templateParam) printRight(p *printer) {
+	if p.lambdaArg {
+		return
+	}
+	if arg := n.arg(p, p.params); arg != nil {
+		p.within(scope{}, func() { arg.printRight(p) })
+	}
+}
+
+func (n *templateParam) rhs(p *printer) int {
+	r := rhsNone
+	if p.lambdaArg {
+		return r
+	}
+	if arg := n.arg(p, p.params); arg != nil {
+		p.within(scope{}, func() { r = arg.rhs(p) })
+	}
+	return r
+}
+
+// functionEncoding is a function's name with its signature.
+type functionEncoding struct {
+	leaf
+	ret    node // Only for template functions.
+	name   node
+	params []node
+	cv     string
+	ref    string
+}
+
+// functionTemplateArgs returns the template arguments of a function
+// named n, or nil.
+func functionTemplateArgs(n node) *templateArgs {
+	switch n := n.(type) {
+	case *templateName:
+		return n.args
+	case *localName:
+		return functionTemplateArgs(n.entity)
+	case *abiTagged:
+		return functionTemplateArgs(n.name)
+	}
+	return nil
+}
+
+func (n *functionEncoding) printLeft(p *printer) {
+	if args := functionTemplateArgs(n.name); args != nil {
+		saved := p.params
+		p.params = args.args
+		defer func() { p.params = saved }()
+	}
+	if n.ret != nil {
+		n.ret.printLeft(p)
+		if n.ret.rhs(p) == rhsNone {
+			p.s(" ")
+		}
+	}
+	p.print(n.name)
+	p.s("(")
+	p.list(n.params)
+	p.s(")")
+	if n.ret != nil {
+		n.ret.printRight(p)
+	}
+	p.s(n.cv)
+	p.s(n.ref)
+}
+
+// Expressions.
+
+// isSimpleExpr reports whether libiberty prints n without parentheses
+// when it is an operand.
+func isSimpleExpr(n node) bool {
+	switch n.(type) {
+	case *nameNode, *qualifiedName, *functionParam, *initList:
+		return true
+	}
+	return false
+}
+
+func printOperand(p *printer, n node) {
+	if isSimpleExpr(n) {
+		p.print(n)
+		return
+	}
+	p.s("(")
+	p.print(n)
+	p.s(")")
+}
+
+type functionParam struct {
+	leaf
+	n int
+}
+
+func (n *functionParam) printLeft(p *printer) {
+	p.s(fmt.Sprintf("{parm#%d}", n.n))
+}
+
+type literal struct {
+	leaf
+	typ    node // nil if the suffix form is used.
+	value  string
+	suffix string
+}
+
+func (n *literal) printLeft(p *printer) {
+	if n.typ != nil {
+		p.s("(")
+		p.print(n.typ)
+		p.s(")")
+	}
+	p.s(n.value)
+	p.s(n.suffix)
+}
+
+type prefixExpr struct {
+	leaf
+	op      string
+	operand node
+}
+
+func (n *prefixExpr) printLeft(p *printer) {
+	p.s(n.op)
+	operand := n.operand
+	if enc, ok := operand.(*functionEncoding); ok && n.op == "&" {
+		// Like c++filt, take the address of a qualified function
+		// without its parameters, unless it's qualified itself.
+		if _, ok := enc.name.(*qualifiedName); ok && enc.cv+enc.ref == "" {
+			operand = enc.name
+		}
+	}
+	printOperand(p, operand)
+}
+
+type postfixExpr struct {
+	leaf
+	operand node
+	op      string
+}
+
+func (n *postfixExpr) printLeft(p *printer) {
+	printOperand(p, n.operand)
+	p.s(n.op)
+}
+
+type binaryExpr struct {
+	leaf
+	left  node
+	op    string
+	right node
+}
+
+func (n *binaryExpr) printLeft(p *printer) {
+	if n.op == ">" {
+		p.s("(")
+	}
+	printOperand(p, n.left)
+	p.s(n.op)
+	printOperand(p, n.right)
+	if n.op == ">" {
+		p.s(")")
+	}
+}
+
+type indexExpr struct {
+	leaf
+	base, index node
+}
+
+func (n *indexExpr) printLeft(p *printer) {
+	printOperand(p, n.base)
+	p.s("[")
+	p.print(n.index)
+	p.s("]")
+}
+
+type conditionalExpr struct {
+	leaf
+	cond, then, els node
+}
+
+func (n *conditionalExpr) printLeft(p *printer) {
+	printOperand(p, n.cond)
+	p.s("?")
+	printOperand(p, n.then)
+	p.s(" : ")
+	printOperand(p, n.els)
+}
+
+type callExpr struct {
+	leaf
+	fn   node
+	args []node
+}
+
+func (n *callExpr) printLeft(p *printer) {
+	fn := n.fn
+	if enc, ok := fn.(*functionEncoding); ok {
+		fn = enc.name // Its parameter types aren't shown.
+	}
+	printOperand(p, fn)
+	p.s("(")
+	p.list(n.args)
+	p.s(")")
+}
+
+type castExpr struct {
+	leaf
+	typ  node
+	args []node
+}
+
+func (n *castExpr) printLeft(p *printer) {
+	p.s("(")
+	p.print(n.typ)
+	p.s(")")
+	if len(n.args) == 1 {
+		printOperand(p, n.args[0])
+		return
+	}
+	p.s("(")
+	p.list(n.args)
+	p.s(")")
+}
+
+// initList is a braced initializer list, like "{1, 2}" or "T{1, 2}".
+type initList struct {
+	leaf
+	typ   node // nil if there's none.
+	elems []node
+}
+
+func (n *initList) printLeft(p *printer) {
+	if n.typ != nil {
+		p.print(n.typ)
+	}
+	p.s("{")
+	p.list(n.elems)
+	p.s("}")
+}
+
+// wrapped prints a fixed prefix and suffix around its child, as in
+// "decltype (x)" or "sizeof (int)".
+type wrapped struct {
+	leaf
+	prefix string
+	child  node
+	suffix string
+}
+
+func (n *wrapped) printLeft(p *printer) {
+	p.s(n.prefix)
+	p.print(n.child)
+	p.s(n.suffix)
+}
+
+// sizeofPack prints as the number of elements in a pack, if known.
+type sizeofPack struct {
+	leaf
+	arg node
+}
+
+func (n *sizeofPack) printLeft(p *printer) {
+	// c++filt counts anything that isn't a pack as empty.
+	count := 0
+	if pack := findPack(p.params, n.arg); pack != nil {
+		count = len(pack.elems)
+	}
+	p.s(strconv.Itoa(count))
+}
+
+// The parser.
+
+type demangler struct {
 	input string
-	ofs   int
+	pos   int
+
+	subs []node
+	// Qualifiers of the last nested-name, which belong to the function.
+	nestedCV, nestedRef string
+	// Whether this is the type of a conversion operator.
+	conversion bool
+	// The last source name, which constructors are named after.
+	lastName string
+}
+
+func (d *demangler) peek() byte {
+	if d.pos < len(d.input) {
+		return d.input[d.pos]
+	}
+	return 0
+}
+
+func (d *demangler) peekAt(n int) byte {
+	if d.pos+n < len(d.input) {
+		return d.input[d.pos+n]
+	}
+	return 0
+}
+
+func (d *demangler) next() byte {
+	c := d.peek()
+	if c == 0 {
+		fail("unexpected end of input")
+	}
+	d.pos++
+	return c
+}
+
+func (d *demangler) consume(prefix string) bool {
+	if strings.HasPrefix(d.input[d.pos:], prefix) {
+		d.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (d *demangler) expect(c byte) {
+	if d.next() != c {
+		d.pos--
+		fail("expected '%c'", c)
+	}
+}
+
+func (d *demangler) addSub(n node) {
+	d.subs = append(d.subs, n)
+}
+
+// number parses <number> ::= [n] <decimal digits>, returning it as text.
+func (d *demangler) number() string {
+	start := d.pos
+	if d.peek() == 'n' {
+		d.pos++
+	}
+	digits := d.pos
+	for '0' <= d.peek() && d.peek() <= '9' {
+		d.pos++
+	}
+	if d.pos == digits {
+		fail("expected number")
+	}
+	if d.input[start] == 'n' {
+		return "-" + d.input[digits:d.pos]
+	}
+	return d.input[start:d.pos]
 }
 
-func (r *stringReader) ReadByte() (byte, error) {
-	if r.ofs == len(r.input) {
-		return 0, io.EOF
+func (d *demangler) int() int {
+	str := d.number()
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		fail("bad number %q", str)
 	}
-	r.ofs++
-	return r.input[r.ofs-1], nil
+	return n
 }
-func (r *stringReader) UnreadByte() {
-	if r.ofs == 0 {
-		panic("unread past beginning")
+
+// sourceName parses <source-name> ::= <positive length number> <identifier>.
+func (d *demangler) sourceName() node {
+	n := d.int()
+	if n <= 0 || n > len(d.input)-d.pos {
+		fail("bad source name length")
+	}
+	id := d.input[d.pos : d.pos+n]
+	d.pos += n
+	if strings.HasPrefix(id, "_GLOBAL_") && len(id) > 9 && strings.IndexByte("._$", id[8]) >= 0 && id[9] == 'N' {
+		id = "(anonymous namespace)"
 	}
-	r.ofs--
+	d.lastName = id
+	return &nameNode{name: id}
+}
+
+// Special substitutions.  c++filt prints the full expansion of the ones
+// that aren't templates themselves.
+var stdSubs = map[byte]struct {
+	name string
+	args []string
+}{
+	'a': {"allocator", nil},
+	'b': {"basic_string", nil},
+	's': {"basic_string", []string{"char", "std::char_traits<char>", "std::allocator<char>"}},
+	'i': {"basic_istream", []string{"char", "std::char_traits<char>"}},
+	'o': {"basic_ostream", []string{"char", "std::char_traits<char>"}},
+	'd': {"basic_iostream", []string{"char", "std::char_traits<char>"}},
 }
 
-func (r *stringReader) ReadN(n int) (string, error) {
-	str := r.input[r.ofs:r.ofs+n]
-	r.ofs += len(str)
-	if len(str) < n {
-		return str, io.EOF
+// substitution parses <substitution>, other than St.
+func (d *demangler) substitution() node {
+	d.expect('S')
+	c := d.peek()
+	if sub, ok := stdSubs[c]; ok {
+		d.pos++
+		d.lastName = sub.name // What its constructors are called.
+		n := node(&qualifiedName{scope: &nameNode{name: "std"}, name: &nameNode{name: sub.name}})
+		if sub.args != nil {
+			args := &templateArgs{}
+			for _, arg := range sub.args {
+				args.args = append(args.args, &nameNode{name: arg})
+			}
+			n = &templateName{name: n, args: args}
+		}
+		return n
+	}
+	id := 0
+	if c != '_' {
+		for {
+			c := d.next()
+			if c == '_' {
+				break
+			}
+			switch {
+			case '0' <= c && c <= '9':
+				id = id*36 + int(c-'0')
+			case 'A' <= c && c <= 'Z':
+				id = id*36 + int(c-'A') + 10
+			default:
+				fail("bad substitution")
+			}
+			if id > len(d.subs) {
+				fail("substitution out of range")
+			}
+		}
+		id++
+	} else {
+		d.pos++
 	}
-	return str, nil
+	if id >= len(d.subs) {
+		fail("substitution S%d_ out of range", id)
+	}
+	return d.subs[id]
 }
 
-type mr struct {
-	*stringReader
-	output   string
-	leftover string
+// templateParam parses <template-param> ::= T_ | T <number> _.
+func (d *demangler) templateParam() node {
+	d.expect('T')
+	index := 0
+	if d.peek() != '_' {
+		index = d.int() + 1
+	}
+	d.expect('_')
+	if index < 0 {
+		fail("bad template parameter")
+	}
+	return &templateParam{index: index}
 }
 
-func (r *mr) Write(str string) {
-	r.output += str
+// templateArgs parses <template-args> ::= I <template-arg>+ E.
+func (d *demangler) templateArgs() *templateArgs {
+	d.expect('I')
+	lastName := d.lastName
+	var args []node
+	for d.peek() != 'E' {
+		args = append(args, d.templateArg())
+	}
+	d.pos++
+	d.lastName = lastName
+	return &templateArgs{args: args}
 }
 
-func (r *mr) ReadSourceName() (string, error) {
-	count := 0
-	for {
-		c, err := r.ReadByte()
-		if err != nil {
-			return "", err
+func (d *demangler) templateArg() node {
+	switch d.peek() {
+	case 'X':
+		d.pos++
+		e := d.expression()
+		d.expect('E')
+		return e
+	case 'L':
+		return d.exprPrimary()
+	case 'J':
+		d.pos++
+		var elems []node
+		for d.peek() != 'E' {
+			elems = append(elems, d.templateArg())
 		}
-		if '0' <= c && c <= '9' {
-			count = count * 10 + int(c - '0')
-		} else {
-			r.UnreadByte()
-			break
+		d.pos++
+		return &argPack{elems: elems}
+	}
+	return d.typ()
+}
+
+// ctorDtorBase returns the name constructors and destructors print
+// with, which like c++filt's is the last source name parsed.
+func (d *demangler) ctorDtorBase() string {
+	if d.lastName == "" {
+		fail("constructor or destructor without class")
+	}
+	return d.lastName
+}
+
+// operators maps operator codes to their names and arity in
+// expressions.
+var operators = map[string]struct {
+	name  string
+	arity int
+}{
+	"nw": {"new", 3}, "na": {"new[]", 3}, "dl": {"delete", 1}, "da": {"delete[]", 1},
+	"ps": {"+", 1}, "ng": {"-", 1}, "ad": {"&", 1}, "de": {"*", 1}, "co": {"~", 1},
+	"pl": {"+", 2}, "mi": {"-", 2}, "ml": {"*", 2}, "dv": {"/", 2}, "rm": {"%", 2},
+	"an": {"&", 2}, "or": {"|", 2}, "eo": {"^", 2}, "aS": {"=", 2}, "pL": {"+=", 2},
+	"mI": {"-=", 2}, "mL": {"*=", 2}, "dV": {"/=", 2}, "rM": {"%=", 2}, "aN": {"&=", 2},
+	"oR": {"|=", 2}, "eO": {"^=", 2}, "ls": {"<<", 2}, "rs": {">>", 2}, "lS": {"<<=", 2},
+	"rS": {">>=", 2}, "eq": {"==", 2}, "ne": {"!=", 2}, "lt": {"<", 2}, "gt": {">", 2},
+	"le": {"<=", 2}, "ge": {">=", 2}, "ss": {"<=>", 2}, "nt": {"!", 1}, "aa": {"&&", 2},
+	"oo": {"||", 2}, "pp": {"++", 1}, "mm": {"--", 1}, "cm": {",", 2}, "pm": {"->*", 2},
+	"pt": {"->", 2}, "cl": {"()", 2}, "ix": {"[]", 2}, "qu": {"?", 3},
+	"aw": {"co_await", 1},
+}
+
+// unqualifiedName parses <unqualified-name>.  scope is the name so far,
+// which constructor and destructor names are derived from.
+func (d *demangler) unqualifiedName() node {
+	var n node
+	c := d.peek()
+	switch {
+	case c == 'L':
+		// Internal linkage, as GCC mangles static functions.
+		d.pos++
+		n = d.unqualifiedName()
+		d.discriminator()
+		return n
+	case '0' <= c && c <= '9':
+		n = d.sourceName()
+	case c == 'C':
+		d.pos++
+		inheriting := d.consume("I")
+		switch d.next() {
+		case '1', '2', '3', '4', '5':
+		default:
+			fail("bad constructor")
+		}
+		if inheriting {
+			// CI1/CI2 <base class type>, whose name it takes.
+			d.typ()
+		}
+		n = &ctorDtorName{base: d.ctorDtorBase()}
+	case c == 'D' && strings.IndexByte("012345", d.peekAt(1)) >= 0:
+		d.pos += 2
+		n = &ctorDtorName{base: d.ctorDtorBase(), dtor: true}
+	case c == 'U':
+		switch d.peekAt(1) {
+		case 't':
+			d.pos += 2
+			num := 1
+			if d.peek() != '_' {
+				num = d.int() + 2
+			}
+			d.expect('_')
+			n = &unnamedType{n: num}
+		case 'l':
+			d.pos += 2
+			params := d.bareFunctionParams()
+			d.expect('E')
+			num := 1
+			if d.peek() != '_' {
+				num = d.int() + 2
+			}
+			d.expect('_')
+			n = &lambdaName{params: params, n: num}
+		default:
+			fail("unknown unnamed name")
 		}
+	case c == 'D' && d.peekAt(1) == 'C':
+		// Structured binding: DC <source-name>+ E.
+		d.pos += 2
+		var names []string
+		for d.peek() != 'E' {
+			names = append(names, d.sourceName().(*nameNode).name)
+		}
+		d.pos++
+		n = &nameNode{name: "[" + strings.Join(names, ", ") + "]"}
+	default:
+		n = d.operatorName()
 	}
+	for d.peek() == 'B' {
+		d.pos++
+		lastName := d.lastName
+		tag := d.sourceName().(*nameNode)
+		d.lastName = lastName
+		n = &abiTagged{name: n, tag: tag.name}
+	}
+	return n
+}
 
-	buf, err := r.ReadN(count)
-	if err != nil {
-		return "", err
+// operatorName parses <operator-name> in a function name.
+func (d *demangler) operatorName() node {
+	if d.pos+2 > len(d.input) {
+		fail("expected operator name")
+	}
+	code := d.input[d.pos : d.pos+2]
+	switch {
+	case code == "cv":
+		d.pos += 2
+		saved := d.conversion
+		d.conversion = true
+		typ := d.typ()
+		d.conversion = saved
+		return &conversionOperator{typ: typ}
+	case code == "li":
+		d.pos += 2
+		name := d.sourceName().(*nameNode)
+		return &nameNode{name: "operator\"\" " + name.name}
+	case code[0] == 'v' && '0' <= code[1] && code[1] <= '9':
+		d.pos += 2
+		name := d.sourceName().(*nameNode)
+		return &nameNode{name: "operator " + name.name}
 	}
+	op, ok := operators[code]
+	if !ok {
+		fail("unknown operator %q", code)
+	}
+	d.pos += 2
+	name := op.name
+	if name[0] >= 'a' && name[0] <= 'z' {
+		return &nameNode{name: "operator " + name}
+	}
+	return &nameNode{name: "operator" + name}
+}
 
-	return string(buf), nil
+// cvQualifiers parses [r] [V] [K], returning them as c++filt prints them.
+func (d *demangler) cvQualifiers() string {
+	var q string
+	if d.consume("r") {
+		q = " restrict"
+	}
+	if d.consume("V") {
+		q = " volatile" + q
+	}
+	if d.consume("K") {
+		q = " const" + q
+	}
+	return q
 }
 
-func CVQualifier(c byte) string {
-	switch c {
-	case 'r': return "restrict"
-	case 'V': return "volatile"
-	case 'K': return "const"
+func (d *demangler) refQualifier() string {
+	if d.consume("R") {
+		return " &"
+	}
+	if d.consume("O") {
+		return " &&"
 	}
 	return ""
 }
 
-func (r *mr) ReadSubstitution() (string, error) {
-	// XXX this special-cases out just the cases we've hit.
+// nestedName parses <nested-name> ::= N [<CV-qualifiers>] [<ref-qualifier>] <prefix> E.
+func (d *demangler) nestedName() node {
+	d.expect('N')
+	cv := d.cvQualifiers()
+	ref := d.refQualifier()
 
-	b, err := r.ReadByte()
-	if err != nil {
-		return "", err
+	var n node
+	for d.peek() != 'E' {
+		switch c := d.peek(); {
+		case c == 'S' && d.peekAt(1) == 't':
+			d.pos += 2
+			n = &nameNode{name: "std"}
+			continue
+		case c == 'S':
+			sub := d.substitution()
+			if n != nil {
+				fail("substitution in the middle of a nested name")
+			}
+			n = sub
+			continue
+		case c == 'I':
+			if n == nil {
+				fail("template args without a name")
+			}
+			n = &templateName{name: n, args: d.templateArgs()}
+		case c == 'T':
+			if n != nil {
+				fail("template param in the middle of a nested name")
+			}
+			n = d.templateParam()
+		case c == 'D' && (d.peekAt(1) == 't' || d.peekAt(1) == 'T'):
+			n = d.decltype()
+		case c == 'M':
+			// A closure's context for lambdas in initializers.
+			d.pos++
+			continue
+		default:
+			name := d.unqualifiedName()
+			if n == nil {
+				n = name
+			} else {
+				n = &qualifiedName{scope: n, name: name}
+			}
+		}
+		if d.peek() != 'E' {
+			d.addSub(n)
+		}
 	}
-	switch b {
-	case 't':
-		return "std", nil
-	default:
-		for '0' <= b && b <= '9' {
-			b, err = r.ReadByte()
-			if err != nil {
-				return "", err
+	d.pos++
+	if n == nil {
+		fail("empty nested name")
+	}
+	// Set last, after any nested names within this one.
+	d.nestedCV, d.nestedRef = cv, ref
+	return n
+}
+
+// localName parses <local-name> ::= Z <encoding> E <entity> [<discriminator>].
+func (d *demangler) localName() node {
+	d.expect('Z')
+	enc := d.encoding()
+	d.expect('E')
+	d.nestedCV, d.nestedRef = "", ""
+	if fn, ok := enc.(*functionEncoding); ok {
+		fn.ret = nil // c++filt doesn't print it for the enclosing function.
+	}
+	var entity node
+	if d.consume("s") {
+		entity = &nameNode{name: "string literal"}
+		d.discriminator()
+	} else {
+		defaultArg := 0
+		if d.consume("d") {
+			// Default argument scope: d [<number>] _.
+			defaultArg = 1
+			if d.peek() != '_' {
+				defaultArg = d.int() + 2
+				if defaultArg < 2 {
+					fail("bad default argument number")
+				}
+			}
+			d.expect('_')
+		}
+		entity = d.name()
+		switch entity.(type) {
+		case *lambdaName, *unnamedType:
+			// These have their own numbering.
+		default:
+			d.discriminator()
+		}
+		if defaultArg > 0 {
+			entity = &qualifiedName{
+				scope: &nameNode{name: fmt.Sprintf("{default arg#%d}", defaultArg)},
+				name:  entity,
+			}
+		}
+	}
+	return &localName{encoding: enc, entity: entity}
+}
+
+// discriminator parses <discriminator> ::= _ <digit> | __ <number> _,
+// as loosely as c++filt does: any number, or none, may follow one
+// underscore, and the closing one is only needed after two digits.
+func (d *demangler) discriminator() {
+	if d.peek() != '_' {
+		return
+	}
+	d.pos++
+	underscores := d.consume("_")
+	n := 0
+	if c := d.peek(); '0' <= c && c <= '9' {
+		n = d.int()
+	}
+	if underscores && n >= 10 {
+		d.expect('_')
+	}
+}
+
+// name parses <name>.
+func (d *demangler) name() node {
+	switch c := d.peek(); {
+	case c == 'N':
+		return d.nestedName()
+	case c == 'Z':
+		return d.localName()
+	case c == 'S' && d.peekAt(1) == 't':
+		d.pos += 2
+		n := node(&qualifiedName{scope: &nameNode{name: "std"}, name: d.unqualifiedName()})
+		if d.peek() == 'I' {
+			d.addSub(n)
+			n = &templateName{name: n, args: d.templateArgs()}
+		}
+		return n
+	case c == 'S':
+		n := d.substitution()
+		if d.peek() != 'I' {
+			fail("substitution as a name must be a template")
+		}
+		return &templateName{name: n, args: d.templateArgs()}
+	}
+	n := d.unqualifiedName()
+	if d.peek() == 'I' {
+		d.addSub(n)
+		n = &templateName{name: n, args: d.templateArgs()}
+	}
+	return n
+}
+
+// hasReturnType reports whether a function named n mangles its return
+// type: template functions other than constructors, destructors and
+// conversion operators do.
+func hasReturnType(n node) bool {
+	switch n := n.(type) {
+	case *templateName:
+		switch n.name.(type) {
+		case *ctorDtorName, *conversionOperator:
+			return false
+		}
+		if q, ok := n.name.(*qualifiedName); ok {
+			switch q.name.(type) {
+			case *ctorDtorName, *conversionOperator:
+				return false
 			}
 		}
+		return true
+	case *localName:
+		return hasReturnType(n.entity)
+	case *abiTagged:
+		return hasReturnType(n.name)
+	}
+	return false
+}
+
+// encoding parses <encoding>.
+func (d *demangler) encoding() node {
+	switch c := d.peek(); {
+	case c == 'T' || (c == 'G' && strings.IndexByte("VRTA", d.peekAt(1)) >= 0):
+		return d.specialName()
+	}
+
+	// Encodings inside this one's template arguments mustn't leave
+	// their qualifiers to it, nor this one to what it's inside of.
+	savedCV, savedRef := d.nestedCV, d.nestedRef
+	defer func() { d.nestedCV, d.nestedRef = savedCV, savedRef }()
+	d.nestedCV, d.nestedRef = "", ""
+	name := d.name()
+	cv, ref := d.nestedCV, d.nestedRef
+
+	if c := d.peek(); c == 0 || c == 'E' || c == '.' || c == '@' {
+		// A data name.
+		if cv+ref != "" {
+			return &postfixType{child: name, postfix: cv + ref}
+		}
+		return name
+	}
+
+	enc := &functionEncoding{name: name, cv: cv, ref: ref}
+	if hasReturnType(name) {
+		enc.ret = d.typ()
 	}
-	return "XXX", nil
+	enc.params = d.bareFunctionParams()
+	return enc
 }
 
-func (r *mr) ReadTemplateArgs() error {
-	// Hacky attempt to skim past template args.
-	depth := 1
+// bareFunctionParams parses a function's parameter types, up to the end
+// of the input or an 'E'.  A lone "void" means no parameters.
+func (d *demangler) bareFunctionParams() []node {
+	var params []node
 	for {
-		b, err := r.ReadByte()
-		if err != nil {
+		c := d.peek()
+		if c == 0 || c == 'E' || c == '.' || c == '@' {
+			break
+		}
+		if c == '_' && len(params) > 0 {
+			break // A discriminator.
+		}
+		params = append(params, d.typ())
+	}
+	if len(params) == 0 {
+		fail("expected function parameters")
+	}
+	if len(params) == 1 {
+		if n, ok := params[0].(*nameNode); ok && n.name == "void" {
 			return nil
 		}
-		switch b {
-		case 'E':
-			depth--
-			if depth == 0 {
-				return nil
-			}
-		case 'X': // expression
-			depth++
-		case 'J': // argument pack
-			depth++
-		case 'L': // expr-primary
-			depth++
-		case 'I': // nested template
-			depth++
-		case 'N': // nested name
-			depth++
-		case 'S':
-			// Specially handle substitutions because "S12_" would otherwise
-			// confuse the default branch below.
-			_, err = r.ReadSubstitution()
-			if err != nil {
-				return err
+	}
+	return params
+}
+
+// callOffset parses <call-offset> ::= h <nv-offset> _ | v <v-offset> _.
+func (d *demangler) callOffset() {
+	switch d.next() {
+	case 'h':
+		d.number()
+		d.expect('_')
+	case 'v':
+		d.number()
+		d.expect('_')
+		d.number()
+		d.expect('_')
+	default:
+		fail("bad call offset")
+	}
+}
+
+// specialName parses <special-name>.
+func (d *demangler) specialName() node {
+	if d.consume("GV") {
+		return &specialName{prefix: "guard variable for ", child: d.name()}
+	}
+	if d.consume("GR") {
+		name := d.name()
+		num := "0"
+		if c := d.peek(); '0' <= c && c <= '9' {
+			num = d.number()
+		}
+		return &specialName{prefix: "reference temporary #" + num + " for ", child: name}
+	}
+	if d.consume("GTt") {
+		return &specialName{prefix: "transaction clone for ", child: d.encoding()}
+	}
+	if d.consume("GTn") {
+		return &specialName{prefix: "non-transaction clone for ", child: d.encoding()}
+	}
+	if d.consume("GA") {
+		return &specialName{prefix: "hidden alias for ", child: d.encoding()}
+	}
+	d.expect('T')
+	switch c := d.next(); c {
+	case 'V':
+		return &specialName{prefix: "vtable for ", child: d.typ()}
+	case 'T':
+		return &specialName{prefix: "VTT for ", child: d.typ()}
+	case 'I':
+		return &specialName{prefix: "typeinfo for ", child: d.typ()}
+	case 'S':
+		return &specialName{prefix: "typeinfo name for ", child: d.typ()}
+	case 'F':
+		return &specialName{prefix: "typeinfo fn for ", child: d.typ()}
+	case 'h':
+		d.number()
+		d.expect('_')
+		return &specialName{prefix: "non-virtual thunk to ", child: d.encoding()}
+	case 'v':
+		d.number()
+		d.expect('_')
+		d.number()
+		d.expect('_')
+		return &specialName{prefix: "virtual thunk to ", child: d.encoding()}
+	case 'c':
+		d.callOffset()
+		d.callOffset()
+		return &specialName{prefix: "covariant return thunk to ", child: d.encoding()}
+	case 'C':
+		derived := d.typ()
+		d.number()
+		d.expect('_')
+		base := d.typ()
+		return &ctorVtable{first: base, second: derived}
+	case 'H':
+		return &specialName{prefix: "TLS init function for ", child: d.name()}
+	case 'W':
+		return &specialName{prefix: "TLS wrapper function for ", child: d.name()}
+	}
+	d.pos--
+	fail("unknown special name")
+	return nil
+}
+
+var builtinTypes = map[byte]string{
+	'v': "void", 'w': "wchar_t", 'b': "bool", 'c': "char", 'a': "signed char",
+	'h': "unsigned char", 's': "short", 't': "unsigned short", 'i': "int",
+	'j': "unsigned int", 'l': "long", 'm': "unsigned long", 'x': "long long",
+	'y': "unsigned long long", 'n': "__int128", 'o': "unsigned __int128",
+	'f': "float", 'd': "double", 'e': "long double", 'g': "__float128",
+	'z': "...",
+}
+
+var builtinDTypes = map[byte]string{
+	'd': "decimal64", 'e': "decimal128", 'f': "decimal32", 'h': "half",
+	'i': "char32_t", 's': "char16_t", 'u': "char8_t", 'a': "auto",
+	'c': "decltype(auto)", 'n': "decltype(nullptr)",
+}
+
+// typ parses <type>.
+func (d *demangler) typ() node {
+	c := d.peek()
+	if name, ok := builtinTypes[c]; ok {
+		d.pos++
+		return &nameNode{name: name}
+	}
+
+	var n node
+	switch c {
+	case 'u':
+		d.pos++
+		n = d.sourceName()
+		// Vendor extended types are substitution candidates.
+	case 'D':
+		if name, ok := builtinDTypes[d.peekAt(1)]; ok {
+			d.pos += 2
+			return &nameNode{name: name}
+		}
+		switch d.peekAt(1) {
+		case 'F':
+			// DF <number> _ is _FloatN; DF <number> x is _FloatNx.
+			d.pos += 2
+			bits := d.number()
+			if d.consume("x") {
+				fail("unsupported _Float%sx", bits)
 			}
-		default:
-			if '0' <= b && b <= '9' {
-				r.UnreadByte()
-				_, err = r.ReadSourceName()
-				if err != nil {
-					return err
-				}
+			d.expect('_')
+			return &nameNode{name: "_Float" + bits}
+		case 'p':
+			d.pos += 2
+			n = &packExpansion{child: d.typ()}
+		case 't', 'T':
+			n = d.decltype()
+		case 'v':
+			d.pos += 2
+			var dim string
+			if d.peek() == '_' {
+				d.pos++
+				dim = printNode(d.expression())
 			} else {
-				// hope for the best!
+				dim = d.number()
+			}
+			d.expect('_')
+			n = &postfixType{child: d.typ(), postfix: " __vector(" + dim + ")"}
+		case 'x', 'o', 'O', 'w':
+			fail("unsupported exception specification")
+		default:
+			fail("unknown builtin type D%c", d.peekAt(1))
+		}
+	case 'r', 'V', 'K':
+		cv := d.cvQualifiers()
+		if d.peek() == 'F' {
+			// Qualifiers on a function type belong to the function, as
+			// in a pointer to a const member function, and the two
+			// make a single substitution candidate.
+			fn := d.functionType().(*functionType)
+			fn.cv = cv
+			n = fn
+		} else {
+			n = &postfixType{child: d.typ(), postfix: cv}
+		}
+	case 'U':
+		d.pos++
+		q := d.sourceName().(*nameNode)
+		if d.peek() == 'I' {
+			d.templateArgs()
+		}
+		n = &postfixType{child: d.typ(), postfix: " " + q.name, paren: true}
+	case 'P':
+		d.pos++
+		n = &pointerType{pointee: d.typ(), op: "*"}
+	case 'R':
+		d.pos++
+		n = &pointerType{pointee: d.typ(), op: "&"}
+	case 'O':
+		d.pos++
+		n = &pointerType{pointee: d.typ(), op: "&&"}
+	case 'C':
+		d.pos++
+		n = &postfixType{child: d.typ(), postfix: " _Complex", paren: true}
+	case 'G':
+		d.pos++
+		n = &postfixType{child: d.typ(), postfix: " _Imaginary", paren: true}
+	case 'F':
+		n = d.functionType()
+	case 'A':
+		n = d.arrayType()
+	case 'M':
+		d.pos++
+		class := d.typ()
+		member := d.typ()
+		n = &memberPointer{class: class, member: member}
+	case 'T':
+		n = d.templateParam()
+		if d.peek() != 'I' {
+			break
+		}
+		if d.conversion {
+			// In "cv T_ I...E", the arguments are usually the
+			// conversion operator's own, unless more follow.
+			pos, nsubs := d.pos, len(d.subs)
+			args := d.templateArgs()
+			if d.peek() != 'I' {
+				d.pos, d.subs = pos, d.subs[:nsubs]
+				break
 			}
+			d.addSub(n)
+			n = &templateName{name: n, args: args}
+			break
+		}
+		d.addSub(n)
+		n = &templateName{name: n, args: d.templateArgs()}
+	case 'S':
+		if d.peekAt(1) != 't' {
+			sub := d.substitution()
+			if d.peek() != 'I' {
+				return sub // Substitutions aren't new candidates.
+			}
+			n = &templateName{name: sub, args: d.templateArgs()}
+			break
+		}
+		n = d.name()
+	default:
+		n = d.name()
+	}
+	d.addSub(n)
+	return n
+}
+
+// functionType parses <function-type> ::= F [Y] <bare-function-type> [<ref-qualifier>] E.
+func (d *demangler) functionType() node {
+	d.expect('F')
+	d.consume("Y")
+	ret := d.typ()
+	var params []node
+	for d.peek() != 'E' && !(d.peekAt(1) == 'E' && (d.peek() == 'R' || d.peek() == 'O')) {
+		params = append(params, d.typ())
+	}
+	if len(params) == 1 {
+		if n, ok := params[0].(*nameNode); ok && n.name == "void" {
+			params = nil
 		}
 	}
-	panic("not reached")
+	ref := d.refQualifier()
+	d.expect('E')
+	return &functionType{ret: ret, params: params, ref: ref}
+}
+
+// arrayType parses <array-type> ::= A [<dimension>] _ <element type>.
+func (d *demangler) arrayType() node {
+	d.expect('A')
+	var dim node
+	switch c := d.peek(); {
+	case c == '_':
+	case '0' <= c && c <= '9':
+		dim = &nameNode{name: d.number()}
+	default:
+		dim = d.expression()
+	}
+	d.expect('_')
+	return &arrayType{elem: d.typ(), dim: dim}
+}
+
+func (d *demangler) decltype() node {
+	d.expect('D')
+	if c := d.next(); c != 't' && c != 'T' {
+		fail("expected decltype")
+	}
+	e := d.expression()
+	d.expect('E')
+	return &wrapped{prefix: "decltype (", child: e, suffix: ")"}
 }
 
-func (r *mr) ReadNestedName() (string, error) {
-	fullname := ""
+// exprPrimary parses <expr-primary> ::= L ... E.
+func (d *demangler) exprPrimary() node {
+	d.expect('L')
+	if d.peek() == '_' && d.peekAt(1) == 'Z' {
+		d.pos += 2
+		enc := d.encoding()
+		d.expect('E')
+		return enc
+	}
+	if d.consume("Z") {
+		enc := d.encoding()
+		d.expect('E')
+		return enc
+	}
+
+	typ := d.typ()
+	if d.peek() == 'E' {
+		d.pos++
+		// A literal with no value, like nullptr's LDnE.
+		return typ
+	}
+	start := d.pos
+	for d.peek() != 'E' {
+		d.next()
+	}
+	value := d.input[start:d.pos]
+	d.pos++
+	if strings.HasPrefix(value, "n") {
+		value = "-" + value[1:]
+	}
+
 	name := ""
-	for {
-		b, err := r.ReadByte()
-		if err != nil {
-			return "", err
-		}
-		switch {
-		case '0' <= b && b <= '9':
-			r.UnreadByte()
-			name, err = r.ReadSourceName()
-			if err != nil {
-				return "", err
-			}
-			if fullname != "" {
-				fullname += "::"
-			}
-			fullname += name
-		case b == 'E':  // done
-			return fullname, nil
-		case b == 'C':  // ctor
-			b, err := r.ReadByte()
-			if err != nil {
-				return "", err
-			}
-			switch b {
-			case '1', '2', '3': // see spec
-				fullname += "::" + name
-			default:
-				r.UnreadByte()
-				return "", fmt.Errorf("unexpected '%c' reading ctor type", b)
-			}
-		case b == 'S':  // St => ::std::
-			sub, err := r.ReadSubstitution()
-			if err != nil {
-				return "", err
-			}
-			fullname += sub
-		case b == 'I':  // template-args
-			err := r.ReadTemplateArgs()
-			if err != nil {
-				return "", err
-			}
-			fullname += "<>"
-		case len(CVQualifier(b)) > 0:
-			// Ignore cv-qualifier for now.
-			continue
-		default:
-			r.UnreadByte()
-			return "", fmt.Errorf("unexpected '%c' reading nested name", b)
+	if t, ok := typ.(*nameNode); ok {
+		name = t.name
+	}
+	switch name {
+	case "int":
+		return &literal{value: value}
+	case "unsigned int":
+		return &literal{value: value, suffix: "u"}
+	case "long":
+		return &literal{value: value, suffix: "l"}
+	case "unsigned long":
+		return &literal{value: value, suffix: "ul"}
+	case "long long":
+		return &literal{value: value, suffix: "ll"}
+	case "unsigned long long":
+		return &literal{value: value, suffix: "ull"}
+	case "bool":
+		switch value {
+		case "0":
+			return &literal{value: "false"}
+		case "1":
+			return &literal{value: "true"}
 		}
+	case "float", "double", "long double", "__float128":
+		return &literal{typ: typ, value: "[" + value + "]"}
 	}
-	panic("not reached")
+	return &literal{typ: typ, value: value}
 }
 
-func (r *mr) demangle(name string) error {
-	header, err := r.ReadN(2)
-	if err != nil {
-		return err
+// expression parses <expression>.
+func (d *demangler) expression() node {
+	c := d.peek()
+	switch {
+	case c == 'L':
+		return d.exprPrimary()
+	case c == 'T':
+		return d.templateParam()
+	case '0' <= c && c <= '9':
+		return d.baseUnresolvedName()
 	}
-	if header != "_Z" {
-		// Nothing to demangle.
-		r.output = name
-		return nil
+	if d.pos+2 > len(d.input) {
+		fail("expected expression")
+	}
+	code := d.input[d.pos : d.pos+2]
+	switch code {
+	case "fp", "fL":
+		d.pos += 2
+		if code == "fL" {
+			d.number()
+			d.expect('p')
+		}
+		d.cvQualifiers()
+		n := 1
+		if d.peek() != '_' {
+			n = d.int() + 2
+		}
+		d.expect('_')
+		return &functionParam{n: n}
+	case "Dt", "DT":
+		return d.decltype()
+	case "st":
+		d.pos += 2
+		return &wrapped{prefix: "sizeof (", child: d.typ(), suffix: ")"}
+	case "at":
+		d.pos += 2
+		return &wrapped{prefix: "alignof (", child: d.typ(), suffix: ")"}
+	case "sz":
+		d.pos += 2
+		return &prefixExpr{op: "sizeof ", operand: d.expression()}
+	case "az":
+		d.pos += 2
+		return &prefixExpr{op: "alignof ", operand: d.expression()}
+	case "sZ":
+		d.pos += 2
+		var arg node
+		if d.peek() == 'T' {
+			arg = d.templateParam()
+		} else {
+			arg = d.expression()
+		}
+		return &sizeofPack{arg: arg}
+	case "sp":
+		d.pos += 2
+		return &packExpansion{child: d.expression()}
+	case "tw":
+		d.pos += 2
+		return &prefixExpr{op: "throw ", operand: d.expression()}
+	case "tr":
+		d.pos += 2
+		return &nameNode{name: "throw"}
+	case "cv":
+		d.pos += 2
+		typ := d.typ()
+		var args []node
+		if d.consume("_") {
+			for d.peek() != 'E' {
+				args = append(args, d.expression())
+			}
+			d.pos++
+		} else {
+			args = []node{d.expression()}
+		}
+		return &castExpr{typ: typ, args: args}
+	case "il", "tl":
+		d.pos += 2
+		var typ node
+		if code == "tl" {
+			typ = d.typ()
+		}
+		var elems []node
+		for d.peek() != 'E' {
+			elems = append(elems, d.expression())
+		}
+		d.pos++
+		return &initList{typ: typ, elems: elems}
+	case "cl":
+		d.pos += 2
+		fn := d.expression()
+		var args []node
+		for d.peek() != 'E' {
+			args = append(args, d.expression())
+		}
+		d.pos++
+		return &callExpr{fn: fn, args: args}
+	case "dt", "pt":
+		d.pos += 2
+		base := d.expression()
+		member := d.unresolvedName()
+		op := "."
+		if code == "pt" {
+			op = "->"
+		}
+		return &binaryExpr{left: base, op: op, right: member}
+	case "sr":
+		return d.unresolvedName()
+	case "ix":
+		d.pos += 2
+		base := d.expression()
+		return &indexExpr{base: base, index: d.expression()}
+	case "qu":
+		d.pos += 2
+		cond := d.expression()
+		then := d.expression()
+		return &conditionalExpr{cond: cond, then: then, els: d.expression()}
+	case "nw", "na":
+		d.pos += 2
+		for d.peek() != '_' {
+			d.expression()
+		}
+		d.pos++
+		typ := d.typ()
+		if !d.consume("E") {
+			fail("unsupported new initializer")
+		}
+		op := "new "
+		if code == "na" {
+			op = "new[] "
+		}
+		return &prefixExpr{op: op, operand: typ}
+	case "so", "fl", "fr", "fR", "di", "dx", "dX", "nx", "dc", "sc", "cc", "rc", "ti", "te", "u8":
+		fail("unsupported expression %q", code)
+	case "pp", "mm":
+		d.pos += 2
+		if d.consume("_") {
+			return &prefixExpr{op: operators[code].name, operand: d.expression()}
+		}
+		return &postfixExpr{operand: d.expression(), op: operators[code].name}
 	}
 
-	b, err := r.ReadByte()
-	if err != nil {
-		return err
+	if op, ok := operators[code]; ok {
+		d.pos += 2
+		switch op.arity {
+		case 1:
+			return &prefixExpr{op: op.name, operand: d.expression()}
+		case 2:
+			left := d.expression()
+			return &binaryExpr{left: left, op: op.name, right: d.expression()}
+		}
+	}
+	if c == 'o' && d.peekAt(1) == 'n' {
+		d.pos += 2
+		return d.operatorName()
 	}
-	switch b {
-	case 'N': // nested-name
-		fullname, err := r.ReadNestedName()
-		if err != nil {
-			return err
+	return d.unresolvedName()
+}
+
+// unresolvedName parses the subset of <unresolved-name> that shows up
+// in practice: [gs] sr <type> <base-unresolved-name>, and plain names.
+func (d *demangler) unresolvedName() node {
+	global := d.consume("gs")
+	var n node
+	if d.consume("sr") {
+		var scope node
+		if d.consume("N") {
+			scope = d.typ()
+			for d.peek() != 'E' {
+				name := d.sourceName()
+				if d.peek() == 'I' {
+					name = &templateName{name: name, args: d.templateArgs()}
+				}
+				scope = &qualifiedName{scope: scope, name: name}
+			}
+			d.pos++
+		} else if c := d.peek(); '0' <= c && c <= '9' {
+			for d.peek() != 'E' {
+				name := d.sourceName()
+				if d.peek() == 'I' {
+					name = &templateName{name: name, args: d.templateArgs()}
+				}
+				if scope == nil {
+					scope = name
+				} else {
+					scope = &qualifiedName{scope: scope, name: name}
+				}
+			}
+			d.pos++
+		} else {
+			scope = d.typ()
+			if d.peek() == 'I' {
+				scope = &templateName{name: scope, args: d.templateArgs()}
+			}
 		}
-		r.Write(fullname)
-	default:
-		if '0' <= b && b <= '9' {
-			r.UnreadByte()
-			name, err := r.ReadSourceName()
-			if err != nil {
-				return err
+		name := d.baseUnresolvedName()
+		if t, ok := name.(*templateName); ok {
+			// Printed as "(a::b<c>)(...)" when called, unlike "a::b(...)".
+			n = &templateName{name: &qualifiedName{scope: scope, name: t.name}, args: t.args}
+		} else {
+			n = &qualifiedName{scope: scope, name: name}
+		}
+	} else {
+		n = d.baseUnresolvedName()
+	}
+	if global {
+		n = &wrapped{prefix: "::", child: n}
+	}
+	return n
+}
+
+func (d *demangler) baseUnresolvedName() node {
+	if d.consume("on") {
+		n := d.operatorName()
+		if d.peek() == 'I' {
+			n = &templateName{name: n, args: d.templateArgs()}
+		}
+		return n
+	}
+	if d.consume("dn") {
+		if c := d.peek(); '0' <= c && c <= '9' {
+			return &wrapped{prefix: "~", child: d.sourceName()}
+		}
+		return &wrapped{prefix: "~", child: d.typ()}
+	}
+	n := d.unqualifiedName()
+	if d.peek() == 'I' {
+		n = &templateName{name: n, args: d.templateArgs()}
+	}
+	return n
+}
+
+// cloneSuffixes turns GCC's ".isra.0"-style suffixes into the
+// " [clone .isra.0]" that c++filt prints.
+func cloneSuffixes(rest string) (string, bool) {
+	out := ""
+	for len(rest) > 0 {
+		if rest[0] != '.' {
+			return "", false
+		}
+		i := 1
+		if i < len(rest) && (rest[i] == '_' || ('a' <= rest[i] && rest[i] <= 'z')) {
+			for i < len(rest) && (rest[i] == '_' || ('a' <= rest[i] && rest[i] <= 'z')) {
+				i++
+			}
+		} else if i >= len(rest) || rest[i] < '0' || rest[i] > '9' {
+			return "", false
+		}
+		for i+1 < len(rest) && rest[i] == '.' && '0' <= rest[i+1] && rest[i+1] <= '9' {
+			i++
+			for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+				i++
 			}
-			r.Write(name)
 		}
+		if i < len(rest) && rest[i] != '.' {
+			// Clones of clones, or a suffix starting with digits.
+			for i < len(rest) && '0' <= rest[i] && rest[i] <= '9' {
+				i++
+			}
+			if i < len(rest) && rest[i] != '.' {
+				return "", false
+			}
+		}
+		out += " [clone " + rest[:i] + "]"
+		rest = rest[i:]
 	}
+	return out, true
+}
 
-	if len(r.output) == 0 {
-		return fmt.Errorf("didn't produce any demangled text")
+// Parse trees.
+
+// printIn prints n with params as the template function's arguments.
+func printIn(params []node, n node) string {
+	p := &printer{scope: scope{params: params}}
+	p.print(n)
+	return p.buf.String()
+}
+
+// printEach prints n, or each element of it if it's a pack or the
+// expansion of one.
+func printEach(params []node, n node) []string {
+	var out []string
+	switch n := n.(type) {
+	case *argPack:
+		for _, elem := range n.elems {
+			out = append(out, printEach(params, elem)...)
+		}
+		return out
+	case *packExpansion:
+		if pack := findPack(params, n.child); pack != nil {
+			for i := range pack.elems {
+				p := &printer{scope: scope{params: params}, packIndex: i}
+				p.print(n.child)
+				out = append(out, p.buf.String())
+			}
+			return out
+		}
 	}
+	if s := printIn(params, n); len(s) > 0 {
+		out = append(out, s)
+	}
+	return out
+}
 
-	if r.stringReader.ofs < len(r.stringReader.input) {
-		r.leftover = r.stringReader.input[r.stringReader.ofs:]
+// nameParts breaks the name n into its parts.
+func nameParts(n node, params []node) []NamePart {
+	switch n := n.(type) {
+	case *qualifiedName:
+		return append(nameParts(n.scope, params), nameParts(n.name, params)...)
+	case *localName:
+		return append(nameParts(n.encoding, params), nameParts(n.entity, params)...)
+	case *templateName:
+		parts := nameParts(n.name, params)
+		last := &parts[len(parts)-1]
+		last.TemplateArgs = []string{}
+		for _, arg := range n.args.args {
+			last.TemplateArgs = append(last.TemplateArgs, printEach(params, arg)...)
+		}
+		return parts
+	case *abiTagged:
+		parts := nameParts(n.name, params)
+		parts[len(parts)-1].Name += "[abi:" + n.tag + "]"
+		return parts
+	case *functionEncoding:
+		if args := functionTemplateArgs(n.name); args != nil {
+			params = args.args
+		}
+		parts := nameParts(n.name, params)
+		last := &parts[len(parts)-1]
+		last.Function = true
+		last.Params = []string{}
+		for _, param := range n.params {
+			last.Params = append(last.Params, printEach(params, param)...)
+		}
+		last.Qualifiers = n.cv + n.ref
+		return parts
 	}
+	return []NamePart{{Name: printIn(params, n)}}
+}
 
-	return nil
+// treeOf breaks the encoding n into its parts.
+func treeOf(n node) *DemangledName {
+	t := &DemangledName{}
+	for {
+		switch sn := n.(type) {
+		case *specialName:
+			if len(sn.suffix) == 0 {
+				t.Special += sn.prefix
+				n = sn.child
+				continue
+			}
+		case *ctorVtable:
+			t.Special += "construction vtable for "
+			t.Parts = nameParts(sn.first, nil)
+			return t
+		case *postfixType:
+			// A data name with qualifiers.
+			n = sn.child
+			continue
+		}
+		break
+	}
+	if fn, ok := n.(*functionEncoding); ok && fn.ret != nil {
+		var params []node
+		if args := functionTemplateArgs(fn.name); args != nil {
+			params = args.args
+		}
+		t.Return = printIn(params, fn.ret)
+	}
+	t.Parts = nameParts(n, nil)
+	return t
 }
 
 type LinuxDemangler bool
+
 func NewLinuxDemangler(includeLeftover bool) *LinuxDemangler {
 	l := LinuxDemangler(includeLeftover)
 	return &l
 }
-func (d *LinuxDemangler) Demangle(name string) (string, error) {
-	mr := &mr{
-	stringReader: &stringReader{name, 0},
+
+// catchDemangleError recovers from a demangleError demangling name,
+// setting *err to it.
+func catchDemangleError(name string, err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(demangleError)
+		if !ok {
+			panic(r)
+		}
+		*err = fmt.Errorf("demangling '%s': %s", name, e)
 	}
-	err := mr.demangle(name)
-	if err != nil {
-		return "", fmt.Errorf("demangling '%s' near '%s': %s", name, mr.stringReader.input[mr.stringReader.ofs:], err)
+}
+
+// parse parses the mangled name, returning it and what follows it, as
+// c++filt prints that.  It panics with a demangleError on failure.
+func (d *LinuxDemangler) parse(name string) (n node, suffix string) {
+	if !strings.HasPrefix(name, "_Z") {
+		fail("not a mangled name")
+	}
+	p := &demangler{input: name, pos: 2}
+	n = p.encoding()
+	leftover := p.input[p.pos:]
+	if len(leftover) == 0 {
+		return n, ""
+	}
+	clones, ok := cloneSuffixes(leftover)
+	switch {
+	case ok:
+		return n, clones
+	case leftover[0] == '@':
+		// A symbol version, as in "foo@@GLIBC_2.2.5".
+		return n, leftover
+	case bool(*d):
+		return n, fmt.Sprintf(" (leftover %s)", leftover)
 	}
+	fail("unexpected '%s'", leftover)
+	return nil, ""
+}
 
-	out := mr.output
-	if bool(*d) && len(mr.leftover) > 0 {
-		out += fmt.Sprintf(" (leftover %s)", mr.leftover)
+func (d *LinuxDemangler) Demangle(name string) (out string, err error) {
+	if !strings.HasPrefix(name, "_Z") {
+		// Nothing to demangle.
+		return name, nil
 	}
-	return out, nil
+	defer catchDemangleError(name, &err)
+	n, suffix := d.parse(name)
+	return printNode(n) + suffix, nil
+}
+
+// DemangleTree demangles name, which must be mangled, into its parts.
+func (d *LinuxDemangler) DemangleTree(name string) (t *DemangledName, err error) {
+	defer catchDemangleError(name, &err)
+	n, suffix := d.parse(name)
+	full := printNode(n) + suffix
+	tree := treeOf(n)
+	tree.Full = full
+	return tree, nil
 }
@@ -12,82 +12,348 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// This file tests mangle_linux.go, and can be removed or renamed once
-// it's in better shape.
-
 package main
 
 import (
-	"fmt"
+	"debug/elf"
+	"flag"
+	"reflect"
 	"regexp"
-	"bufio"
-	"os"
-	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
 )
 
-func check(err error) {
-	if err != nil {
-		panic(err)
+// The tests below compare against c++filt when it's installed.  To
+// measure the demangler on a binary of your own, run
+//   go test -run ELF -elf /path/to/binary
+// and to look for divergences beyond it,
+//   go test -fuzz Demangle
+// which records each one it finds under testdata/fuzz/FuzzDemangle,
+// where it is rerun by every later go test.
+
+var flag_elf *string = flag.String("elf", "testdata/sample.o", "ELF file whose symbols seed the demangler tests (see testdata/sample.cc)")
+
+// Expected output is what c++filt prints, but for its stray separators
+// (see cppFiltArtifacts).
+var demangleTests = []struct{ in, out string }{
+	{"_ZN3net23TCPClientSocketLibevent14DoReadCallbackEi",
+		"net::TCPClientSocketLibevent::DoReadCallback(int)"},
+	{"_ZNK3gfx17PlatformFontPango10DeriveFontEii",
+		"gfx::PlatformFontPango::DeriveFont(int, int) const"},
+	{"_ZNSt8_Rb_treeISsSt4pairIKSsPN4base5ValueEESt10_Select1stIS5_ESt4lessISsESaIS5_EE16_M_insert_uniqueERKS5_",
+		"std::_Rb_tree<std::basic_string<char, std::char_traits<char>, std::allocator<char> >, std::pair<std::basic_string<char, std::char_traits<char>, std::allocator<char> > const, base::Value*>, std::_Select1st<std::pair<std::basic_string<char, std::char_traits<char>, std::allocator<char> > const, base::Value*> >, std::less<std::basic_string<char, std::char_traits<char>, std::allocator<char> > >, std::allocator<std::pair<std::basic_string<char, std::char_traits<char>, std::allocator<char> > const, base::Value*> > >::_M_insert_unique(std::pair<std::basic_string<char, std::char_traits<char>, std::allocator<char> > const, base::Value*> const&)"},
+	{"_Z11UTF16ToUTF8RKSbItN4base20string16_char_traitsESaItEE",
+		"UTF16ToUTF8(std::basic_string<unsigned short, base::string16_char_traits, std::allocator<unsigned short> > const&)"},
+	{"_ZN6sample6WidgetpLERKS0_",
+		"sample::Widget::operator+=(sample::Widget const&)"},
+	{"_ZNK6sample6WidgetcvbEv",
+		"sample::Widget::operator bool() const"},
+	{"_ZN6sample6WidgetD0Ev",
+		"sample::Widget::~Widget()"},
+	{"_ZTVN6sample6WidgetE",
+		"vtable for sample::Widget"},
+	{"_ZTIN6sample6WidgetE",
+		"typeinfo for sample::Widget"},
+	{"_ZThn8_N1C1fEv",
+		"non-virtual thunk to C::f()"},
+	{"_ZGVZ1fvE1x",
+		"guard variable for f()::x"},
+	{"_ZZN6sample5LocalEvEN7Counter4NextEv",
+		"sample::Local()::Counter::Next()"},
+	{"_ZN6sample12_GLOBAL__N_16HiddenEPKcz",
+		"sample::(anonymous namespace)::Hidden(char const*, ...)"},
+	{"_ZN6sample9CountArgsIJicdRA2_KcEEEmDpOT_",
+		"unsigned long sample::CountArgs<int, char, double, char const (&) [2]>(int&&, char&&, double&&, char const (&) [2])"},
+	{"_ZN6sample5TwiceIfEEDTplfp_fp_ET_",
+		"decltype ({parm#1}+{parm#1}) sample::Twice<float>(float)"},
+	{"_ZN6sample5ApplyIZNS_3UseEvEUliE_EEiT_i",
+		"int sample::Apply<sample::Use()::{lambda(int)#1}>(sample::Use()::{lambda(int)#1}, int)"},
+	{"_Z1fPFivEPA3_iM1AFvvEM1Ai",
+		"f(int (*)(), int (*) [3], void (A::*)(), int A::*)"},
+	{"_Z1fPVKi",
+		"f(int const volatile*)"},
+	{"_ZNSt6vectorIiSaIiEE9push_backEOi@GLIBCXX_3.4",
+		"std::vector<int, std::allocator<int> >::push_back(int&&)@GLIBCXX_3.4"},
+	{"_ZN4base6Widget3RunEv.cold",
+		"base::Widget::Run() [clone .cold]"},
+	{"_ZN4base6Widget3RunEv.isra.0",
+		"base::Widget::Run() [clone .isra.0]"},
+	{"_Z1fIJEiEvv",
+		"void f<, int>()"},
+	{"_Z1fIiLi42ELb1EEvv",
+		"void f<int, 42, true>()"},
+	{"_ZN1AcvT_IiEEv",
+		"A::operator int<int>()"},
+	{"_ZSt4moveIRiEONSt16remove_referenceIT_E4typeEOS2_",
+		"std::remove_reference<int&>::type&& std::move<int&>(int&)"},
+	{"_ZNKSt8functionIFviEEclEi",
+		"std::function<void (int)>::operator()(int) const"},
+	{"_ZZ1fiEd_NKUlvE_clEv",
+		"f(int)::{default arg#1}::{lambda()#1}::operator()() const"},
+	{"_Z1fIJidEEvDpRKT_",
+		"void f<int, double>(int const&, double const&)"},
+	{"_Z3fooILi2EEvRAplT_Li1E_i",
+		"void foo<2>(int (&) [(2)+(1)])"},
+	{"_ZNSt4pairIKNSt7__cxx1112basic_stringIcSt11char_traitsIcESaIcEEESt6vectorIN6sample6WidgetESaIS9_EEEC2IJOS5_EJLm0EEJEJEEERSt5tupleIJDpT_EERSF_IJDpT1_EESt12_Index_tupleIJXspT0_EEESO_IJXspT2_EEE",
+		"std::pair<std::__cxx11::basic_string<char, std::char_traits<char>, std::allocator<char> > const, std::vector<sample::Widget, std::allocator<sample::Widget> > >::pair<std::__cxx11::basic_string<char, std::char_traits<char>, std::allocator<char> >&&, 0ul>(std::tuple<std::__cxx11::basic_string<char, std::char_traits<char>, std::allocator<char> >&&>&, std::tuple<>&, std::_Index_tuple<0ul>, std::_Index_tuple<>)"},
+	{"_ZZ1fvENKUlT_E_clIiEEDaS_",
+		"auto f()::{lambda(auto:1)#1}::operator()<int>(int) const"},
+	{"_ZZ1fvENKUlPT_E_clIiEEDaS0_",
+		"auto f()::{lambda(auto:1*)#1}::operator()<int>(int*) const"},
+	{"_Z1fIiEDTcl1gtlT_EEES0_",
+		"decltype (g(int{})) f<int>(int)"},
+	{"_Z1fIiEDTcl1gilLi1ELi2EEEES0_",
+		"decltype (g({1, 2})) f<int>(decltype (g({1, 2})))"},
+	{"_ZGRL13AllS16Vectors_",
+		"reference temporary #0 for AllS16Vectors"},
+	{"_ZGRZ1fvE1x_",
+		"reference temporary #0 for f()::x"},
+	{"_ZZ1fvE1x__12_",
+		"f()::x"},
+	{"_Z1fIXadL_ZNK1A1gEvEEEvv",
+		"void f<&(A::g() const)>()"},
+	{"_Z1fIXadL_ZN1A1gEvEEEvv",
+		"void f<&A::g>()"},
+	{"_ZNK1A1fIXadL_ZN1B1gEvEEEEvv",
+		"void A::f<&B::g>() const"},
+}
+
+func TestDemangle(t *testing.T) {
+	d := NewLinuxDemangler(false)
+	for _, test := range demangleTests {
+		got, err := d.Demangle(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if got != test.out {
+			t.Errorf("%s:\n got %s\nwant %s", test.in, got, test.out)
+		}
 	}
 }
 
-func test() {
-	syms := []string{
-		"_ZN3net23TCPClientSocketLibevent14DoReadCallbackEi",
-		"_ZN14ProfileManager22DoFinalInitForServicesEP7Profileb",
-		"_ZNK3gfx17PlatformFontPango10DeriveFontEii",
-		"_ZN10extensions16SettingsFrontendC2ERK13scoped_refptrINS_22SettingsStorageFactoryEEP7Profile",
-		"_ZNSt8_Rb_treeISsSt4pairIKSsPN4base5ValueEESt10_Select1stIS5_ESt4lessISsESaIS5_EE16_M_insert_uniqueERKS5_",
-		"_Z11UTF16ToUTF8RKSbItN4base20string16_char_traitsESaItEE",
-	}
-	d := NewLinuxDemangler(true)
-	for _, sym := range syms {
-		fmt.Printf("%s\n", sym)
-		dem, err := d.Demangle(sym)
-		check(err)
-		fmt.Printf("=> %s\n", dem)
+func TestDemangleErrors(t *testing.T) {
+	d := NewLinuxDemangler(false)
+	for _, name := range []string{"_Z", "_ZN", "_ZNE", "_Z1", "_Z9f", "_Z1fS_", "_Z1fS999999999999999999_", "_Z1fT_", "_Z1fvjunk"} {
+		if got, err := d.Demangle(name); err == nil {
+			t.Errorf("%s: got %q, want an error", name, got)
+		}
+	}
+
+	// Names that aren't mangled pass through.
+	for _, name := range []string{"", "main", "runtime.mallocgc", "_start"} {
+		if got, err := d.Demangle(name); err != nil || got != name {
+			t.Errorf("%q: got %q, %v", name, got, err)
+		}
 	}
+
+	if got, _ := NewLinuxDemangler(true).Demangle("_Z1fvEjunk"); got != "f() (leftover Ejunk)" {
+		t.Errorf("with leftover: got %q", got)
+	}
+}
+
+var (
+	cppFiltOnce sync.Once
+	sharedCppFilt *CppFilt
+)
+
+// startCppFilt returns the shared c++filt, or nil if there isn't one.
+func startCppFilt() *CppFilt {
+	cppFiltOnce.Do(func() {
+		if cf, err := NewCppFilt(1); err == nil {
+			sharedCppFilt = cf
+		}
+	})
+	return sharedCppFilt
 }
 
-func output(buf []byte) {
-	_, err := os.Stdout.Write(buf)
+// cppFiltOutput returns what c++filt prints for name, which is name
+// itself if it can't demangle it.
+func cppFiltOutput(cf *CppFilt, name string) string {
+	if out, err := cf.Demangle(name); err == nil {
+		return out
+	}
+	return name
+}
+
+// canFilt reports whether c++filt sees name as a single symbol; it
+// splits its input at anything that can't be part of one.
+func canFilt(name string) bool {
+	if !strings.HasPrefix(name, "_Z") {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '.' || c == '$') {
+			return false
+		}
+	}
+	return true
+}
+
+// cppFiltArtifacts matches the separators c++filt leaves before empty
+// packs when its output buffer happens to fill up in between, as in
+// "f<int, >()".
+var cppFiltArtifacts = regexp.MustCompile(`, ([>)])`)
+
+// sameAsCppFilt reports whether got is what c++filt printed as want.
+func sameAsCppFilt(got, want string) bool {
+	return got == want || got == cppFiltArtifacts.ReplaceAllString(want, "$1")
+}
+
+// elfSymbols returns the sorted mangled C++ names defined or used in
+// the ELF file at path.
+func elfSymbols(tb testing.TB, path string) []string {
+	f, err := elf.Open(path)
 	if err != nil {
-		panic(err)
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	syms, _ := f.Symbols()
+	dyn, _ := f.DynamicSymbols()
+	seen := make(map[string]bool)
+	var names []string
+	for _, sym := range append(syms, dyn...) {
+		if strings.HasPrefix(sym.Name, "_Z") && !seen[sym.Name] {
+			seen[sym.Name] = true
+			names = append(names, sym.Name)
+		}
 	}
+	sort.Strings(names)
+	return names
 }
 
-func filt() {
+func TestDemangleELF(t *testing.T) {
+	cf := startCppFilt()
+	if cf == nil {
+		t.Skip("no c++filt to compare with")
+	}
 	d := NewLinuxDemangler(false)
-	re := regexp.MustCompile(`_Z[_a-zA-Z0-9]+`)
-	r := bufio.NewReader(os.Stdin)
-	for {
-		line, isPrefix, err := r.ReadLine()
-		if isPrefix {
-			panic("overlong line")
+	names := elfSymbols(t, *flag_elf)
+	same := 0
+	for _, name := range names {
+		want := cppFiltOutput(cf, name)
+		got, err := d.Demangle(name)
+		if err != nil {
+			got = name // As c++filt prints it.
 		}
-		if err == io.EOF {
-			break
+		if !sameAsCppFilt(got, want) {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+			continue
 		}
+		same++
+	}
+	t.Logf("%d of %d symbols in %s demangle as c++filt does", same, len(names), *flag_elf)
+}
+
+// FuzzDemangle checks that the demangler doesn't panic, that it can
+// break up whatever it demangles, and that it agrees with c++filt whenever both of them can demangle a name.
+// c++filt accepts a lot of malformed names that we reject, so those
+// aren't counted as divergences.
+func FuzzDemangle(f *testing.F) {
+	for _, test := range demangleTests {
+		f.Add(test.in)
+	}
+	for _, name := range elfSymbols(f, *flag_elf) {
+		f.Add(name)
+	}
+	d := NewLinuxDemangler(false)
+	f.Fuzz(func(t *testing.T, name string) {
+		got, err := d.Demangle(name)
 		if err != nil {
-			panic(err)
-		}
-		offsets := re.FindAllIndex(line, -1)
-		if offsets != nil {
-			last := 0
-			for _, match := range offsets {
-				start, end := match[0], match[1]
-				output(line[last:start])
-				dem, err := d.Demangle(string(line[start:end]))
-				check(err)
-				output([]byte(dem))
-				last = end
+			return
+		}
+		if strings.HasPrefix(name, "_Z") {
+			if _, err := d.DemangleTree(name); err != nil {
+				t.Errorf("%s: demangles but has no tree: %s", name, err)
 			}
-			output(line[last:])
-			output([]byte("\n"))
 		}
+		cf := startCppFilt()
+		if cf == nil || !canFilt(name) {
+			return
+		}
+		want := cppFiltOutput(cf, name)
+		if want != name && !sameAsCppFilt(got, want) {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+		}
+	})
+}
+
+func TestDemangleTree(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		special string
+		ret     string
+		parts   []NamePart
+	}{
+		{"_ZNK3gfx17PlatformFontPango10DeriveFontEii", "", "", []NamePart{
+			{Name: "gfx"},
+			{Name: "PlatformFontPango"},
+			{Name: "DeriveFont", Function: true, Params: []string{"int", "int"}, Qualifiers: " const"}}},
+		{"_ZNSs4sizeEv", "", "", []NamePart{
+			{Name: "std"},
+			{Name: "basic_string", TemplateArgs: []string{"char", "std::char_traits<char>", "std::allocator<char>"}},
+			{Name: "size", Function: true, Params: []string{}}}},
+		{"_ZN6sample9CountArgsIJicdRA2_KcEEEmDpOT_", "", "unsigned long", []NamePart{
+			{Name: "sample"},
+			{Name: "CountArgs", TemplateArgs: []string{"int", "char", "double", "char const (&) [2]"},
+				Function: true, Params: []string{"int&&", "char&&", "double&&", "char const (&) [2]"}}}},
+		{"_ZZZN6sample5LocalEvEN7Counter4NextEvE1n", "", "", []NamePart{
+			{Name: "sample"},
+			{Name: "Local", Function: true, Params: []string{}},
+			{Name: "Counter"},
+			{Name: "Next", Function: true, Params: []string{}},
+			{Name: "n"}}},
+		{"_ZN6sample12_GLOBAL__N_16HiddenEPKcz", "", "", []NamePart{
+			{Name: "sample"},
+			{Name: "(anonymous namespace)"},
+			{Name: "Hidden", Function: true, Params: []string{"char const*", "..."}}}},
+		{"_ZTVN6sample6WidgetE", "vtable for ", "", []NamePart{{Name: "sample"}, {Name: "Widget"}}},
+		{"_ZGVZ1fvE1x", "guard variable for ", "", []NamePart{{Name: "f", Function: true, Params: []string{}}, {Name: "x"}}},
+		{"_ZN1AB5cxx113getEv", "", "", []NamePart{{Name: "A[abi:cxx11]"}, {Name: "get", Function: true, Params: []string{}}}},
+		{"_Z1fIJEiEvv", "", "void", []NamePart{{Name: "f", TemplateArgs: []string{"int"}, Function: true, Params: []string{}}}},
+		{"_ZN4base6Widget3RunEv.cold", "", "", []NamePart{{Name: "base"}, {Name: "Widget"}, {Name: "Run", Function: true, Params: []string{}}}},
+	} {
+		got, err := NewLinuxDemangler(false).DemangleTree(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if got.Special != test.special || got.Return != test.ret || !reflect.DeepEqual(got.Parts, test.parts) {
+			t.Errorf("%s:\n got %q %q %+v\nwant %q %q %+v", test.in, got.Special, got.Return, got.Parts, test.special, test.ret, test.parts)
+		}
+	}
+	if _, err := NewLinuxDemangler(false).DemangleTree("main"); err == nil {
+		t.Errorf("main: want an error")
 	}
 }
 
-func main() {
-	test()
+// TestDemangleTreeFull checks that a name's parts print as the whole name,
+// but for libiberty's stray commas around empty packs.
+func TestDemangleTreeFull(t *testing.T) {
+	d := NewLinuxDemangler(false)
+	names := elfSymbols(t, *flag_elf)
+	for _, test := range demangleTests {
+		names = append(names, test.in)
+	}
+	for _, name := range names {
+		tree, err := d.DemangleTree(name)
+		if err != nil {
+			continue
+		}
+		if want, _ := d.Demangle(name); tree.Full != want {
+			t.Errorf("%s:\n tree %s\n  got %s", name, tree.Full, want)
+		}
+		if strings.Contains(tree.Full, "<, ") || strings.Contains(tree.Full, ", >") || strings.Contains(tree.Full, ", , ") {
+			continue
+		}
+		got := tree.Special + formatParts(tree.Parts, simplifyFull)
+		if len(tree.Return) > 0 {
+			got = tree.Return + " " + got
+		}
+		if !strings.HasPrefix(tree.Full, got) {
+			t.Errorf("%s:\nparts %s\n full %s", name, got, tree.Full)
+		}
+	}
 }
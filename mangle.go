@@ -16,42 +16,387 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os/exec"
+	"strings"
 )
 
+// A Demangler turns a mangled symbol into something readable.
+// Demanglers are safe for concurrent use.
 type Demangler interface {
 	Demangle(name string) (string, error)
 }
 
+// A TreeDemangler can also break the names it demangles into their
+// parts, so they can be shortened and grouped without re-parsing.
+type TreeDemangler interface {
+	DemangleTree(name string) (*DemangledName, error)
+}
+
+// A BatchDemangler can demangle many names faster together than one at
+// a time.  Each name fails or succeeds on its own.
+type BatchDemangler interface {
+	DemangleBatch(names []string) ([]string, []error)
+}
+
+// demangleBatch demangles names with d, as one batch if d can.
+func demangleBatch(d Demangler, names []string) ([]string, []error) {
+	if bd, ok := d.(BatchDemangler); ok {
+		return bd.DemangleBatch(names)
+	}
+	outs := make([]string, len(names))
+	errs := make([]error, len(names))
+	for i, name := range names {
+		outs[i], errs[i] = d.Demangle(name)
+	}
+	return outs, errs
+}
+
+// A NamePart is a component of a qualified name, like "vector<int>" in
+// "std::vector<int>::push_back(int&&)".
+type NamePart struct {
+	Name string
+	// Nil unless the part is a template instance.
+	TemplateArgs []string
+	// Whether the part is a function, like the last part of a function's
+	// name or the function a local name is in, and its parameter types
+	// and qualifiers, as in " const &&".
+	Function   bool
+	Params     []string
+	Qualifiers string
+}
+
+// A DemangledName is a demangled name broken into its parts.
+type DemangledName struct {
+	// The qualified name, outermost scope first.
+	Parts []NamePart
+	// The return type of a function template.
+	Return string
+	// What Parts names is the subject of, as in "vtable for ".
+	Special string
+	// The whole name, as Demangle returns it.
+	Full string
+}
+
+// Scope returns the parts enclosing what n names: its class or
+// namespace, or for special names like vtables, what they're for.
+func (n *DemangledName) Scope() []NamePart {
+	if len(n.Special) > 0 {
+		return n.Parts
+	}
+	return n.Parts[:len(n.Parts)-1]
+}
+
+// formatParts prints a qualified name with as much detail as level.
+func formatParts(parts []NamePart, level simplifyLevel) string {
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteString("::")
+		}
+		b.WriteString(part.Name)
+		if part.TemplateArgs != nil && level < simplifyNoTemplates {
+			if strings.HasSuffix(part.Name, "<") {
+				b.WriteString(" ") // As in "operator<< <char>".
+			}
+			b.WriteString("<" + strings.Join(part.TemplateArgs, ", "))
+			if b.String()[b.Len()-1] == '>' {
+				b.WriteString(" ")
+			}
+			b.WriteString(">")
+		}
+		if part.Function && level < simplifyNoParams {
+			b.WriteString("(" + strings.Join(part.Params, ", ") + ")" + part.Qualifiers)
+		}
+	}
+	return b.String()
+}
+
+// Format prints n with as much detail as level.
+func (n *DemangledName) Format(level simplifyLevel) string {
+	if level == simplifyFull {
+		return n.Full
+	}
+	return n.Special + formatParts(n.Parts, level)
+}
+
+// Simplify prints n with as much detail as level, rewritten with rules.
+func (n *DemangledName) Simplify(level simplifyLevel, rules []rewriteRule) string {
+	if level == simplifyFull {
+		return Rewrite(n.Full, rules)
+	}
+	return n.Special + simplifyParts(n.Parts, level, rules)
+}
+
+// simplifyParts prints a qualified name with as much detail as level,
+// rewritten with rules.  The rules see the template arguments even where
+// level leaves them out, so that those like the one making
+// "std::basic_string<char, ...>" "std::string" take effect.
+func simplifyParts(parts []NamePart, level simplifyLevel, rules []rewriteRule) string {
+	if level == simplifyFull {
+		return Rewrite(formatParts(parts, level), rules)
+	}
+	withTemplates := formatParts(parts, simplifyNoParams)
+	name := Rewrite(withTemplates, rules)
+	if level == simplifyNoParams {
+		return name
+	}
+	if name == withTemplates {
+		return formatParts(parts, level)
+	}
+	// The rules changed the name, so the parts no longer describe it.
+	return removeTemplates(name)
+}
+
+// A manglingScheme is a way compilers encode names into symbols.
+type manglingScheme int
+
+const (
+	schemeNone manglingScheme = iota
+	// The Itanium C++ ABI's, used by C++ compilers everywhere but
+	// Windows.
+	schemeItanium
+	// rustc's legacy and v0 schemes.
+	schemeRust
+	// Swift's, which hp has no demangler for.
+	schemeSwift
+	// D's, which hp has no demangler for either.
+	schemeD
+	// Microsoft Visual C++'s.
+	schemeMSVC
+)
+
+var schemeNames = []string{"none", "itanium", "rust", "swift", "d", "msvc"}
+
+func (s manglingScheme) String() string {
+	return schemeNames[s]
+}
+
+// mangledBy says which scheme name was mangled with, going by its
+// prefix.  Rust's legacy names would pass for C++ but for their hash,
+// so they're checked for first.
+func mangledBy(name string) manglingScheme {
+	switch {
+	case isRustSymbol(name):
+		return schemeRust
+	case strings.HasPrefix(name, "_Z"):
+		return schemeItanium
+	case strings.HasPrefix(name, "$s"), strings.HasPrefix(name, "$S"),
+		strings.HasPrefix(name, "$e"), strings.HasPrefix(name, "_T0"):
+		return schemeSwift
+	case len(name) > 2 && strings.HasPrefix(name, "_D") && '1' <= name[2] && name[2] <= '9':
+		// A qualified name, which starts with the length of its
+		// first part.
+		return schemeD
+	case strings.HasPrefix(name, "?"):
+		return schemeMSVC
+	}
+	return schemeNone
+}
+
+// SchemeDemangler hands each name to the demangler for the scheme it
+// was mangled with, so a binary mixing languages gets readable names
+// throughout.  Names that no demangler takes, or that the demangler for
+// their scheme fails on, come back as they are.
+type SchemeDemangler map[manglingScheme]Demangler
+
+// NewDemangler returns a SchemeDemangler with every demangler hp has.
+func NewDemangler() SchemeDemangler {
+	return SchemeDemangler{
+		schemeItanium: NewLinuxDemangler(false),
+		schemeRust:    NewRustDemangler(),
+		schemeMSVC:    NewMSVCDemangler(),
+	}
+}
+
+func (d SchemeDemangler) DemangleTree(name string) (*DemangledName, error) {
+	scheme := mangledBy(name)
+	backend, ok := d[scheme].(TreeDemangler)
+	if !ok {
+		return nil, fmt.Errorf("no parse trees for %s names", scheme)
+	}
+	return backend.DemangleTree(name)
+}
+
+func (d SchemeDemangler) Demangle(name string) (string, error) {
+	backend := d[mangledBy(name)]
+	if backend == nil {
+		return name, nil
+	}
+	out, err := backend.Demangle(name)
+	if err != nil {
+		return name, nil
+	}
+	return out, nil
+}
+
+// DemangleBatch hands each scheme's names to its demangler as a batch.
+func (d SchemeDemangler) DemangleBatch(names []string) ([]string, []error) {
+	outs := append([]string{}, names...)
+	errs := make([]error, len(names))
+	byScheme := make(map[manglingScheme][]int)
+	for i, name := range names {
+		scheme := mangledBy(name)
+		byScheme[scheme] = append(byScheme[scheme], i)
+	}
+	for scheme, indexes := range byScheme {
+		backend := d[scheme]
+		if backend == nil {
+			continue
+		}
+		batch := make([]string, len(indexes))
+		for j, i := range indexes {
+			batch[j] = names[i]
+		}
+		batchOuts, batchErrs := demangleBatch(backend, batch)
+		for j, i := range indexes {
+			if batchErrs[j] == nil {
+				outs[i] = batchOuts[j]
+			}
+		}
+	}
+	return outs, errs
+}
+
+// FallbackDemangler tries each of its demanglers in turn, returning the
+// first demangling that succeeds.
+type FallbackDemangler []Demangler
+
+func (d FallbackDemangler) Demangle(name string) (out string, err error) {
+	for _, backend := range d {
+		if out, err = backend.Demangle(name); err == nil {
+			return out, nil
+		}
+	}
+	return "", err
+}
+
+// DemangleBatch passes each demangler the names the ones before it
+// failed on, as a batch.
+func (d FallbackDemangler) DemangleBatch(names []string) ([]string, []error) {
+	outs := make([]string, len(names))
+	errs := make([]error, len(names))
+	todo := make([]int, len(names))
+	for i := range names {
+		todo[i] = i
+		errs[i] = fmt.Errorf("no demangler for %s", names[i])
+	}
+	for _, backend := range d {
+		if len(todo) == 0 {
+			break
+		}
+		batch := make([]string, len(todo))
+		for j, i := range todo {
+			batch[j] = names[i]
+		}
+		batchOuts, batchErrs := demangleBatch(backend, batch)
+		var failed []int
+		for j, i := range todo {
+			outs[i], errs[i] = batchOuts[j], batchErrs[j]
+			if errs[i] != nil {
+				failed = append(failed, i)
+			}
+		}
+		todo = failed
+	}
+	return outs, errs
+}
+
+func (d FallbackDemangler) DemangleTree(name string) (t *DemangledName, err error) {
+	err = fmt.Errorf("no parse tree for %s", name)
+	for _, backend := range d {
+		if td, ok := backend.(TreeDemangler); ok {
+			if t, err = td.DemangleTree(name); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// CppFilt demangles by way of a pool of running c++filts, each taking
+// a batch of names at a time.
 type CppFilt struct {
+	// The processes not busy with a batch.
+	free chan *cppFiltProc
+}
+
+type cppFiltProc struct {
 	in  io.Writer
 	out *bufio.Reader
 }
 
-func NewCppFilt() Demangler {
-	cmd := exec.Command("c++filt")
-	in, err := cmd.StdinPipe()
-	check(err)
-	out, err := cmd.StdoutPipe()
-	check(err)
-	cf := &CppFilt{
-		in:  in,
-		out: bufio.NewReader(out),
+// NewCppFilt starts n c++filts, failing if it isn't installed.
+func NewCppFilt(n int) (*CppFilt, error) {
+	cf := &CppFilt{free: make(chan *cppFiltProc, n)}
+	for i := 0; i < n; i++ {
+		cmd := exec.Command("c++filt")
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		cf.free <- &cppFiltProc{in: in, out: bufio.NewReader(out)}
 	}
-	err = cmd.Start()
-	check(err)
-	return cf
+	return cf, nil
 }
 
+// Demangle fails on names c++filt gives back as they are.
 func (cf *CppFilt) Demangle(name string) (string, error) {
-	_, err := io.WriteString(cf.in, name+"\n")
-	if err != nil {
-		return "", err
+	outs, errs := cf.DemangleBatch([]string{name})
+	return outs[0], errs[0]
+}
+
+// DemangleBatch pipes names through one of the c++filts.
+func (cf *CppFilt) DemangleBatch(names []string) ([]string, []error) {
+	outs := make([]string, len(names))
+	errs := make([]error, len(names))
+	// c++filt reads a name per line.
+	var todo []int
+	for i, name := range names {
+		if strings.ContainsAny(name, "\n") {
+			errs[i] = fmt.Errorf("c++filt can't demangle %q", name)
+		} else {
+			todo = append(todo, i)
+		}
 	}
-	res, err := mustReadLine(cf.out)
-	if err != nil {
-		return "", err
+
+	p := <-cf.free
+	defer func() { cf.free <- p }()
+	// Write while reading, so that neither waits on the other's full
+	// pipe.
+	written := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(p.in)
+		for _, i := range todo {
+			w.WriteString(names[i] + "\n")
+		}
+		written <- w.Flush()
+	}()
+	for j, i := range todo {
+		// Not mustReadLine: demangled names can outgrow the reader's
+		// buffer.
+		res, err := p.out.ReadString('\n')
+		if err != nil {
+			for _, i := range todo[j:] {
+				errs[i] = err
+			}
+			break
+		}
+		res = strings.TrimSuffix(res, "\n")
+		if res == names[i] {
+			errs[i] = fmt.Errorf("c++filt can't demangle %q", names[i])
+			continue
+		}
+		outs[i] = res
 	}
-	return string(res), nil
+	<-written
+	return outs, errs
 }
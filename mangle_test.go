@@ -0,0 +1,202 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMangledBy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		scheme manglingScheme
+	}{
+		{"_ZN3foo3barEv", schemeItanium},
+		{"_ZN3foo3barE", schemeItanium},
+		{"_ZN3std2rt10lang_start17h0123456789abcdefE", schemeRust},
+		{"_ZN3std2rt10lang_start17h0123456789abcdefE.llvm.1234ABCD", schemeRust},
+		// Not rustc's hash, which is 16 lowercase hex digits.
+		{"_ZN3foo17h0123456789abcdeE", schemeItanium},
+		{"_RNvCs1234_7mycrate3foo", schemeRust},
+		{"$s4main3FooVMn", schemeSwift},
+		{"_T0s5print_9separator10terminatoryypd_S2StF", schemeSwift},
+		{"_D4test3fooFZv", schemeD},
+		{"_Dmain", schemeNone},
+		{"?f@@YAXXZ", schemeMSVC},
+		{"main", schemeNone},
+		{"_start", schemeNone},
+		{"", schemeNone},
+	} {
+		if got := mangledBy(test.name); got != test.scheme {
+			t.Errorf("%q: got %v, want %v", test.name, got, test.scheme)
+		}
+	}
+}
+
+func TestSchemeDemangler(t *testing.T) {
+	d := NewDemangler()
+	for _, test := range []struct{ in, out string }{
+		{"_ZN3foo3barEv", "foo::bar()"},
+		{"_ZN3foo3barE", "foo::bar"},
+		{"_ZN3foo17h0123456789abcdefEv", "foo::h0123456789abcdef()"},
+		{"_ZN3std2rt10lang_start17h0123456789abcdefE", "std::rt::lang_start"},
+		{"_RNvCs1234_7mycrate3foo", "mycrate::foo"},
+		{"?Foo@Bar@@QEAAXH@Z", "public: void __cdecl Bar::Foo(int)"},
+		// Names no demangler takes, or that fail to demangle, are
+		// shown as they are.
+		{"$s4main3FooVMn", "$s4main3FooVMn"},
+		{"_D4test3fooFZv", "_D4test3fooFZv"},
+		{"_Z1fvjunk", "_Z1fvjunk"},
+		{"_RNvC1a1bjunk", "_RNvC1a1bjunk"},
+		{"?f@@YAXH", "?f@@YAXH"},
+		{"main", "main"},
+	} {
+		got, err := d.Demangle(test.in)
+		if err != nil || got != test.out {
+			t.Errorf("%s: got %q, %v; want %q", test.in, got, err, test.out)
+		}
+	}
+}
+
+// mapDemangler demangles only the names it has.
+type mapDemangler map[string]string
+
+func (d mapDemangler) Demangle(name string) (string, error) {
+	if out, ok := d[name]; ok {
+		return out, nil
+	}
+	return "", fmt.Errorf("can't demangle %s", name)
+}
+
+func TestFallbackDemangler(t *testing.T) {
+	d := FallbackDemangler{NewLinuxDemangler(false), mapDemangler{"_Z1fvjunk": "fallback"}}
+	for _, test := range []struct{ in, out string }{
+		{"_Z1fv", "f()"},
+		{"_Z1fvjunk", "fallback"},
+	} {
+		if got, err := d.Demangle(test.in); err != nil || got != test.out {
+			t.Errorf("%s: got %q, %v; want %q", test.in, got, err, test.out)
+		}
+	}
+	if got, err := d.Demangle("_Z1gvjunk"); err == nil {
+		t.Errorf("got %q, want an error", got)
+	}
+	// Trees come from the demanglers that have them.
+	if _, err := d.DemangleTree("_Z1fv"); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.DemangleTree("_Z1fvjunk"); err == nil {
+		t.Errorf("want an error for a tree from the fallback")
+	}
+}
+
+func TestCppFilt(t *testing.T) {
+	cf, err := NewCppFilt(2)
+	if err != nil {
+		t.Skip("no c++filt:", err)
+	}
+	if got, err := cf.Demangle("_ZN3foo3barEv"); err != nil || got != "foo::bar()" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	for _, name := range []string{"main", "_Z1fvjunk", "two\nlines"} {
+		if got, err := cf.Demangle(name); err == nil {
+			t.Errorf("%q: got %q, want an error", name, got)
+		}
+	}
+
+	// Batches big enough to fill the pipes, from more goroutines than
+	// there are c++filts.
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = fmt.Sprintf("_Z3f%02dv", i%100)
+		if i%7 == 0 {
+			names[i] = "main"
+		}
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outs, errs := cf.DemangleBatch(names)
+			for i, name := range names {
+				want := fmt.Sprintf("f%02d()", i%100)
+				if name == "main" {
+					if errs[i] == nil {
+						t.Errorf("%s: got %q, want an error", name, outs[i])
+					}
+				} else if errs[i] != nil || outs[i] != want {
+					t.Errorf("%s: got %q, %v; want %q", name, outs[i], errs[i], want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSchemeDemanglerBatch(t *testing.T) {
+	d := NewDemangler()
+	d[schemeItanium] = FallbackDemangler{d[schemeItanium], mapDemangler{"_Z1fvjunk": "fallback"}}
+	names := []string{"_Z1fv", "main", "_RNvCs1234_7mycrate3foo", "_Z1fvjunk", "_Z1gvjunk"}
+	outs, errs := d.DemangleBatch(names)
+	for i, want := range []string{"f()", "main", "mycrate::foo", "fallback", "_Z1gvjunk"} {
+		if errs[i] != nil || outs[i] != want {
+			t.Errorf("%s: got %q, %v; want %q", names[i], outs[i], errs[i], want)
+		}
+	}
+}
+
+func TestDemangledNameFormat(t *testing.T) {
+	d := NewDemangler()
+	for _, test := range []struct {
+		in                    string
+		noparams, notemplates string
+		scope                 string
+	}{
+		{"_ZNSt6vectorIiSaIiEE9push_backEOi", "std::vector<int, std::allocator<int> >::push_back", "std::vector::push_back", "std::vector"},
+		{"_ZStlsISt11char_traitsIcEERSt13basic_ostreamIcT_ES5_PKc",
+			"std::operator<< <std::char_traits<char> >", "std::operator<<", "std"},
+		{"_ZZ1fiENKUlvE_clEv", "f::{lambda()#1}::operator()", "f::{lambda()#1}::operator()", "f::{lambda()#1}"},
+		{"_ZTVN6sample6WidgetE", "vtable for sample::Widget", "vtable for sample::Widget", "sample::Widget"},
+		{"_Z4mainv", "main", "main", ""},
+	} {
+		tree, err := d.DemangleTree(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if got, _ := d.Demangle(test.in); tree.Format(simplifyFull) != got {
+			t.Errorf("%s: full %q, want %q", test.in, tree.Format(simplifyFull), got)
+		}
+		if got := tree.Format(simplifyNoParams); got != test.noparams {
+			t.Errorf("%s: noparams %q, want %q", test.in, got, test.noparams)
+		}
+		if got := tree.Format(simplifyNoTemplates); got != test.notemplates {
+			t.Errorf("%s: notemplates %q, want %q", test.in, got, test.notemplates)
+		}
+		if got := formatParts(tree.Scope(), simplifyNoTemplates); got != test.scope {
+			t.Errorf("%s: scope %q, want %q", test.in, got, test.scope)
+		}
+	}
+
+	// Only the Itanium demangler gives trees so far.
+	for _, name := range []string{"_RNvCs1234_7mycrate3foo", "?f@@YAXXZ", "main", "_Z1fvjunk"} {
+		if tree, err := d.DemangleTree(name); err == nil {
+			t.Errorf("%s: got %+v, want an error", name, tree)
+		}
+	}
+}
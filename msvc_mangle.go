@@ -0,0 +1,2051 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements the name mangling of Microsoft Visual C++, as in
+//   ?Foo@Bar@@QEAAXH@Z   public: void __cdecl Bar::Foo(int)
+// Microsoft doesn't document it; this follows LLVM's MicrosoftDemangle,
+// and names are printed the way llvm-undname prints them.  Names are
+// written innermost scope first, each ended by '@', with a further '@'
+// ending the list.  The first ten names and the first ten function
+// parameter types longer than a letter can be referred back to by a
+// digit.
+
+// Demangled names longer than this are taken to be malicious: back
+// references can double a name's size with each template nested in it.
+const msvcMaxOutput = 1000000
+
+type MSVCDemangler struct{}
+
+func NewMSVCDemangler() *MSVCDemangler {
+	return &MSVCDemangler{}
+}
+
+func (m *MSVCDemangler) Demangle(name string) (string, error) {
+	if !strings.HasPrefix(name, "?") && !strings.HasPrefix(name, ".") {
+		// Nothing to demangle.
+		return name, nil
+	}
+	out, err := demangleMSVC(name)
+	if err != nil {
+		return "", fmt.Errorf("demangling '%s': %s", name, err)
+	}
+	return out, nil
+}
+
+// demangleMSVC demangles a whole mangled name.  Like llvm-undname, it
+// ignores anything following the name.
+func demangleMSVC(name string) (out string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(demangleError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	d := &msDemangler{input: name}
+	sym := d.parse()
+	p := &msPrinter{}
+	sym.print(p, 0)
+	return p.String(), nil
+}
+
+// Printing.
+
+type msPrinter struct {
+	strings.Builder
+}
+
+func (p *msPrinter) s(str string) {
+	p.WriteString(str)
+	if p.Len() > msvcMaxOutput {
+		fail("demangled name too long")
+	}
+}
+
+func (p *msPrinter) last() byte {
+	str := p.String()
+	if len(str) == 0 {
+		return 0
+	}
+	return str[len(str)-1]
+}
+
+// space separates what follows from a preceding word.
+func (p *msPrinter) space() {
+	c := p.last()
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '>' {
+		p.s(" ")
+	}
+}
+
+// Flags for printing.
+const (
+	// Leave out calling conventions, as inside a function pointer,
+	// where it goes inside the parentheses.
+	msNoCallingConvention = 1 << iota
+)
+
+type msQuals uint8
+
+const (
+	msConst msQuals = 1 << iota
+	msVolatile
+	msRestrict
+	msUnaligned
+	msPointer64
+)
+
+// printQuals prints the cv-qualifiers and __restrict in q.
+func printQuals(p *msPrinter, q msQuals, spaceBefore, spaceAfter bool) {
+	printed := false
+	for _, qual := range []struct {
+		mask msQuals
+		name string
+	}{{msConst, "const"}, {msVolatile, "volatile"}, {msRestrict, "__restrict"}} {
+		if q&qual.mask == 0 {
+			continue
+		}
+		if spaceBefore {
+			p.s(" ")
+		}
+		p.s(qual.name)
+		spaceBefore = true
+		printed = true
+	}
+	if spaceAfter && printed {
+		p.s(" ")
+	}
+}
+
+// A msNode is a parsed component of a mangled name.
+type msNode interface {
+	print(p *msPrinter, flags int)
+}
+
+func printMSList(p *msPrinter, nodes []msNode, flags int, sep string) {
+	for i, n := range nodes {
+		if i > 0 {
+			p.s(sep)
+		}
+		n.print(p, flags)
+	}
+}
+
+// Types.
+
+// A msType prints in two halves, so that declarators like function
+// pointers wrap around what's inside them: "void (__cdecl *" + inner +
+// ")(int)".
+type msType interface {
+	msNode
+	printLeft(p *msPrinter, flags int)
+	printRight(p *msPrinter, flags int)
+	quals() *msQuals
+}
+
+type msTypeQuals struct {
+	q msQuals
+}
+
+func (t *msTypeQuals) quals() *msQuals { return &t.q }
+
+type msPrimitive struct {
+	msTypeQuals
+	name string
+}
+
+func (t *msPrimitive) printLeft(p *msPrinter, flags int) {
+	p.s(t.name)
+	printQuals(p, t.q, true, false)
+}
+
+func (t *msPrimitive) printRight(p *msPrinter, flags int) {}
+func (t *msPrimitive) print(p *msPrinter, flags int)      { printMSType(p, t, flags) }
+
+// msTag is a class, struct, union or enum.
+type msTag struct {
+	msTypeQuals
+	tag  string
+	name *msQualifiedName
+}
+
+func (t *msTag) printLeft(p *msPrinter, flags int) {
+	p.s(t.tag + " ")
+	t.name.print(p, flags)
+	printQuals(p, t.q, true, false)
+}
+
+func (t *msTag) printRight(p *msPrinter, flags int) {}
+func (t *msTag) print(p *msPrinter, flags int)      { printMSType(p, t, flags) }
+
+// msCustom is a type named by an identifier, as "?" + name.
+type msCustom struct {
+	msTypeQuals
+	ident msIdent
+}
+
+func (t *msCustom) printLeft(p *msPrinter, flags int)  { t.ident.print(p, flags) }
+func (t *msCustom) printRight(p *msPrinter, flags int) {}
+func (t *msCustom) print(p *msPrinter, flags int)      { printMSType(p, t, flags) }
+
+const (
+	msPointer = iota
+	msReference
+	msRValueReference
+)
+
+// msPointerType is a pointer, a reference or, with a class, a pointer
+// to member.
+type msPointerType struct {
+	msTypeQuals
+	affinity int
+	class    *msQualifiedName
+	pointee  msType
+}
+
+func (t *msPointerType) printLeft(p *msPrinter, flags int) {
+	sig, isFunc := t.pointee.(*msFuncSig)
+	_, isArray := t.pointee.(*msArrayType)
+	if isFunc {
+		sig.printLeft(p, msNoCallingConvention)
+	} else {
+		t.pointee.printLeft(p, flags)
+	}
+	p.space()
+	if t.q&msUnaligned != 0 {
+		p.s("__unaligned ")
+	}
+	if isArray {
+		p.s("(")
+	} else if isFunc {
+		p.s("(")
+		printCallingConvention(p, sig.cc)
+		p.s(" ")
+	}
+	if t.class != nil {
+		t.class.print(p, flags)
+		p.s("::")
+	}
+	p.s([]string{"*", "&", "&&"}[t.affinity])
+	printQuals(p, t.q, false, false)
+}
+
+func (t *msPointerType) printRight(p *msPrinter, flags int) {
+	switch t.pointee.(type) {
+	case *msFuncSig, *msArrayType:
+		p.s(")")
+	}
+	t.pointee.printRight(p, flags)
+}
+
+func (t *msPointerType) print(p *msPrinter, flags int) { printMSType(p, t, flags) }
+
+type msArrayType struct {
+	msTypeQuals
+	dims []uint64
+	elem msType
+}
+
+func (t *msArrayType) printLeft(p *msPrinter, flags int) {
+	t.elem.printLeft(p, flags)
+	printQuals(p, t.q, true, false)
+}
+
+func (t *msArrayType) printRight(p *msPrinter, flags int) {
+	p.s("[")
+	for i, dim := range t.dims {
+		if i > 0 {
+			p.s("][")
+		}
+		// Unknown bounds, as in "extern int a[];".
+		if dim != 0 {
+			p.s(strconv.FormatUint(dim, 10))
+		}
+	}
+	p.s("]")
+	t.elem.printRight(p, flags)
+}
+
+func (t *msArrayType) print(p *msPrinter, flags int) { printMSType(p, t, flags) }
+
+// Function classes.
+const (
+	fcPrivate = 1 << iota
+	fcProtected
+	fcPublic
+	fcGlobal
+	fcStatic
+	fcVirtual
+	fcFar
+	fcExternC
+	// An extern "C" function's locals are mangled with its name alone.
+	fcNoParameterList
+	fcVirtualThisAdjust
+	fcVirtualThisAdjustEx
+	fcStaticThisAdjust
+)
+
+const (
+	msNoRefQualifier = iota
+	msRefQualifier
+	msRValueRefQualifier
+)
+
+// msFuncSig is a function's type, or a thunk's, which adjusts "this"
+// before calling the function.
+type msFuncSig struct {
+	msTypeQuals
+	class int
+	cc    string
+	ret   msType
+	// Nil for "(void)", as opposed to empty for "(...)".
+	params   []msNode
+	variadic bool
+	noexcept bool
+	ref      int
+
+	thunk bool
+	// How a thunk adjusts "this", all in 32 bits.
+	staticOffset                                uint32
+	vbptrOffset, vboffsetOffset, vtordispOffset int32
+}
+
+func (t *msFuncSig) printLeft(p *msPrinter, flags int) {
+	if t.thunk {
+		p.s("[thunk]: ")
+	}
+	switch {
+	case t.class&fcPublic != 0:
+		p.s("public: ")
+	case t.class&fcProtected != 0:
+		p.s("protected: ")
+	case t.class&fcPrivate != 0:
+		p.s("private: ")
+	}
+	if t.class&fcGlobal == 0 && t.class&fcStatic != 0 {
+		p.s("static ")
+	}
+	if t.class&fcVirtual != 0 {
+		p.s("virtual ")
+	}
+	if t.class&fcExternC != 0 {
+		p.s("extern \"C\" ")
+	}
+	if t.ret != nil {
+		t.ret.printLeft(p, flags)
+		p.s(" ")
+	}
+	if flags&msNoCallingConvention == 0 {
+		printCallingConvention(p, t.cc)
+	}
+}
+
+func (t *msFuncSig) printRight(p *msPrinter, flags int) {
+	switch {
+	case t.class&fcStaticThisAdjust != 0:
+		p.s(fmt.Sprintf("`adjustor{%d}'", t.staticOffset))
+	case t.class&fcVirtualThisAdjustEx != 0:
+		p.s(fmt.Sprintf("`vtordispex{%d, %d, %d, %d}'", t.vbptrOffset, t.vboffsetOffset, t.vtordispOffset, t.staticOffset))
+	case t.class&fcVirtualThisAdjust != 0:
+		p.s(fmt.Sprintf("`vtordisp{%d, %d}'", t.vtordispOffset, t.staticOffset))
+	}
+	if t.class&fcNoParameterList == 0 {
+		p.s("(")
+		if t.params != nil {
+			printMSList(p, t.params, flags, ", ")
+		} else {
+			p.s("void")
+		}
+		if t.variadic {
+			if p.last() != '(' {
+				p.s(", ")
+			}
+			p.s("...")
+		}
+		p.s(")")
+	}
+	if t.q&msConst != 0 {
+		p.s(" const")
+	}
+	if t.q&msVolatile != 0 {
+		p.s(" volatile")
+	}
+	if t.q&msRestrict != 0 {
+		p.s(" __restrict")
+	}
+	if t.q&msUnaligned != 0 {
+		p.s(" __unaligned")
+	}
+	if t.noexcept {
+		p.s(" noexcept")
+	}
+	switch t.ref {
+	case msRefQualifier:
+		p.s(" &")
+	case msRValueRefQualifier:
+		p.s(" &&")
+	}
+	if t.ret != nil {
+		t.ret.printRight(p, flags)
+	}
+}
+
+func (t *msFuncSig) print(p *msPrinter, flags int) { printMSType(p, t, flags) }
+
+func printMSType(p *msPrinter, t msType, flags int) {
+	t.printLeft(p, flags)
+	t.printRight(p, flags)
+}
+
+func printCallingConvention(p *msPrinter, cc string) {
+	p.space()
+	p.s(cc)
+}
+
+// Template arguments other than types.
+
+type msIntegerLiteral struct {
+	value    uint64
+	negative bool
+}
+
+func (n *msIntegerLiteral) print(p *msPrinter, flags int) {
+	if n.negative {
+		p.s("-")
+	}
+	p.s(strconv.FormatUint(n.value, 10))
+}
+
+// msSymbolRef is a template argument referring to a symbol, or a
+// pointer to member given by the symbol and the offsets that find it.
+type msSymbolRef struct {
+	symbol  msSymbol
+	pointer bool
+	offsets []int64
+}
+
+func (n *msSymbolRef) print(p *msPrinter, flags int) {
+	if len(n.offsets) > 0 {
+		p.s("{")
+	} else if n.pointer {
+		p.s("&")
+	}
+	if n.symbol != nil {
+		n.symbol.print(p, flags)
+		if len(n.offsets) > 0 {
+			p.s(", ")
+		}
+	}
+	for i, off := range n.offsets {
+		if i > 0 {
+			p.s(", ")
+		}
+		p.s(strconv.FormatInt(off, 10))
+	}
+	if len(n.offsets) > 0 {
+		p.s("}")
+	}
+}
+
+// Names.
+
+// A msIdent is one component of a qualified name.
+type msIdent interface {
+	msNode
+	args() *msTemplateArgs
+}
+
+type msTemplateArgs struct {
+	// Nil when the name isn't a template's.
+	templateArgs []msNode
+}
+
+func (a *msTemplateArgs) args() *msTemplateArgs { return a }
+
+func (a *msTemplateArgs) print(p *msPrinter, flags int) {
+	if a.templateArgs == nil {
+		return
+	}
+	p.s("<")
+	printMSList(p, a.templateArgs, flags, ", ")
+	p.s(">")
+}
+
+type msName struct {
+	msTemplateArgs
+	name string
+}
+
+func (n *msName) print(p *msPrinter, flags int) {
+	p.s(n.name)
+	n.msTemplateArgs.print(p, flags)
+}
+
+// msOperator is an operator or a compiler generated function.
+type msOperator struct {
+	msTemplateArgs
+	name string
+}
+
+func (n *msOperator) print(p *msPrinter, flags int) {
+	p.s(n.name)
+	n.msTemplateArgs.print(p, flags)
+}
+
+type msLiteralOperator struct {
+	msTemplateArgs
+	name string
+}
+
+func (n *msLiteralOperator) print(p *msPrinter, flags int) {
+	p.s("operator \"\"" + n.name)
+	n.msTemplateArgs.print(p, flags)
+}
+
+type msConversionOperator struct {
+	msTemplateArgs
+	// The function's return type.
+	target msType
+}
+
+func (n *msConversionOperator) print(p *msPrinter, flags int) {
+	p.s("operator")
+	n.msTemplateArgs.print(p, flags)
+	p.s(" ")
+	if n.target != nil {
+		n.target.print(p, flags)
+	}
+}
+
+// msStructor is a constructor or destructor.
+type msStructor struct {
+	msTemplateArgs
+	destructor bool
+	class      msIdent
+}
+
+func (n *msStructor) print(p *msPrinter, flags int) {
+	if n.destructor {
+		p.s("~")
+	}
+	if n.class != nil {
+		n.class.print(p, flags)
+	}
+	n.msTemplateArgs.print(p, flags)
+}
+
+// msDynamicStructor is the function initializing or destroying a
+// static variable.
+type msDynamicStructor struct {
+	msTemplateArgs
+	destructor bool
+	variable   *msVariable
+	name       *msQualifiedName
+}
+
+func (n *msDynamicStructor) print(p *msPrinter, flags int) {
+	if n.destructor {
+		p.s("`dynamic atexit destructor for ")
+	} else {
+		p.s("`dynamic initializer for ")
+	}
+	if n.variable != nil {
+		p.s("`")
+		n.variable.print(p, flags)
+	} else {
+		p.s("'")
+		n.name.print(p, flags)
+	}
+	p.s("''")
+}
+
+type msLocalStaticGuard struct {
+	msTemplateArgs
+	thread     bool
+	scopeIndex uint32
+}
+
+func (n *msLocalStaticGuard) print(p *msPrinter, flags int) {
+	if n.thread {
+		p.s("`local static thread guard'")
+	} else {
+		p.s("`local static guard'")
+	}
+	if n.scopeIndex > 0 {
+		p.s(fmt.Sprintf("{%d}", n.scopeIndex))
+	}
+}
+
+type msVcallThunk struct {
+	msTemplateArgs
+	offset uint64
+}
+
+func (n *msVcallThunk) print(p *msPrinter, flags int) {
+	p.s(fmt.Sprintf("`vcall'{%d, {flat}}", n.offset))
+}
+
+type msBaseClassDescriptor struct {
+	msTemplateArgs
+	nvOffset      uint64
+	vbptrOffset   int64
+	vbtableOffset uint64
+	flags         uint64
+}
+
+func (n *msBaseClassDescriptor) print(p *msPrinter, flags int) {
+	p.s(fmt.Sprintf("`RTTI Base Class Descriptor at (%d, %d, %d, %d)'", n.nvOffset, n.vbptrOffset, n.vbtableOffset, n.flags))
+}
+
+type msQualifiedName struct {
+	parts []msIdent
+}
+
+func (n *msQualifiedName) print(p *msPrinter, flags int) {
+	for i, part := range n.parts {
+		if i > 0 {
+			p.s("::")
+		}
+		part.print(p, flags)
+	}
+}
+
+func (n *msQualifiedName) unqualified() msIdent {
+	return n.parts[len(n.parts)-1]
+}
+
+// Symbols.
+
+type msSymbol interface {
+	msNode
+	symbolName() *msQualifiedName
+}
+
+type msFunction struct {
+	sig  *msFuncSig
+	name *msQualifiedName
+}
+
+func (s *msFunction) symbolName() *msQualifiedName { return s.name }
+
+func (s *msFunction) print(p *msPrinter, flags int) {
+	s.sig.printLeft(p, flags)
+	p.space()
+	s.name.print(p, flags)
+	s.sig.printRight(p, flags)
+}
+
+// Storage classes of variables.
+const (
+	scNone = iota
+	scPrivateStatic
+	scProtectedStatic
+	scPublicStatic
+	scGlobal
+	scFunctionLocalStatic
+)
+
+type msVariable struct {
+	class int
+	typ   msType
+	name  *msQualifiedName
+}
+
+func (s *msVariable) symbolName() *msQualifiedName { return s.name }
+
+func (s *msVariable) print(p *msPrinter, flags int) {
+	switch s.class {
+	case scPrivateStatic:
+		p.s("private: static ")
+	case scProtectedStatic:
+		p.s("protected: static ")
+	case scPublicStatic:
+		p.s("public: static ")
+	}
+	if s.typ != nil {
+		s.typ.printLeft(p, flags)
+		p.space()
+	}
+	s.name.print(p, flags)
+	if s.typ != nil {
+		s.typ.printRight(p, flags)
+	}
+}
+
+// msSpecialTable is a vftable, vbtable or RTTI complete object locator,
+// for the part of its class that derives from target.
+type msSpecialTable struct {
+	q      msQuals
+	name   *msQualifiedName
+	target *msQualifiedName
+}
+
+func (s *msSpecialTable) symbolName() *msQualifiedName { return s.name }
+
+func (s *msSpecialTable) print(p *msPrinter, flags int) {
+	printQuals(p, s.q, false, true)
+	s.name.print(p, flags)
+	if s.target != nil {
+		p.s("{for `")
+		s.target.print(p, flags)
+		p.s("'}")
+	}
+}
+
+// msNamedSymbol is a symbol printed as its name alone: a local static
+// guard, or a name too long to mangle, which is replaced by its MD5 sum.
+type msNamedSymbol struct {
+	name *msQualifiedName
+}
+
+func (s *msNamedSymbol) symbolName() *msQualifiedName { return s.name }
+
+func (s *msNamedSymbol) print(p *msPrinter, flags int) { s.name.print(p, flags) }
+
+type msStringLiteral struct {
+	prefix    string
+	decoded   string
+	truncated bool
+}
+
+func (s *msStringLiteral) symbolName() *msQualifiedName { return nil }
+
+func (s *msStringLiteral) print(p *msPrinter, flags int) {
+	p.s(s.prefix + "\"" + s.decoded + "\"")
+	if s.truncated {
+		p.s("...")
+	}
+}
+
+func synthesizedName(name string) *msQualifiedName {
+	return &msQualifiedName{parts: []msIdent{&msName{name: name}}}
+}
+
+// Parsing.
+
+// The most back references a name can have of each kind.
+const msMaxBackrefs = 10
+
+type msBackrefs struct {
+	names  []*msName
+	params []msNode
+}
+
+type msDemangler struct {
+	input string
+	msBackrefs
+}
+
+func (d *msDemangler) startsWith(prefix string) bool {
+	return strings.HasPrefix(d.input, prefix)
+}
+
+func (d *msDemangler) eat(prefix string) bool {
+	if !d.startsWith(prefix) {
+		return false
+	}
+	d.input = d.input[len(prefix):]
+	return true
+}
+
+func (d *msDemangler) next() byte {
+	if len(d.input) == 0 {
+		fail("unexpected end")
+	}
+	c := d.input[0]
+	d.input = d.input[1:]
+	return c
+}
+
+func (d *msDemangler) startsWithDigit() bool {
+	return len(d.input) > 0 && '0' <= d.input[0] && d.input[0] <= '9'
+}
+
+// number parses a number: a digit for 1 to 10, or hex digits written
+// with 'A' to 'P' and ended by '@'.  A '?' makes it negative.
+func (d *msDemangler) number() (uint64, bool) {
+	negative := d.eat("?")
+	if d.startsWithDigit() {
+		return uint64(d.next()-'0') + 1, negative
+	}
+	var n uint64
+	for i := 0; i < len(d.input); i++ {
+		c := d.input[i]
+		if c == '@' {
+			d.input = d.input[i+1:]
+			return n, negative
+		}
+		if c < 'A' || c > 'P' {
+			break
+		}
+		n = n<<4 + uint64(c-'A')
+	}
+	fail("bad number")
+	return 0, false
+}
+
+func (d *msDemangler) unsigned() uint64 {
+	n, negative := d.number()
+	if negative {
+		fail("negative number")
+	}
+	return n
+}
+
+func (d *msDemangler) signed() int64 {
+	n, negative := d.number()
+	if n > 1<<63-1 {
+		fail("number out of range")
+	}
+	if negative {
+		return -int64(n)
+	}
+	return int64(n)
+}
+
+func (d *msDemangler) memorizeString(s string) {
+	if len(d.names) >= msMaxBackrefs {
+		return
+	}
+	for _, n := range d.names {
+		if n.name == s {
+			return
+		}
+	}
+	d.names = append(d.names, &msName{name: s})
+}
+
+// memorizeIdentifier makes a template's name, arguments and all, one
+// that can be referred back to.
+func (d *msDemangler) memorizeIdentifier(id msIdent) {
+	p := &msPrinter{}
+	id.print(p, 0)
+	d.memorizeString(p.String())
+}
+
+func (d *msDemangler) parse() msSymbol {
+	switch {
+	case d.startsWith("."):
+		// The name of a type in its RTTI.
+		d.eat(".")
+		t := d.typ(msResult)
+		if len(d.input) > 0 {
+			fail("unexpected '%s'", d.input)
+		}
+		return &msVariable{typ: t, name: synthesizedName("`RTTI Type Descriptor Name'")}
+	case d.startsWith("??@"):
+		return d.md5Name()
+	}
+	if !d.eat("?") {
+		fail("expected '?'")
+	}
+	if s := d.specialIntrinsic(); s != nil {
+		return s
+	}
+	return d.declarator()
+}
+
+// md5Name parses a name too long to mangle, "??@" followed by its
+// hash, which can only be printed as it is.
+func (d *msDemangler) md5Name() msSymbol {
+	start := d.input
+	end := strings.IndexByte(d.input[len("??@"):], '@')
+	if end < 0 {
+		fail("unterminated MD5 name")
+	}
+	d.input = d.input[len("??@")+end+1:]
+	// The complete object locator of such a class.
+	d.eat("??_R4@")
+	return &msNamedSymbol{name: synthesizedName(start[:len(start)-len(d.input)])}
+}
+
+const (
+	siNone = iota
+	siVftable
+	siVbtable
+	siVcallThunk
+	siTypeof
+	siLocalStaticGuard
+	siStringLiteral
+	siUdtReturning
+	siRttiTypeDescriptor
+	siRttiBaseClassDescriptor
+	siRttiBaseClassArray
+	siRttiClassHierarchyDescriptor
+	siRttiCompleteObjLocator
+	siLocalVftable
+	siDynamicInitializer
+	siDynamicAtexitDestructor
+	siLocalStaticThreadGuard
+)
+
+var msSpecialIntrinsics = []struct {
+	prefix string
+	kind   int
+}{
+	{"?_7", siVftable},
+	{"?_8", siVbtable},
+	{"?_9", siVcallThunk},
+	{"?_A", siTypeof},
+	{"?_B", siLocalStaticGuard},
+	{"?_C", siStringLiteral},
+	{"?_P", siUdtReturning},
+	{"?_R0", siRttiTypeDescriptor},
+	{"?_R1", siRttiBaseClassDescriptor},
+	{"?_R2", siRttiBaseClassArray},
+	{"?_R3", siRttiClassHierarchyDescriptor},
+	{"?_R4", siRttiCompleteObjLocator},
+	{"?_S", siLocalVftable},
+	{"?__E", siDynamicInitializer},
+	{"?__F", siDynamicAtexitDestructor},
+	{"?__J", siLocalStaticThreadGuard},
+}
+
+// specialIntrinsic parses the compiler generated symbols that aren't
+// functions or variables, returning nil for other names.
+func (d *msDemangler) specialIntrinsic() msSymbol {
+	kind := siNone
+	for _, si := range msSpecialIntrinsics {
+		if d.eat(si.prefix) {
+			kind = si.kind
+			break
+		}
+	}
+	switch kind {
+	case siNone:
+		return nil
+	case siStringLiteral:
+		return d.stringLiteral()
+	case siVftable:
+		return d.specialTable("`vftable'")
+	case siVbtable:
+		return d.specialTable("`vbtable'")
+	case siLocalVftable:
+		return d.specialTable("`local vftable'")
+	case siRttiCompleteObjLocator:
+		return d.specialTable("`RTTI Complete Object Locator'")
+	case siVcallThunk:
+		return d.vcallThunk()
+	case siLocalStaticGuard, siLocalStaticThreadGuard:
+		return d.localStaticGuard(kind == siLocalStaticThreadGuard)
+	case siRttiTypeDescriptor:
+		t := d.typ(msResult)
+		if !d.eat("@8") {
+			fail("expected '@8'")
+		}
+		if len(d.input) > 0 {
+			fail("unexpected '%s'", d.input)
+		}
+		return &msVariable{typ: t, name: synthesizedName("`RTTI Type Descriptor'")}
+	case siRttiBaseClassArray:
+		return d.untypedVariable("`RTTI Base Class Array'")
+	case siRttiClassHierarchyDescriptor:
+		return d.untypedVariable("`RTTI Class Hierarchy Descriptor'")
+	case siRttiBaseClassDescriptor:
+		bcd := &msBaseClassDescriptor{}
+		bcd.nvOffset = d.unsigned()
+		bcd.vbptrOffset = d.signed()
+		bcd.vbtableOffset = d.unsigned()
+		bcd.flags = d.unsigned()
+		v := &msVariable{name: d.nameScopeChain(bcd)}
+		d.eat("8")
+		return v
+	case siDynamicInitializer, siDynamicAtexitDestructor:
+		return d.initFiniStub(kind == siDynamicAtexitDestructor)
+	}
+	// Typeof and UDT returning names, which no known compiler emits.
+	fail("unsupported special name")
+	return nil
+}
+
+func (d *msDemangler) specialTable(name string) msSymbol {
+	s := &msSpecialTable{name: d.nameScopeChain(&msName{name: name})}
+	if c := d.next(); c != '6' && c != '7' {
+		fail("bad table '%c'", c)
+	}
+	s.q, _ = d.qualifiers()
+	if !d.eat("@") {
+		s.target = d.fullyQualifiedTypeName()
+	}
+	return s
+}
+
+func (d *msDemangler) vcallThunk() msSymbol {
+	id := &msVcallThunk{}
+	f := &msFunction{sig: &msFuncSig{thunk: true, class: fcNoParameterList}}
+	f.name = d.nameScopeChain(id)
+	if !d.eat("$B") {
+		fail("expected '$B'")
+	}
+	id.offset = d.unsigned()
+	if !d.eat("A") {
+		fail("expected 'A'")
+	}
+	f.sig.cc = d.callingConvention()
+	return f
+}
+
+func (d *msDemangler) localStaticGuard(thread bool) msSymbol {
+	id := &msLocalStaticGuard{thread: thread}
+	s := &msNamedSymbol{name: d.nameScopeChain(id)}
+	if !d.eat("4IA") && !d.eat("5") {
+		fail("bad local static guard")
+	}
+	if len(d.input) > 0 {
+		id.scopeIndex = uint32(d.unsigned())
+	}
+	return s
+}
+
+func (d *msDemangler) untypedVariable(name string) msSymbol {
+	v := &msVariable{name: d.nameScopeChain(&msName{name: name})}
+	if !d.eat("8") {
+		fail("expected '8'")
+	}
+	return v
+}
+
+// initFiniStub parses the function initializing or destroying a static
+// variable.
+func (d *msDemangler) initFiniStub(destructor bool) msSymbol {
+	id := &msDynamicStructor{destructor: destructor}
+	member := d.eat("?")
+	sym := d.declarator()
+	if v, ok := sym.(*msVariable); ok {
+		id.variable = v
+		// Older versions of clang ended these with one '@' and no
+		// leading '?', rather than two.
+		ats := "@"
+		if member {
+			ats = "@@"
+		}
+		if !d.eat(ats) {
+			fail("expected '%s'", ats)
+		}
+		f := d.functionEncoding()
+		f.name = &msQualifiedName{parts: []msIdent{id}}
+		return f
+	}
+	if member {
+		fail("expected a static data member")
+	}
+	f := sym.(*msFunction)
+	id.name = f.name
+	f.name = &msQualifiedName{parts: []msIdent{id}}
+	return f
+}
+
+// declarator parses a function or variable.
+func (d *msDemangler) declarator() msSymbol {
+	name := d.fullyQualifiedSymbolName()
+	var sym msSymbol
+	if len(d.input) > 0 && '0' <= d.input[0] && d.input[0] <= '4' {
+		sym = d.variableEncoding(int(d.next()-'0') + scPrivateStatic)
+		sym.(*msVariable).name = name
+	} else {
+		f := d.functionEncoding()
+		f.name = name
+		if op, ok := name.unqualified().(*msConversionOperator); ok {
+			op.target = f.sig.ret
+		}
+		sym = f
+	}
+	if op, ok := name.unqualified().(*msConversionOperator); ok && op.target == nil {
+		fail("conversion operator without a type")
+	}
+	return sym
+}
+
+func (d *msDemangler) variableEncoding(class int) *msVariable {
+	v := &msVariable{class: class, typ: d.typ(msDrop)}
+	if ptr, ok := v.typ.(*msPointerType); ok {
+		ptr.q |= d.pointerExtQualifiers()
+		q, _ := d.qualifiers()
+		if ptr.class != nil {
+			// The class again.
+			d.fullyQualifiedTypeName()
+		}
+		*ptr.pointee.quals() |= q
+	} else {
+		*v.typ.quals(), _ = d.qualifiers()
+	}
+	return v
+}
+
+var msFunctionClasses = map[byte]int{
+	'9': fcExternC | fcNoParameterList,
+	'A': fcPrivate,
+	'B': fcPrivate | fcFar,
+	'C': fcPrivate | fcStatic,
+	'D': fcPrivate | fcStatic | fcFar,
+	'E': fcPrivate | fcVirtual,
+	'F': fcPrivate | fcVirtual | fcFar,
+	'G': fcPrivate | fcStaticThisAdjust,
+	'H': fcPrivate | fcStaticThisAdjust | fcFar,
+	'I': fcProtected,
+	'J': fcProtected | fcFar,
+	'K': fcProtected | fcStatic,
+	'L': fcProtected | fcStatic | fcFar,
+	'M': fcProtected | fcVirtual,
+	'N': fcProtected | fcVirtual | fcFar,
+	'O': fcProtected | fcVirtual | fcStaticThisAdjust,
+	'P': fcProtected | fcVirtual | fcStaticThisAdjust | fcFar,
+	'Q': fcPublic,
+	'R': fcPublic | fcFar,
+	'S': fcPublic | fcStatic,
+	'T': fcPublic | fcStatic | fcFar,
+	'U': fcPublic | fcVirtual,
+	'V': fcPublic | fcVirtual | fcFar,
+	'W': fcPublic | fcVirtual | fcStaticThisAdjust,
+	'X': fcPublic | fcVirtual | fcStaticThisAdjust | fcFar,
+	'Y': fcGlobal,
+	'Z': fcGlobal | fcFar,
+}
+
+// Function classes of thunks adjusting "this" by a vtordisp, after
+// "$".
+var msVtordispClasses = map[byte]int{
+	'0': fcPrivate | fcVirtual,
+	'1': fcPrivate | fcVirtual | fcFar,
+	'2': fcProtected | fcVirtual,
+	'3': fcProtected | fcVirtual | fcFar,
+	'4': fcPublic | fcVirtual,
+	'5': fcPublic | fcVirtual | fcFar,
+}
+
+func (d *msDemangler) functionClass() int {
+	c := d.next()
+	if c != '$' {
+		if fc, ok := msFunctionClasses[c]; ok {
+			return fc
+		}
+		fail("bad function class '%c'", c)
+	}
+	adjust := fcVirtualThisAdjust
+	if d.eat("R") {
+		adjust |= fcVirtualThisAdjustEx
+	}
+	c = d.next()
+	if fc, ok := msVtordispClasses[c]; ok {
+		return fc | adjust
+	}
+	fail("bad function class '$%c'", c)
+	return 0
+}
+
+func (d *msDemangler) functionEncoding() *msFunction {
+	extra := 0
+	if d.eat("$$J0") {
+		extra = fcExternC
+	}
+	class := d.functionClass() | extra
+	var sig *msFuncSig
+	thunk := &msFuncSig{thunk: true}
+	switch {
+	case class&fcStaticThisAdjust != 0:
+		thunk.staticOffset = uint32(d.signed())
+	case class&fcVirtualThisAdjust != 0:
+		if class&fcVirtualThisAdjustEx != 0 {
+			thunk.vbptrOffset = int32(d.signed())
+			thunk.vboffsetOffset = int32(d.signed())
+		}
+		thunk.vtordispOffset = int32(d.signed())
+		thunk.staticOffset = uint32(d.signed())
+	default:
+		thunk = nil
+	}
+	if class&fcNoParameterList != 0 {
+		// The local names of an extern "C" function have its
+		// name and nothing of its type.
+		sig = &msFuncSig{}
+	} else {
+		sig = d.functionType(class&(fcGlobal|fcStatic) == 0)
+	}
+	if thunk != nil {
+		sig.thunk = true
+		sig.staticOffset = thunk.staticOffset
+		sig.vbptrOffset = thunk.vbptrOffset
+		sig.vboffsetOffset = thunk.vboffsetOffset
+		sig.vtordispOffset = thunk.vtordispOffset
+	}
+	sig.class = class
+	return &msFunction{sig: sig}
+}
+
+func (d *msDemangler) functionType(hasThisQuals bool) *msFuncSig {
+	sig := &msFuncSig{}
+	if hasThisQuals {
+		sig.q = d.pointerExtQualifiers()
+		switch {
+		case d.eat("G"):
+			sig.ref = msRefQualifier
+		case d.eat("H"):
+			sig.ref = msRValueRefQualifier
+		}
+		q, _ := d.qualifiers()
+		sig.q |= q
+	}
+	sig.cc = d.callingConvention()
+	// Constructors and destructors have no return type.
+	if !d.eat("@") {
+		sig.ret = d.typ(msResult)
+	}
+	sig.params, sig.variadic = d.functionParams()
+	switch {
+	case d.eat("_E"):
+		sig.noexcept = true
+	case d.eat("Z"):
+	default:
+		fail("expected a throw specification")
+	}
+	return sig
+}
+
+func (d *msDemangler) functionParams() ([]msNode, bool) {
+	if d.eat("X") {
+		return nil, false
+	}
+	params := []msNode{}
+	for !d.startsWith("@") && !d.startsWith("Z") {
+		if d.startsWithDigit() {
+			i := int(d.next() - '0')
+			if i >= len(d.params) {
+				fail("bad parameter back reference %d", i)
+			}
+			params = append(params, d.params[i])
+			continue
+		}
+		size := len(d.input)
+		t := d.typ(msDrop)
+		params = append(params, t)
+		// Single letter types aren't worth referring back to.
+		if len(d.params) < msMaxBackrefs && size-len(d.input) > 1 {
+			d.params = append(d.params, t)
+		}
+	}
+	// A list is ended by '@', or by 'Z' for "...".
+	if d.eat("@") {
+		return params, false
+	}
+	d.eat("Z")
+	return params, true
+}
+
+func (d *msDemangler) templateArgs() []msNode {
+	args := []msNode{}
+	for !d.startsWith("@") {
+		if d.eat("$S") || d.eat("$$V") || d.eat("$$$V") || d.eat("$$Z") {
+			// Ends a parameter pack.
+			continue
+		}
+		var arg msNode
+		switch {
+		case d.eat("$$Y"):
+			// An alias template.
+			arg = d.fullyQualifiedTypeName()
+		case d.eat("$$B"):
+			// An array.
+			arg = d.typ(msDrop)
+		case d.eat("$$C"):
+			// A type with qualifiers.
+			arg = d.typ(msMangle)
+		case d.startsWith("$1"), d.startsWith("$H"), d.startsWith("$I"), d.startsWith("$J"):
+			// A pointer to member function: its symbol and, but
+			// for single inheritance, offsets to adjust "this" by.
+			d.next()
+			inheritance := d.next()
+			ref := &msSymbolRef{pointer: true}
+			if d.startsWith("?") {
+				ref.symbol = d.parse()
+				if ref.symbol.symbolName() == nil {
+					fail("template argument without a name")
+				}
+				d.memorizeIdentifier(ref.symbol.symbolName().unqualified())
+			}
+			n := strings.IndexByte("1HIJ", inheritance)
+			for i := 0; i < n; i++ {
+				ref.offsets = append(ref.offsets, d.signed())
+			}
+			arg = ref
+		case d.startsWith("$E?"):
+			// A reference to a symbol.
+			d.eat("$E")
+			arg = &msSymbolRef{symbol: d.parse()}
+		case d.startsWith("$F"), d.startsWith("$G"):
+			// A pointer to data member.
+			d.next()
+			n := 2
+			if d.next() == 'G' {
+				n = 3
+			}
+			ref := &msSymbolRef{}
+			for i := 0; i < n; i++ {
+				ref.offsets = append(ref.offsets, d.signed())
+			}
+			arg = ref
+		case d.eat("$0"):
+			value, negative := d.number()
+			arg = &msIntegerLiteral{value, negative}
+		default:
+			arg = d.typ(msDrop)
+		}
+		args = append(args, arg)
+	}
+	d.eat("@")
+	return args
+}
+
+// How qualifiers in front of a type are mangled.
+const (
+	// Not at all.
+	msDrop = iota
+	// Always.
+	msMangle
+	// After a '?', as for return types.
+	msResult
+)
+
+func (d *msDemangler) typ(mode int) msType {
+	var q msQuals
+	if mode == msMangle || mode == msResult && d.eat("?") {
+		q, _ = d.qualifiers()
+	}
+	if len(d.input) == 0 {
+		fail("expected a type")
+	}
+	var t msType
+	switch {
+	case strings.IndexByte("TUVW", d.input[0]) >= 0:
+		t = d.tagType()
+	case d.startsWith("$$Q") || strings.IndexByte("APQRS", d.input[0]) >= 0:
+		if d.isMemberPointer() {
+			t = d.memberPointerType()
+		} else {
+			t = d.pointerType()
+		}
+	case d.eat("Y"):
+		t = d.arrayType()
+	case d.eat("$$A8@@"):
+		t = d.functionType(true)
+	case d.eat("$$A6"):
+		t = d.functionType(false)
+	case d.eat("?"):
+		id := d.unqualifiedTypeName(true)
+		if !d.eat("@") {
+			fail("expected '@'")
+		}
+		t = &msCustom{ident: id}
+	default:
+		t = d.primitiveType()
+	}
+	*t.quals() |= q
+	return t
+}
+
+// isMemberPointer reports whether the pointer type that follows points
+// to a member.
+func (d *msDemangler) isMemberPointer() bool {
+	s := d.input
+	switch s[0] {
+	case '$', 'A':
+		// Rvalue references and references, which can't be to
+		// members.
+		return false
+	}
+	s = s[1:]
+	if len(s) > 0 && '0' <= s[0] && s[0] <= '9' {
+		// A function pointer, 6 for a non-member one and 8 for a
+		// member one.
+		if s[0] != '6' && s[0] != '8' {
+			fail("bad function pointer '%c'", s[0])
+		}
+		return s[0] == '8'
+	}
+	for _, ext := range []string{"E", "I", "F"} {
+		s = strings.TrimPrefix(s, ext)
+	}
+	if len(s) == 0 {
+		fail("expected qualifiers")
+	}
+	switch s[0] {
+	case 'A', 'B', 'C', 'D':
+		return false
+	case 'Q', 'R', 'S', 'T':
+		return true
+	}
+	fail("bad qualifiers '%c'", s[0])
+	return false
+}
+
+// pointerQualifiers parses the kind of a pointer and its cv-qualifiers.
+func (d *msDemangler) pointerQualifiers() (msQuals, int) {
+	if d.eat("$$Q") {
+		return 0, msRValueReference
+	}
+	switch d.next() {
+	case 'A':
+		return 0, msReference
+	case 'P':
+		return 0, msPointer
+	case 'Q':
+		return msConst, msPointer
+	case 'R':
+		return msVolatile, msPointer
+	}
+	return msConst | msVolatile, msPointer
+}
+
+// pointerExtQualifiers parses the qualifiers only pointers have.
+func (d *msDemangler) pointerExtQualifiers() msQuals {
+	var q msQuals
+	if d.eat("E") {
+		q |= msPointer64
+	}
+	if d.eat("I") {
+		q |= msRestrict
+	}
+	if d.eat("F") {
+		q |= msUnaligned
+	}
+	return q
+}
+
+// qualifiers parses cv-qualifiers, also returning whether they're a
+// member's.
+func (d *msDemangler) qualifiers() (msQuals, bool) {
+	c := d.next()
+	switch c {
+	case 'Q', 'A':
+		return 0, c == 'Q'
+	case 'R', 'B':
+		return msConst, c == 'R'
+	case 'S', 'C':
+		return msVolatile, c == 'S'
+	case 'T', 'D':
+		return msConst | msVolatile, c == 'T'
+	}
+	fail("bad qualifiers '%c'", c)
+	return 0, false
+}
+
+var msCallingConventions = map[byte]string{
+	'A': "__cdecl",
+	'B': "__cdecl",
+	'C': "__pascal",
+	'D': "__pascal",
+	'E': "__thiscall",
+	'F': "__thiscall",
+	'G': "__stdcall",
+	'H': "__stdcall",
+	'I': "__fastcall",
+	'J': "__fastcall",
+	'M': "__clrcall",
+	'N': "__clrcall",
+	'O': "__eabi",
+	'P': "__eabi",
+	'Q': "__vectorcall",
+	'S': "__attribute__((__swiftcall__)) ",
+	'W': "__attribute__((__swiftasynccall__)) ",
+}
+
+// callingConvention parses a calling convention, which prints as
+// nothing when it's unknown.
+func (d *msDemangler) callingConvention() string {
+	return msCallingConventions[d.next()]
+}
+
+func (d *msDemangler) pointerType() msType {
+	t := &msPointerType{}
+	t.q, t.affinity = d.pointerQualifiers()
+	if d.eat("6") {
+		t.pointee = d.functionType(false)
+		return t
+	}
+	t.q |= d.pointerExtQualifiers()
+	t.pointee = d.typ(msMangle)
+	return t
+}
+
+func (d *msDemangler) memberPointerType() msType {
+	t := &msPointerType{}
+	t.q, t.affinity = d.pointerQualifiers()
+	t.q |= d.pointerExtQualifiers()
+	if d.eat("8") {
+		t.class = d.fullyQualifiedTypeName()
+		t.pointee = d.functionType(true)
+		return t
+	}
+	q, _ := d.qualifiers()
+	t.class = d.fullyQualifiedTypeName()
+	t.pointee = d.typ(msDrop)
+	*t.pointee.quals() = q
+	return t
+}
+
+func (d *msDemangler) arrayType() msType {
+	rank, negative := d.number()
+	if negative || rank == 0 {
+		fail("bad array rank")
+	}
+	t := &msArrayType{}
+	for i := uint64(0); i < rank; i++ {
+		dim, negative := d.number()
+		if negative {
+			fail("negative array dimension")
+		}
+		t.dims = append(t.dims, dim)
+	}
+	if d.eat("$$C") {
+		var member bool
+		t.q, member = d.qualifiers()
+		if member {
+			fail("array with member qualifiers")
+		}
+	}
+	t.elem = d.typ(msDrop)
+	return t
+}
+
+func (d *msDemangler) tagType() msType {
+	t := &msTag{}
+	switch d.next() {
+	case 'T':
+		t.tag = "union"
+	case 'U':
+		t.tag = "struct"
+	case 'V':
+		t.tag = "class"
+	case 'W':
+		if !d.eat("4") {
+			fail("expected '4'")
+		}
+		t.tag = "enum"
+	}
+	t.name = d.fullyQualifiedTypeName()
+	return t
+}
+
+var msPrimitiveTypes = map[byte]string{
+	'X': "void",
+	'D': "char",
+	'C': "signed char",
+	'E': "unsigned char",
+	'F': "short",
+	'G': "unsigned short",
+	'H': "int",
+	'I': "unsigned int",
+	'J': "long",
+	'K': "unsigned long",
+	'M': "float",
+	'N': "double",
+	'O': "long double",
+}
+
+// Primitive types after '_'.
+var msExtendedPrimitiveTypes = map[byte]string{
+	'N': "bool",
+	'J': "__int64",
+	'K': "unsigned __int64",
+	'W': "wchar_t",
+	'Q': "char8_t",
+	'S': "char16_t",
+	'U': "char32_t",
+}
+
+func (d *msDemangler) primitiveType() msType {
+	if d.eat("$$T") {
+		return &msPrimitive{name: "std::nullptr_t"}
+	}
+	c := d.next()
+	name, ok := msPrimitiveTypes[c]
+	if c == '_' {
+		c = d.next()
+		name, ok = msExtendedPrimitiveTypes[c]
+	}
+	if !ok {
+		fail("bad type '%c'", c)
+	}
+	return &msPrimitive{name: name}
+}
+
+// Which names templates may refer back to.
+const (
+	nbbTemplate = 1 << iota
+	nbbSimple
+)
+
+func (d *msDemangler) fullyQualifiedTypeName() *msQualifiedName {
+	return d.nameScopeChain(d.unqualifiedTypeName(true))
+}
+
+// fullyQualifiedSymbolName parses the name of a function or variable.
+// The only template whose name can end it is a function template,
+// whose name isn't one that can be referred back to.
+func (d *msDemangler) fullyQualifiedSymbolName() *msQualifiedName {
+	id := d.unqualifiedSymbolName(nbbSimple)
+	name := d.nameScopeChain(id)
+	if s, ok := id.(*msStructor); ok {
+		if len(name.parts) < 2 {
+			fail("constructor without a class")
+		}
+		s.class = name.parts[len(name.parts)-2]
+	}
+	return name
+}
+
+func (d *msDemangler) unqualifiedTypeName(memorize bool) msIdent {
+	switch {
+	case d.startsWithDigit():
+		return d.backrefName()
+	case d.startsWith("?$"):
+		return d.templateInstantiationName(nbbTemplate)
+	}
+	return d.simpleName(memorize)
+}
+
+func (d *msDemangler) unqualifiedSymbolName(nbb int) msIdent {
+	switch {
+	case d.startsWithDigit():
+		return d.backrefName()
+	case d.startsWith("?$"):
+		return d.templateInstantiationName(nbb)
+	case d.startsWith("?"):
+		return d.functionIdentifierCode()
+	}
+	return d.simpleName(nbb&nbbSimple != 0)
+}
+
+// nameScopeChain parses the scopes that id is in, innermost first, and
+// returns the whole name.
+func (d *msDemangler) nameScopeChain(id msIdent) *msQualifiedName {
+	parts := []msIdent{id}
+	for !d.eat("@") {
+		if len(d.input) == 0 {
+			fail("unterminated name")
+		}
+		parts = append(parts, d.nameScopePiece())
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return &msQualifiedName{parts: parts}
+}
+
+func (d *msDemangler) nameScopePiece() msIdent {
+	switch {
+	case d.startsWithDigit():
+		return d.backrefName()
+	case d.startsWith("?$"):
+		return d.templateInstantiationName(nbbTemplate)
+	case d.eat("?A"):
+		// The anonymous namespace, which is named by a key that is
+		// remembered but not printed.
+		end := strings.IndexByte(d.input, '@')
+		if end < 0 {
+			fail("unterminated anonymous namespace")
+		}
+		d.memorizeString(d.input[:end])
+		d.input = d.input[end+1:]
+		return &msName{name: "`anonymous namespace'"}
+	case isLocalScope(d.input):
+		return d.locallyScopedName()
+	}
+	return d.simpleName(true)
+}
+
+// isLocalScope reports whether s starts with the number of a scope
+// inside a function, as in "?1?", "?@?" or "?BA@?".
+func isLocalScope(s string) bool {
+	if !strings.HasPrefix(s, "?") {
+		return false
+	}
+	s = s[1:]
+	end := strings.IndexByte(s, '?')
+	if end <= 0 {
+		return false
+	}
+	n := s[:end]
+	if len(n) == 1 {
+		return n[0] == '@' || '0' <= n[0] && n[0] <= '9'
+	}
+	if n[len(n)-1] != '@' {
+		return false
+	}
+	n = n[:len(n)-1]
+	// There's no leading 'A', for 0, which would start an anonymous
+	// namespace.
+	if n[0] < 'B' || n[0] > 'P' {
+		return false
+	}
+	for i := 1; i < len(n); i++ {
+		if n[i] < 'A' || n[i] > 'P' {
+			return false
+		}
+	}
+	return true
+}
+
+// locallyScopedName parses a scope inside a function, which is printed
+// as the function and the scope's number.
+func (d *msDemangler) locallyScopedName() msIdent {
+	d.eat("?")
+	n, _ := d.number()
+	d.eat("?")
+	scope := d.parse()
+	p := &msPrinter{}
+	p.s("`")
+	scope.print(p, 0)
+	p.s(fmt.Sprintf("'::`%d'", n))
+	return &msName{name: p.String()}
+}
+
+func (d *msDemangler) backrefName() msIdent {
+	i := int(d.next() - '0')
+	if i >= len(d.names) {
+		fail("bad name back reference %d", i)
+	}
+	return d.names[i]
+}
+
+// templateInstantiationName parses a template's name and arguments,
+// which have back references of their own.
+func (d *msDemangler) templateInstantiationName(nbb int) msIdent {
+	d.eat("?$")
+	outer := d.msBackrefs
+	d.msBackrefs = msBackrefs{}
+	id := d.unqualifiedSymbolName(nbbSimple)
+	id.args().templateArgs = d.templateArgs()
+	d.msBackrefs = outer
+	if nbb&nbbTemplate != 0 {
+		// Only types and scopes have this, and constructors and
+		// conversion operators can't be either.
+		switch id.(type) {
+		case *msConversionOperator, *msStructor:
+			fail("unexpected function name in a type")
+		}
+		d.memorizeIdentifier(id)
+	}
+	return id
+}
+
+func (d *msDemangler) simpleName(memorize bool) msIdent {
+	return &msName{name: d.simpleString(memorize)}
+}
+
+func (d *msDemangler) simpleString(memorize bool) string {
+	end := strings.IndexByte(d.input, '@')
+	if end <= 0 {
+		fail("expected a name")
+	}
+	s := d.input[:end]
+	d.input = d.input[end+1:]
+	if memorize {
+		d.memorizeString(s)
+	}
+	return s
+}
+
+// Operators and compiler generated functions, by their code after "?",
+// "?_" and "?__", in the order 0-9, A-Z.  Those left out are
+// constructors, destructors and conversion operators, which are handled
+// separately, special names or unused.
+var msOperators = [3][36]string{{
+	2:  "operator new",
+	3:  "operator delete",
+	4:  "operator=",
+	5:  "operator>>",
+	6:  "operator<<",
+	7:  "operator!",
+	8:  "operator==",
+	9:  "operator!=",
+	10: "operator[]",
+	12: "operator->",
+	13: "operator*",
+	14: "operator++",
+	15: "operator--",
+	16: "operator-",
+	17: "operator+",
+	18: "operator&",
+	19: "operator->*",
+	20: "operator/",
+	21: "operator%",
+	22: "operator<",
+	23: "operator<=",
+	24: "operator>",
+	25: "operator>=",
+	26: "operator,",
+	27: "operator()",
+	28: "operator~",
+	29: "operator^",
+	30: "operator|",
+	31: "operator&&",
+	32: "operator||",
+	33: "operator*=",
+	34: "operator+=",
+	35: "operator-=",
+}, {
+	0:  "operator/=",
+	1:  "operator%=",
+	2:  "operator>>=",
+	3:  "operator<<=",
+	4:  "operator&=",
+	5:  "operator|=",
+	6:  "operator^=",
+	13: "`vbase dtor'",
+	14: "`vector deleting dtor'",
+	15: "`default ctor closure'",
+	16: "`scalar deleting dtor'",
+	17: "`vector ctor iterator'",
+	18: "`vector dtor iterator'",
+	19: "`vector vbase ctor iterator'",
+	20: "`virtual displacement map'",
+	21: "`eh vector ctor iterator'",
+	22: "`eh vector dtor iterator'",
+	23: "`eh vector vbase ctor iterator'",
+	24: "`copy ctor closure'",
+	29: "`local vftable ctor closure'",
+	30: "operator new[]",
+	31: "operator delete[]",
+}, {
+	10: "`managed vector ctor iterator'",
+	11: "`managed vector dtor iterator'",
+	12: "`EH vector copy ctor iterator'",
+	13: "`EH vector vbase copy ctor iterator'",
+	16: "`vector copy ctor iterator'",
+	17: "`vector vbase copy constructor iterator'",
+	18: "`managed vector vbase copy constructor iterator'",
+	21: "operator co_await",
+	22: "operator<=>",
+}}
+
+// functionIdentifierCode parses the name of an operator, constructor or
+// other function named by a code.
+func (d *msDemangler) functionIdentifierCode() msIdent {
+	d.eat("?")
+	group := 0
+	switch {
+	case d.eat("__"):
+		group = 2
+	case d.eat("_"):
+		group = 1
+	}
+	c := d.next()
+	switch {
+	case group == 0 && (c == '0' || c == '1'):
+		return &msStructor{destructor: c == '1'}
+	case group == 0 && c == 'B':
+		return &msConversionOperator{}
+	case group == 2 && c == 'K':
+		return &msLiteralOperator{name: d.simpleString(false)}
+	}
+	var i int
+	switch {
+	case '0' <= c && c <= '9':
+		i = int(c - '0')
+	case 'A' <= c && c <= 'Z':
+		i = int(c-'A') + 10
+	default:
+		fail("bad operator code '%c'", c)
+	}
+	return &msOperator{name: msOperators[group][i]}
+}
+
+// String literals.
+
+// stringLiteral parses a string literal's symbol, which holds its length,
+// a checksum and at most 32 bytes of it.
+func (d *msDemangler) stringLiteral() msSymbol {
+	if !d.eat("@_") {
+		fail("expected '@_'")
+	}
+	s := &msStringLiteral{}
+	var wide bool
+	switch d.next() {
+	case '1':
+		wide = true
+	case '0':
+	default:
+		fail("bad string literal")
+	}
+	size, negative := d.number()
+	if negative || wide && size < 2 || size < 1 {
+		fail("bad string literal size")
+	}
+	// The checksum.
+	end := strings.IndexByte(d.input, '@')
+	if end < 0 {
+		fail("unterminated checksum")
+	}
+	d.input = d.input[end+1:]
+	if len(d.input) == 0 {
+		fail("unexpected end")
+	}
+	var out msPrinter
+	if wide {
+		s.prefix = "L"
+		s.truncated = size > 64
+		for !d.eat("@") {
+			if len(d.input) < 2 {
+				fail("unterminated string literal")
+			}
+			c1 := d.charLiteral()
+			if len(d.input) == 0 {
+				fail("unterminated string literal")
+			}
+			c := uint32(c1)<<8 | uint32(d.charLiteral())
+			// Leave out the terminating null.
+			if size != 2 || s.truncated {
+				printEscapedChar(&out, c)
+			}
+			size -= 2
+		}
+	} else {
+		// There should be 32 bytes at most, but some compilers have
+		// mangled more.
+		const maxBytes = 32 * 4
+		var bytes []byte
+		for !d.eat("@") {
+			if len(d.input) == 0 || len(bytes) >= maxBytes {
+				fail("bad string literal")
+			}
+			bytes = append(bytes, d.charLiteral())
+		}
+		s.truncated = size > uint64(len(bytes))
+		width := guessCharWidth(bytes, size)
+		s.prefix = map[int]string{1: "", 2: "u", 4: "U"}[width]
+		n := len(bytes) / width
+		for i := 0; i < n; i++ {
+			var c uint32
+			for j := 0; j < width; j++ {
+				c |= uint32(bytes[i*width+j]) << (8 * j)
+			}
+			if i+1 < n || s.truncated {
+				printEscapedChar(&out, c)
+			}
+		}
+	}
+	s.decoded = out.String()
+	return s
+}
+
+func (d *msDemangler) charLiteral() byte {
+	if !d.eat("?") {
+		return d.next()
+	}
+	if len(d.input) == 0 {
+		fail("bad character")
+	}
+	c := d.input[0]
+	switch {
+	case d.eat("$"):
+		// Two hex digits written with 'A' to 'P'.
+		if len(d.input) < 2 || !isRebasedHexDigit(d.input[0]) || !isRebasedHexDigit(d.input[1]) {
+			fail("bad character")
+		}
+		c = (d.input[0]-'A')<<4 | (d.input[1] - 'A')
+		d.input = d.input[2:]
+		return c
+	case '0' <= c && c <= '9':
+		d.input = d.input[1:]
+		return ",/\\:. \n\t'-"[c-'0']
+	case 'a' <= c && c <= 'z':
+		d.input = d.input[1:]
+		return 0xe1 + c - 'a'
+	case 'A' <= c && c <= 'Z':
+		d.input = d.input[1:]
+		return 0xc1 + c - 'A'
+	}
+	fail("bad character")
+	return 0
+}
+
+func isRebasedHexDigit(c byte) bool {
+	return 'A' <= c && c <= 'P'
+}
+
+// guessCharWidth guesses how wide the characters of a narrow string
+// literal of size bytes are from its first bytes: by its terminating
+// null if they're all there, or else by how many nulls there are.
+func guessCharWidth(bytes []byte, size uint64) int {
+	if size%2 == 1 {
+		return 1
+	}
+	if size < 32 {
+		trailing := 0
+		for i := len(bytes) - 1; i >= 0 && bytes[i] == 0; i-- {
+			trailing++
+		}
+		switch {
+		case trailing >= 4 && size%4 == 0:
+			return 4
+		case trailing >= 2:
+			return 2
+		}
+		return 1
+	}
+	nulls := 0
+	for _, b := range bytes {
+		if b == 0 {
+			nulls++
+		}
+	}
+	switch {
+	case nulls >= 2*len(bytes)/3 && size%4 == 0:
+		return 4
+	case nulls >= len(bytes)/3:
+		return 2
+	}
+	return 1
+}
+
+var msCharEscapes = map[uint32]string{
+	0:    `\0`,
+	'\'': `\'`,
+	'"':  `\"`,
+	'\\': `\\`,
+	'\a': `\a`,
+	'\b': `\b`,
+	'\f': `\f`,
+	'\n': `\n`,
+	'\r': `\r`,
+	'\t': `\t`,
+	'\v': `\v`,
+}
+
+func printEscapedChar(p *msPrinter, c uint32) {
+	if e, ok := msCharEscapes[c]; ok {
+		p.s(e)
+		return
+	}
+	if c > 0x1f && c < 0x7f {
+		p.s(string(rune(c)))
+		return
+	}
+	// Whole bytes of hex.
+	hex := strings.ToUpper(strconv.FormatUint(uint64(c), 16))
+	if len(hex)%2 == 1 {
+		hex = "0" + hex
+	}
+	p.s(`\x` + hex)
+}
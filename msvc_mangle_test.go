@@ -0,0 +1,117 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// msvcSymbols reads the fixture of MSVC symbols and their demanglings.
+func msvcSymbols(tb testing.TB) [][2]string {
+	f, err := os.Open("testdata/msvc_symbols.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	var syms [][2]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			tb.Fatalf("bad fixture line %q", line)
+		}
+		syms = append(syms, [2]string{fields[0], fields[1]})
+	}
+	if err := s.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return syms
+}
+
+func TestMSVCDemangle(t *testing.T) {
+	d := NewMSVCDemangler()
+	for _, sym := range msvcSymbols(t) {
+		got, err := d.Demangle(sym[0])
+		if err != nil {
+			t.Errorf("%s: %s", sym[0], err)
+			continue
+		}
+		if got != sym[1] {
+			t.Errorf("%s:\n got %s\nwant %s", sym[0], got, sym[1])
+		}
+	}
+}
+
+func TestMSVCDemangleErrors(t *testing.T) {
+	d := NewMSVCDemangler()
+	// Back references double the name with each template.
+	deep := "?$A@H@"
+	for i := 0; i < 40; i++ {
+		deep = "?$A@V" + deep + "@V1@V1@@"
+	}
+	for _, name := range []string{"?", "?f", "?f@@", "?f@@YAX", "?f@@YAXH", "?f@@YAXH@", "?f@@YAX0@Z", "?f@@YAXV2@@Z",
+		"?f@@3", "??_7A@@", "??BA@@3HA", "??_C@_0", ".?AVA@", "?x@@3V" + deep + "@A"} {
+		if got, err := d.Demangle(name); err == nil {
+			t.Errorf("%.40s: got %q, want an error", name, got)
+		}
+	}
+
+	// Names that aren't mangled pass through.
+	for _, name := range []string{"", "main", "_Z1fv", "malloc"} {
+		if got, err := d.Demangle(name); err != nil || got != name {
+			t.Errorf("%q: got %q, %v", name, got, err)
+		}
+	}
+}
+
+// undname returns llvm-undname's demangling of name, and whether it
+// could demangle it.
+func undname(name string) (string, bool) {
+	out, err := exec.Command("llvm-undname", name).Output()
+	lines := strings.Split(string(out), "\n")
+	if err != nil || len(lines) < 2 || lines[1] == "" {
+		return "", false
+	}
+	return lines[1], true
+}
+
+// FuzzMSVCDemangle checks that the demangler doesn't panic, and that it
+// agrees with llvm-undname whenever both of them can demangle a name.
+// llvm-undname accepts some malformed names that we reject, so those
+// aren't counted as divergences.
+func FuzzMSVCDemangle(f *testing.F) {
+	for _, sym := range msvcSymbols(f) {
+		f.Add(sym[0])
+	}
+	_, err := exec.LookPath("llvm-undname")
+	canUndname := err == nil
+	f.Fuzz(func(t *testing.T, name string) {
+		got, err := demangleMSVC(name)
+		if err != nil || !canUndname || strings.ContainsAny(name, "\x00\n") {
+			return
+		}
+		if want, ok := undname(name); ok && got != want {
+			t.Errorf("%q:\n got %s\nwant %s", name, got, want)
+		}
+	})
+}
@@ -17,15 +17,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type Stats struct {
-	InuseObjects, InuseBytes, AllocObjects, AllocBytes int
+	InuseObjects int `json:"inuse_objects"`
+	InuseBytes   int `json:"inuse_space"`
+	AllocObjects int `json:"alloc_objects"`
+	AllocBytes   int `json:"alloc_space"`
 }
 
 func (s *Stats) Add(other *Stats) {
@@ -35,6 +40,74 @@ func (s *Stats) Add(other *Stats) {
 	s.AllocBytes += other.AllocBytes
 }
 
+func (s *Stats) Sub(other *Stats) {
+	s.InuseObjects -= other.InuseObjects
+	s.InuseBytes -= other.InuseBytes
+	s.AllocObjects -= other.AllocObjects
+	s.AllocBytes -= other.AllocBytes
+}
+
+// Which of a stack's Stats to measure functions by.
+type metric int
+
+const (
+	metricInuseBytes metric = iota
+	metricInuseObjects
+	metricAllocBytes
+	metricAllocObjects
+)
+
+var metrics = []metric{metricInuseBytes, metricInuseObjects, metricAllocBytes, metricAllocObjects}
+
+// The names pprof gives these.
+var metricNames = []string{"inuse_space", "inuse_objects", "alloc_space", "alloc_objects"}
+
+func (m metric) String() string {
+	return metricNames[m]
+}
+
+func parseMetric(s string) (metric, error) {
+	for _, m := range metrics {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("bad metric %q; want one of %s", s, strings.Join(metricNames, ", "))
+}
+
+func (s *Stats) Get(m metric) int {
+	switch m {
+	case metricInuseObjects:
+		return s.InuseObjects
+	case metricAllocBytes:
+		return s.AllocBytes
+	case metricAllocObjects:
+		return s.AllocObjects
+	}
+	return s.InuseBytes
+}
+
+// Unit is how many of m's units hp counts as one in display: a kilobyte
+// of bytes, or a single object.
+func (m metric) Unit() int {
+	if m == metricInuseBytes || m == metricAllocBytes {
+		return 1024
+	}
+	return 1
+}
+
+// Format writes n of m for display, with a sign if signed is set.
+func (m metric) Format(n int, signed bool) string {
+	format := "%d"
+	if signed {
+		format = "%+d"
+	}
+	if m.Unit() == 1024 {
+		format += "k"
+	}
+	return fmt.Sprintf(format, n/m.Unit())
+}
+
 type Stack struct {
 	Stats *Stats
 	Stack []uint64
@@ -42,6 +115,7 @@ type Stack struct {
 
 type MapEntry struct {
 	start, end uint64
+	offset     uint64
 	path       string
 }
 
@@ -64,6 +138,9 @@ type Profile struct {
 	Header *Stats
 	stacks []*Stack
 	maps   Maps
+
+	// Symbols embedded in the profile by "hp symbolize", if any.
+	syms *Symbols
 }
 
 func mustReadLine(r *bufio.Reader) ([]byte, error) {
@@ -101,13 +178,20 @@ func ParseHeap(r *bufio.Reader) *Profile {
 	line, err := mustReadLine(r)
 	check(err)
 
+	var syms *Symbols
+	if bytes.Equal(line, symbolSection) {
+		syms = readSymbolSection(r)
+		line, err = mustReadLine(r)
+		check(err)
+	}
+
 	headerPrefix := []byte("heap profile:")
 	if !bytes.HasPrefix(line, headerPrefix) {
 		panic("bad header" + string(line))
 	}
 	line = line[len(headerPrefix):]
 
-	profile := &Profile{}
+	profile := &Profile{syms: syms}
 
 	header, _ := parseStats(line)
 	profile.Header = header
@@ -125,8 +209,9 @@ func ParseHeap(r *bufio.Reader) *Profile {
 		}
 		stats, rest := parseStats(line)
 
-		// XXX filter here
-		if stats.InuseBytes == 0 {
+		// Stacks whose memory was all freed still count towards the
+		// alloc_* metrics.
+		if *stats == (Stats{}) {
 			continue
 		}
 
@@ -161,9 +246,10 @@ func ParseHeap(r *bufio.Reader) *Profile {
 		}
 		start := parseAddr(match[1])
 		end := parseAddr(match[2])
+		offset := parseAddr(match[4])
 		file := string(match[6])
 
-		entry := &MapEntry{start, end, file}
+		entry := &MapEntry{start, end, offset, file}
 		profile.maps = append(profile.maps, entry)
 	}
 
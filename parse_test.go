@@ -0,0 +1,56 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const heapProfile = `heap profile:    2:     3000 [    4:     5000] @ heapprofile
+     1:     1000 [     1:     1000] @ 0x1010 0x1000
+     1:     2000 [     1:     2000] @ 0x1020 0x1000
+     0:        0 [     2:     2000] @ 0x1030 0x1000
+     0:        0 [     0:        0] @ 0x1040 0x1000
+
+MAPPED_LIBRARIES:
+00001000-00002000 r-xp 00000000 08:01 1234       /bin/app
+`
+
+func TestParseHeap(t *testing.T) {
+	p := ParseHeap(bufio.NewReader(strings.NewReader(heapProfile)))
+	if want := (Stats{InuseObjects: 2, InuseBytes: 3000, AllocObjects: 4, AllocBytes: 5000}); *p.Header != want {
+		t.Errorf("header %+v, want %+v", *p.Header, want)
+	}
+	// The freed stack still counts for alloc_*, but the empty one is
+	// dropped.
+	var got [][]uint64
+	var total Stats
+	for _, stack := range p.stacks {
+		got = append(got, stack.Stack)
+		total.Add(stack.Stats)
+	}
+	if want := [][]uint64{{0x1010, 0x1000}, {0x1020, 0x1000}, {0x1030, 0x1000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stacks %x, want %x", got, want)
+	}
+	if total != *p.Header {
+		t.Errorf("stacks total %+v, want the header's %+v", total, *p.Header)
+	}
+	if len(p.maps) != 1 || p.maps[0].path != "/bin/app" {
+		t.Errorf("maps %+v", p.maps)
+	}
+}
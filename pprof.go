@@ -0,0 +1,293 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// This file exports profiles, symbolized, as the gzipped profile.proto
+// messages that pprof and tools like it read.  The few messages needed
+// are encoded by hand rather than pulling in a protobuf library; field
+// numbers are those of
+// https://github.com/google/pprof/blob/main/proto/profile.proto.
+
+// protoBuffer accumulates a protobuf message.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// uint64 writes x as field, unless it's the default of 0.
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x != 0 {
+		b.key(field, wireVarint)
+		b.varint(x)
+	}
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bool(field int, x bool) {
+	if x {
+		b.uint64(field, 1)
+	}
+}
+
+// string writes s as field, even if it's empty, as string tables need.
+func (b *protoBuffer) string(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	if len(xs) == 0 {
+		return
+	}
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.key(field, wireBytes)
+	b.varint(uint64(len(p.data)))
+	b.data = append(b.data, p.data...)
+}
+
+// message writes the message encode makes as field.
+func (b *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.key(field, wireBytes)
+	b.varint(uint64(len(m.data)))
+	b.data = append(b.data, m.data...)
+}
+
+// Field numbers in profile.proto.
+const (
+	// Profile.
+	pprofSampleType        = 1
+	pprofSample            = 2
+	pprofMapping           = 3
+	pprofLocation          = 4
+	pprofFunction          = 5
+	pprofStringTable       = 6
+	pprofDefaultSampleType = 14
+
+	// ValueType.
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	// Sample.
+	pprofSampleLocation = 1
+	pprofSampleValue    = 2
+
+	// Mapping.
+	pprofMappingID           = 1
+	pprofMappingStart        = 2
+	pprofMappingLimit        = 3
+	pprofMappingOffset       = 4
+	pprofMappingFilename     = 5
+	pprofMappingHasFunctions = 7
+	pprofMappingHasFilenames = 8
+
+	// Location.
+	pprofLocationID      = 1
+	pprofLocationMapping = 2
+	pprofLocationAddress = 3
+	pprofLocationLine    = 4
+
+	// Line.
+	pprofLineFunction = 1
+	pprofLineLine     = 2
+
+	// Function.
+	pprofFunctionID         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+	pprofFunctionFilename   = 4
+	pprofFunctionStartLine  = 5
+)
+
+// fullName is the demangled name of the function named name, with
+// nothing simplified.
+func (s *state) fullName(name string) string {
+	name, clones := splitCloneSuffix(name)
+	name, _ = s.demangler.Demangle(name)
+	for _, clone := range clones {
+		name += " [clone " + clone + "]"
+	}
+	return name
+}
+
+// Pprof encodes the profile's stacks, after CleanupStacks, as a
+// profile.proto message, with a sample value for each metric.  Every
+// function's address is a location, with the function's demangled name
+// and, where the symbols know it, source file.
+func (s *state) Pprof() []byte {
+	strs := map[string]int64{"": 0}
+	strTable := []string{""}
+	str := func(x string) int64 {
+		i, ok := strs[x]
+		if !ok {
+			i = int64(len(strTable))
+			strs[x] = i
+			strTable = append(strTable, x)
+		}
+		return i
+	}
+
+	var p protoBuffer
+	for _, m := range metrics {
+		unit := "count"
+		if m.Unit() != 1 {
+			unit = "bytes"
+		}
+		p.message(pprofSampleType, func(vt *protoBuffer) {
+			vt.int64(pprofValueTypeType, str(m.String()))
+			vt.int64(pprofValueTypeUnit, str(unit))
+		})
+	}
+
+	// Locations and functions, numbered from 1 as they're met.
+	locations := make(map[uint64]uint64)
+	var locationAddrs []uint64
+	for _, stack := range s.Profile.stacks {
+		ids := make([]uint64, len(stack.Stack))
+		for i, addr := range stack.Stack {
+			id, ok := locations[addr]
+			if !ok {
+				id = uint64(len(locationAddrs) + 1)
+				locations[addr] = id
+				locationAddrs = append(locationAddrs, addr)
+			}
+			ids[i] = id
+		}
+		values := make([]uint64, len(metrics))
+		for i, m := range metrics {
+			values[i] = uint64(stack.Stats.Get(m))
+		}
+		p.message(pprofSample, func(sample *protoBuffer) {
+			sample.packed(pprofSampleLocation, ids)
+			sample.packed(pprofSampleValue, values)
+		})
+	}
+
+	// Which mappings have functions whose source file is known.
+	filenames := make(map[*MapEntry]bool)
+	for _, addr := range locationAddrs {
+		if sym := s.syms.Lookup(addr); sym != nil && addr < inlineAddrBase && sym.file != "" {
+			filenames[s.Profile.maps.Search(addr)] = true
+		}
+	}
+
+	mappings := make(map[*MapEntry]uint64)
+	for i, e := range s.Profile.maps {
+		mappings[e] = uint64(i + 1)
+		p.message(pprofMapping, func(mapping *protoBuffer) {
+			mapping.uint64(pprofMappingID, uint64(i+1))
+			mapping.uint64(pprofMappingStart, e.start)
+			mapping.uint64(pprofMappingLimit, e.end)
+			mapping.uint64(pprofMappingOffset, e.offset)
+			mapping.int64(pprofMappingFilename, str(e.path))
+			// So that pprof doesn't try symbolizing again.
+			mapping.bool(pprofMappingHasFunctions, true)
+			mapping.bool(pprofMappingHasFilenames, filenames[e])
+		})
+	}
+
+	functions := make(map[string]uint64)
+	for i, addr := range locationAddrs {
+		name := s.names[addr]
+		var function uint64
+		if len(name) > 0 {
+			var ok bool
+			function, ok = functions[name]
+			if !ok {
+				function = uint64(len(functions) + 1)
+				functions[name] = function
+				var file string
+				var line int
+				if sym := s.syms.Lookup(addr); sym != nil && addr < inlineAddrBase {
+					file, line = sym.file, sym.line
+				}
+				p.message(pprofFunction, func(f *protoBuffer) {
+					f.uint64(pprofFunctionID, function)
+					f.int64(pprofFunctionName, str(s.fullName(name)))
+					f.int64(pprofFunctionSystemName, str(name))
+					f.int64(pprofFunctionFilename, str(file))
+					f.int64(pprofFunctionStartLine, int64(line))
+				})
+			}
+		}
+		p.message(pprofLocation, func(loc *protoBuffer) {
+			loc.uint64(pprofLocationID, uint64(i+1))
+			// Functions inlined here have made-up addresses.
+			if addr < inlineAddrBase {
+				if e := s.Profile.maps.Search(addr); e != nil {
+					loc.uint64(pprofLocationMapping, mappings[e])
+				}
+				loc.uint64(pprofLocationAddress, addr)
+			}
+			if function != 0 {
+				var lineno int
+				if sym := s.syms.Lookup(addr); sym != nil && addr < inlineAddrBase {
+					// Functions inlined at addr have locations of their
+					// own; this one is the call in the function itself.
+					lines := sym.Lines(addr)
+					lineno = lines[len(lines)-1].line
+				}
+				loc.message(pprofLocationLine, func(line *protoBuffer) {
+					line.uint64(pprofLineFunction, function)
+					line.int64(pprofLineLine, int64(lineno))
+				})
+			}
+		})
+	}
+
+	p.int64(pprofDefaultSampleType, str(s.Params.Metric.String()))
+	for _, x := range strTable {
+		p.string(pprofStringTable, x)
+	}
+	return p.data
+}
+
+// WritePprof writes the profile as a gzipped profile.proto.
+func (s *state) WritePprof(w io.Writer) error {
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(s.Pprof()); err != nil {
+		return err
+	}
+	return z.Close()
+}
@@ -0,0 +1,175 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// protoFields decodes a message into the varints and byte strings of
+// each of its fields.
+func protoFields(t *testing.T, data []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("bad key in %x", data)
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			x, n := binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("bad varint in %x", data)
+			}
+			fields[field] = append(fields[field], x)
+			data = data[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				t.Fatalf("bad length in %x", data)
+			}
+			fields[field] = append(fields[field], data[n:n+int(l)])
+			data = data[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+// packedVarints decodes a packed repeated field.
+func packedVarints(data []byte) []uint64 {
+	var xs []uint64
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		xs = append(xs, x)
+		data = data[n:]
+	}
+	return xs
+}
+
+func TestProtoBuffer(t *testing.T) {
+	var b protoBuffer
+	b.uint64(1, 150)
+	b.uint64(2, 0)
+	b.int64(3, -1)
+	b.string(4, "")
+	b.packed(5, []uint64{3, 270})
+	b.message(6, func(m *protoBuffer) { m.bool(1, true) })
+	want := []byte{
+		0x08, 0x96, 0x01,
+		0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+		0x22, 0x00,
+		0x2a, 0x03, 0x03, 0x8e, 0x02,
+		0x32, 0x02, 0x08, 0x01,
+	}
+	if !bytes.Equal(b.data, want) {
+		t.Errorf("got %x, want %x", b.data, want)
+	}
+}
+
+func TestWritePprof(t *testing.T) {
+	s := flameState("")
+	// Only the executable's symbols know their files.
+	s.syms = NewSymbols([]Symbol{
+		{addr: 0x1000, size: 0x100, name: "main", file: "main.cc", line: 3},
+		{addr: 0x7000, size: 0x100, name: "malloc"},
+	})
+	var out bytes.Buffer
+	if err := s.WritePprof(&out); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := protoFields(t, data)
+	var strs []string
+	for _, s := range p[pprofStringTable] {
+		strs = append(strs, string(s.([]byte)))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table %q doesn't start with \"\"", strs)
+	}
+	str := func(x interface{}) string { return strs[x.(uint64)] }
+
+	var types []string
+	for _, vt := range p[pprofSampleType] {
+		f := protoFields(t, vt.([]byte))
+		types = append(types, str(f[pprofValueTypeType][0])+"/"+str(f[pprofValueTypeUnit][0]))
+	}
+	if want := []string{"inuse_space/bytes", "inuse_objects/count", "alloc_space/bytes", "alloc_objects/count"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("sample types %v, want %v", types, want)
+	}
+	if got := str(p[pprofDefaultSampleType][0]); got != "inuse_space" {
+		t.Errorf("default sample type %q", got)
+	}
+
+	// Function names by id, and the names of each location's function.
+	functions := make(map[uint64]string)
+	for _, fn := range p[pprofFunction] {
+		f := protoFields(t, fn.([]byte))
+		functions[f[pprofFunctionID][0].(uint64)] = str(f[pprofFunctionName][0]) + " = " + str(f[pprofFunctionSystemName][0])
+	}
+	locations := make(map[uint64]string)
+	for _, loc := range p[pprofLocation] {
+		f := protoFields(t, loc.([]byte))
+		line := protoFields(t, f[pprofLocationLine][0].([]byte))
+		locations[f[pprofLocationID][0].(uint64)] = functions[line[pprofLineFunction][0].(uint64)]
+	}
+	if len(p[pprofMapping]) != 2 {
+		t.Errorf("%d mappings, want 2", len(p[pprofMapping]))
+	}
+	for _, m := range p[pprofMapping] {
+		f := protoFields(t, m.([]byte))
+		path := str(f[pprofMappingFilename][0])
+		if got, want := len(f[pprofMappingHasFilenames]) > 0, path == "/bin/app"; got != want {
+			t.Errorf("%s: has filenames %v, want %v", path, got, want)
+		}
+	}
+
+	var samples []string
+	for _, sample := range p[pprofSample] {
+		f := protoFields(t, sample.([]byte))
+		var frames []string
+		for _, id := range packedVarints(f[pprofSampleLocation][0].([]byte)) {
+			frames = append(frames, locations[id])
+		}
+		values := packedVarints(f[pprofSampleValue][0].([]byte))
+		samples = append(samples, fmt.Sprint(values, frames))
+	}
+	want := []string{
+		"[100 1 0 0] [malloc = malloc base::Widget::Run() = _ZN4base6Widget3RunEv main = main]",
+		"[200 1 0 0] [malloc = malloc parse(std::vector<int, std::allocator<int> > const&) = _Z5parseRKSt6vectorIiSaIiEE main = main]",
+		"[300 1 0 0] [malloc = malloc parse(std::vector<int, std::allocator<int> > const&) = _Z5parseRKSt6vectorIiSaIiEE main = main]",
+		"[400 1 0 0] [base::Widget::Run() = _ZN4base6Widget3RunEv main = main]",
+	}
+	if !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples\n%q\nwant\n%q", samples, want)
+	}
+}
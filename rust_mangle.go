@@ -0,0 +1,1052 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file implements rustc's two symbol manglings.  Legacy names
+// dress a path up as an Itanium C++ nested name whose last component is
+// a hash,
+//   _ZN4core3ptr13drop_in_place17h0123456789abcdefE
+// while v0 names, described at
+//   https://doc.rust-lang.org/rustc/symbol-mangling/v0.html
+// start with "_R" and encode generics, impls and types as well.  Both
+// are printed the way rustc-demangle prints them with "{:#}", which
+// leaves out hashes and crate disambiguators.
+
+// Demangled names longer than this are taken to be malicious;
+// rustc-demangle gives up at the same size.
+const rustMaxOutput = 1000000
+
+// Nesting deeper than this is taken to be malicious, as in
+// rustc-demangle.
+const rustMaxDepth = 500
+
+type RustDemangler struct{}
+
+func NewRustDemangler() *RustDemangler {
+	return &RustDemangler{}
+}
+
+func (r *RustDemangler) Demangle(name string) (string, error) {
+	sym := trimLLVMSuffix(name)
+	var out, suffix string
+	var err error
+	switch {
+	case strings.HasPrefix(sym, "_ZN"):
+		out, suffix, err = demangleRustLegacy(sym)
+	case strings.HasPrefix(sym, "_R"):
+		out, suffix, err = demangleRustV0(sym)
+	default:
+		// Nothing to demangle.
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("demangling '%s': %s", name, err)
+	}
+	if len(suffix) > 0 {
+		if suffix[0] != '.' || !isSymbolLike(suffix) {
+			return "", fmt.Errorf("demangling '%s': unexpected '%s'", name, suffix)
+		}
+		out += suffix
+	}
+	return out, nil
+}
+
+// isRustSymbol reports whether name was mangled by rustc.  Legacy names
+// are told apart from C++ ones by the hash that ends them.
+func isRustSymbol(name string) bool {
+	sym := trimLLVMSuffix(name)
+	if strings.HasPrefix(sym, "_R") {
+		return len(sym) > 2 && 'A' <= sym[2] && sym[2] <= 'Z'
+	}
+	if !strings.HasPrefix(sym, "_ZN") {
+		return false
+	}
+	elems, rest, ok := rustLegacyElements(sym[3:])
+	if !ok || len(elems) == 0 || (len(rest) > 0 && rest[0] != '.') {
+		return false
+	}
+	hash := elems[len(elems)-1]
+	if len(hash) != 17 || hash[0] != 'h' {
+		return false
+	}
+	for i := 1; i < len(hash); i++ {
+		if !isLowerHex(hash[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// trimLLVMSuffix removes the ".llvm.<hash>" LLVM appends to names it
+// promotes under ThinLTO.
+func trimLLVMSuffix(name string) string {
+	i := strings.Index(name, ".llvm.")
+	if i < 0 {
+		return name
+	}
+	for _, c := range name[i+len(".llvm."):] {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F' || c == '@') {
+			return name
+		}
+	}
+	return name[:i]
+}
+
+// isSymbolLike reports whether s is all ASCII letters, digits and
+// punctuation.
+func isSymbolLike(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// rustLegacyElements splits the length-prefixed components of a legacy
+// name, which follow its "_ZN", returning them and what follows the
+// "E" that ends them.
+func rustLegacyElements(inner string) (elems []string, rest string, ok bool) {
+	if !isASCII(inner) {
+		return nil, "", false
+	}
+	pos := 0
+	for {
+		if pos >= len(inner) {
+			return nil, "", false
+		}
+		if inner[pos] == 'E' {
+			return elems, inner[pos+1:], true
+		}
+		n := 0
+		start := pos
+		for pos < len(inner) && '0' <= inner[pos] && inner[pos] <= '9' {
+			if n > (len(inner)-int(inner[pos]-'0'))/10 {
+				return nil, "", false
+			}
+			n = n*10 + int(inner[pos]-'0')
+			pos++
+		}
+		// The "E" can't be part of the last component.
+		if pos == start || n >= len(inner)-pos {
+			return nil, "", false
+		}
+		elems = append(elems, inner[pos:pos+n])
+		pos += n
+	}
+}
+
+// Escapes for the characters legacy names can't contain.
+var rustLegacyEscapes = map[string]string{
+	"SP": "@",
+	"BP": "*",
+	"RF": "&",
+	"LT": "<",
+	"GT": ">",
+	"LP": "(",
+	"RP": ")",
+	"C":  ",",
+}
+
+func demangleRustLegacy(sym string) (out, suffix string, err error) {
+	elems, rest, ok := rustLegacyElements(sym[3:])
+	if !ok {
+		return "", "", demangleError("bad legacy Rust name")
+	}
+	var b strings.Builder
+	for i, elem := range elems {
+		if i == len(elems)-1 && isRustHash(elem) {
+			break
+		}
+		if i > 0 {
+			b.WriteString("::")
+		}
+		if strings.HasPrefix(elem, "_$") {
+			elem = elem[1:]
+		}
+		b.WriteString(unescapeRustLegacy(elem))
+	}
+	return b.String(), rest, nil
+}
+
+func isRustHash(s string) bool {
+	if len(s) == 0 || s[0] != 'h' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// unescapeRustLegacy turns a component's "$LT$"-style escapes and ".."
+// back into what they stand for.  Past an escape it doesn't know, the
+// rest of the component is printed as is.
+func unescapeRustLegacy(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			if strings.HasPrefix(s, "..") {
+				b.WriteString("::")
+				s = s[2:]
+			} else {
+				b.WriteByte('.')
+				s = s[1:]
+			}
+			continue
+		case '$':
+			end := strings.IndexByte(s[1:], '$')
+			if end < 0 {
+				b.WriteString(s)
+				return b.String()
+			}
+			escape := s[1 : end+1]
+			if r, ok := rustLegacyEscapes[escape]; ok {
+				b.WriteString(r)
+				s = s[end+2:]
+				continue
+			}
+			if c, ok := rustLegacyCodePoint(escape); ok {
+				b.WriteRune(c)
+				s = s[end+2:]
+				continue
+			}
+			b.WriteString(s)
+			return b.String()
+		}
+		i := strings.IndexAny(s, "$.")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+	}
+	return b.String()
+}
+
+// rustLegacyCodePoint decodes a "u7e"-style escape.
+func rustLegacyCodePoint(escape string) (rune, bool) {
+	if len(escape) < 2 || escape[0] != 'u' {
+		return 0, false
+	}
+	for i := 1; i < len(escape); i++ {
+		if !isLowerHex(escape[i]) {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseUint(escape[1:], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(v)) || unicode.IsControl(rune(v)) {
+		return 0, false
+	}
+	return rune(v), true
+}
+
+func demangleRustV0(sym string) (out, suffix string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(demangleError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	inner := sym[2:]
+	if len(inner) == 0 || inner[0] < 'A' || inner[0] > 'Z' {
+		fail("expected path")
+	}
+	if !isASCII(inner) {
+		fail("non-ASCII name")
+	}
+	d := &rustDemangler{input: inner, out: &strings.Builder{}}
+	d.path(true)
+	// The crate the generic was instantiated in.
+	if 'A' <= d.peek() && d.peek() <= 'Z' {
+		d.skipping(func() { d.path(false) })
+	}
+	return d.out.String(), inner[d.pos:], nil
+}
+
+// rustDemangler parses and prints a v0 name in one go, as its
+// back references refer to positions in the input, not to parsed
+// components.
+type rustDemangler struct {
+	input string
+	pos   int
+	depth int
+	// Where output goes; nil while skipping the parts that aren't
+	// printed.
+	out *strings.Builder
+	// How many lifetimes the binders around us introduced.
+	boundLifetimes uint64
+}
+
+func (d *rustDemangler) peek() byte {
+	if d.pos < len(d.input) {
+		return d.input[d.pos]
+	}
+	return 0
+}
+
+func (d *rustDemangler) next() byte {
+	c := d.peek()
+	if c == 0 {
+		fail("unexpected end of input")
+	}
+	d.pos++
+	return c
+}
+
+func (d *rustDemangler) eat(c byte) bool {
+	if d.peek() == c && c != 0 {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *rustDemangler) print(s string) {
+	if d.out == nil {
+		return
+	}
+	d.out.WriteString(s)
+	if d.out.Len() > rustMaxOutput {
+		fail("output too long")
+	}
+}
+
+func (d *rustDemangler) push() {
+	d.depth++
+	if d.depth > rustMaxDepth {
+		fail("nested too deeply")
+	}
+}
+
+func (d *rustDemangler) pop() {
+	d.depth--
+}
+
+// skipping parses without printing.
+func (d *rustDemangler) skipping(f func()) {
+	out := d.out
+	d.out = nil
+	f()
+	d.out = out
+}
+
+// integer62 parses a base-62 number, in which "_" is 0 and a number
+// followed by "_" is one more than its value.
+func (d *rustDemangler) integer62() uint64 {
+	if d.eat('_') {
+		return 0
+	}
+	var x uint64
+	for !d.eat('_') {
+		c := d.next()
+		var v uint64
+		switch {
+		case '0' <= c && c <= '9':
+			v = uint64(c - '0')
+		case 'a' <= c && c <= 'z':
+			v = uint64(c-'a') + 10
+		case 'A' <= c && c <= 'Z':
+			v = uint64(c-'A') + 36
+		default:
+			fail("bad base-62 number")
+		}
+		if x > (1<<64-1-v)/62 {
+			fail("number too large")
+		}
+		x = x*62 + v
+	}
+	if x == 1<<64-1 {
+		fail("number too large")
+	}
+	return x + 1
+}
+
+// optInteger62 parses a base-62 number introduced by tag, returning
+// 0 if there's no tag and the number plus one if there is.
+func (d *rustDemangler) optInteger62(tag byte) uint64 {
+	if !d.eat(tag) {
+		return 0
+	}
+	x := d.integer62()
+	if x == 1<<64-1 {
+		fail("number too large")
+	}
+	return x + 1
+}
+
+func (d *rustDemangler) disambiguator() uint64 {
+	return d.optInteger62('s')
+}
+
+// hexNibbles parses the lowercase hex digits of a constant, up to the
+// "_" that ends them.
+func (d *rustDemangler) hexNibbles() string {
+	start := d.pos
+	for {
+		c := d.next()
+		if c == '_' {
+			return d.input[start : d.pos-1]
+		}
+		if !isLowerHex(c) {
+			fail("bad hex digit")
+		}
+	}
+}
+
+// A rustIdent is an identifier, which may be Punycode-encoded.
+type rustIdent struct {
+	ascii, punycode string
+}
+
+func (d *rustDemangler) ident() rustIdent {
+	isPunycode := d.eat('u')
+	c := d.next()
+	if c < '0' || c > '9' {
+		fail("expected identifier length")
+	}
+	n := int(c - '0')
+	if n != 0 {
+		for '0' <= d.peek() && d.peek() <= '9' {
+			if n > (len(d.input)-int(d.peek()-'0'))/10 {
+				fail("bad identifier length")
+			}
+			n = n*10 + int(d.next()-'0')
+		}
+	}
+	// Separates the length from an identifier starting with a digit
+	// or "_".
+	d.eat('_')
+	if n > len(d.input)-d.pos {
+		fail("bad identifier length")
+	}
+	id := d.input[d.pos : d.pos+n]
+	d.pos += n
+	if !isPunycode {
+		return rustIdent{ascii: id}
+	}
+	var ident rustIdent
+	if i := strings.LastIndexByte(id, '_'); i >= 0 {
+		ident = rustIdent{ascii: id[:i], punycode: id[i+1:]}
+	} else {
+		ident = rustIdent{punycode: id}
+	}
+	if len(ident.punycode) == 0 {
+		fail("empty Punycode")
+	}
+	return ident
+}
+
+func (id rustIdent) empty() bool {
+	return len(id.ascii) == 0 && len(id.punycode) == 0
+}
+
+// Identifiers decoding to more characters than this are printed in
+// their encoded form, as rustc-demangle does.
+const rustMaxPunycode = 128
+
+func (id rustIdent) String() string {
+	if len(id.punycode) == 0 {
+		return id.ascii
+	}
+	if s, ok := decodePunycode(id.ascii, id.punycode); ok {
+		return s
+	}
+	if len(id.ascii) > 0 {
+		return "punycode{" + id.ascii + "-" + id.punycode + "}"
+	}
+	return "punycode{" + id.punycode + "}"
+}
+
+// decodePunycode decodes RFC 3492 Punycode, whose basic code points
+// are ascii and whose deltas are encoded in punycode.
+func decodePunycode(ascii, punycode string) (string, bool) {
+	const (
+		base = 36
+		tMin = 1
+		tMax = 26
+		skew = 38
+	)
+	out := []rune(ascii)
+	if len(out) > rustMaxPunycode {
+		return "", false
+	}
+	damp, bias := 700, 72
+	i, n := 0, 0x80
+	for pos := 0; ; {
+		delta, w := 0, 1
+		for k := base; ; k += base {
+			t := k - bias
+			if t < tMin {
+				t = tMin
+			} else if t > tMax {
+				t = tMax
+			}
+			if pos >= len(punycode) {
+				return "", false
+			}
+			c := punycode[pos]
+			pos++
+			var digit int
+			switch {
+			case 'a' <= c && c <= 'z':
+				digit = int(c - 'a')
+			case '0' <= c && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", false
+			}
+			if digit > (utf8.MaxRune*(rustMaxPunycode+1)-delta)/w {
+				return "", false
+			}
+			delta += digit * w
+			if digit < t {
+				break
+			}
+			w *= base - t
+		}
+
+		i += delta
+		n += i / (len(out) + 1)
+		i %= len(out) + 1
+		if n > utf8.MaxRune || !utf8.ValidRune(rune(n)) || len(out) == rustMaxPunycode {
+			return "", false
+		}
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+		if pos == len(punycode) {
+			return string(out), true
+		}
+
+		delta /= damp
+		damp = 2
+		delta += delta / len(out)
+		k := 0
+		for delta > (base-tMin)*tMax/2 {
+			delta /= base - tMin
+			k += base
+		}
+		bias = k + (base-tMin+1)*delta/(delta+skew)
+	}
+}
+
+// backref follows a back reference to an earlier position in the
+// input, calling f to print what's there.  Back references aren't
+// followed while skipping, so skipping can't blow up.
+func (d *rustDemangler) backref(f func()) {
+	start := d.pos - 1
+	i := d.integer62()
+	if i >= uint64(start) {
+		fail("bad back reference")
+	}
+	if d.out == nil {
+		return
+	}
+	pos := d.pos
+	d.pos = int(i)
+	d.push()
+	f()
+	d.pop()
+	d.pos = pos
+}
+
+// list prints what f prints up to an "E", separated by sep, and
+// returns how many there were.
+func (d *rustDemangler) list(f func(), sep string) int {
+	n := 0
+	for !d.eat('E') {
+		if n > 0 {
+			d.print(sep)
+		}
+		f()
+		n++
+	}
+	return n
+}
+
+// path prints a path.  inValue is set for paths in expressions, where
+// generic arguments need a "::" before them.
+func (d *rustDemangler) path(inValue bool) {
+	d.push()
+	switch tag := d.next(); tag {
+	case 'C':
+		// Crate root.
+		d.disambiguator()
+		d.print(d.ident().String())
+	case 'N':
+		ns := d.next()
+		if !('A' <= ns && ns <= 'Z' || 'a' <= ns && ns <= 'z') {
+			fail("bad namespace")
+		}
+		d.path(inValue)
+		dis := d.disambiguator()
+		name := d.ident()
+		switch {
+		case 'A' <= ns && ns <= 'Z':
+			// Closures, shims and the like.
+			d.print("::{")
+			switch ns {
+			case 'C':
+				d.print("closure")
+			case 'S':
+				d.print("shim")
+			default:
+				d.print(string(ns))
+			}
+			if !name.empty() {
+				d.print(":" + name.String())
+			}
+			d.print("#" + strconv.FormatUint(dis, 10) + "}")
+		case !name.empty():
+			d.print("::" + name.String())
+		}
+	case 'M', 'X', 'Y':
+		// Inherent impl, trait impl and trait definition.
+		if tag != 'Y' {
+			// The impl's own path isn't printed.
+			d.disambiguator()
+			d.skipping(func() { d.path(false) })
+		}
+		d.print("<")
+		d.typ()
+		if tag != 'M' {
+			d.print(" as ")
+			d.path(false)
+		}
+		d.print(">")
+	case 'I':
+		d.path(inValue)
+		if inValue {
+			d.print("::")
+		}
+		d.print("<")
+		d.list(d.genericArg, ", ")
+		d.print(">")
+	case 'B':
+		d.backref(func() { d.path(inValue) })
+	default:
+		fail("bad path")
+	}
+	d.pop()
+}
+
+func (d *rustDemangler) genericArg() {
+	switch {
+	case d.eat('L'):
+		d.lifetime(d.integer62())
+	case d.eat('K'):
+		d.constant(false)
+	default:
+		d.typ()
+	}
+}
+
+// lifetime prints the lifetime bound lt binders out, or "'_" for an
+// erased one.  The innermost bound lifetime is 'a.
+func (d *rustDemangler) lifetime(lt uint64) {
+	if d.out == nil {
+		// Binders aren't tracked while skipping.
+		return
+	}
+	if lt == 0 {
+		d.print("'_")
+		return
+	}
+	if lt > d.boundLifetimes {
+		fail("unbound lifetime")
+	}
+	depth := d.boundLifetimes - lt
+	if depth < 26 {
+		d.print("'" + string(rune('a'+depth)))
+	} else {
+		d.print("'_" + strconv.FormatUint(depth, 10))
+	}
+}
+
+// binder prints the "for<'a, ...> " that introduces higher-ranked
+// lifetimes, then what f prints in their scope.
+func (d *rustDemangler) binder(f func()) {
+	n := d.optInteger62('G')
+	if d.out == nil {
+		f()
+		return
+	}
+	if n > 0 {
+		d.print("for<")
+		for i := uint64(0); i < n; i++ {
+			if i > 0 {
+				d.print(", ")
+			}
+			d.boundLifetimes++
+			d.lifetime(1)
+		}
+		d.print("> ")
+	}
+	f()
+	d.boundLifetimes -= n
+}
+
+var rustBasicTypes = map[byte]string{
+	'b': "bool",
+	'c': "char",
+	'e': "str",
+	'u': "()",
+	'a': "i8",
+	's': "i16",
+	'l': "i32",
+	'x': "i64",
+	'n': "i128",
+	'i': "isize",
+	'h': "u8",
+	't': "u16",
+	'm': "u32",
+	'y': "u64",
+	'o': "u128",
+	'j': "usize",
+	'f': "f32",
+	'd': "f64",
+	'z': "!",
+	'p': "_",
+	'v': "...",
+}
+
+func (d *rustDemangler) typ() {
+	tag := d.next()
+	if t, ok := rustBasicTypes[tag]; ok {
+		d.print(t)
+		return
+	}
+	d.push()
+	switch tag {
+	case 'R', 'Q':
+		d.print("&")
+		if d.eat('L') {
+			if lt := d.integer62(); lt != 0 {
+				d.lifetime(lt)
+				d.print(" ")
+			}
+		}
+		if tag == 'Q' {
+			d.print("mut ")
+		}
+		d.typ()
+	case 'P':
+		d.print("*const ")
+		d.typ()
+	case 'O':
+		d.print("*mut ")
+		d.typ()
+	case 'A', 'S':
+		d.print("[")
+		d.typ()
+		if tag == 'A' {
+			d.print("; ")
+			d.constant(true)
+		}
+		d.print("]")
+	case 'T':
+		d.print("(")
+		if d.list(d.typ, ", ") == 1 {
+			d.print(",")
+		}
+		d.print(")")
+	case 'F':
+		d.binder(d.fnSig)
+	case 'D':
+		d.print("dyn ")
+		d.binder(func() { d.list(d.dynTrait, " + ") })
+		if !d.eat('L') {
+			fail("expected lifetime")
+		}
+		if lt := d.integer62(); lt != 0 {
+			d.print(" + ")
+			d.lifetime(lt)
+		}
+	case 'B':
+		d.backref(d.typ)
+	default:
+		// Any other type is named by a path.
+		d.pos--
+		d.path(false)
+	}
+	d.pop()
+}
+
+func (d *rustDemangler) fnSig() {
+	unsafe := d.eat('U')
+	abi := ""
+	if d.eat('K') {
+		if d.eat('C') {
+			abi = "C"
+		} else {
+			id := d.ident()
+			if len(id.ascii) == 0 || len(id.punycode) > 0 {
+				fail("bad ABI")
+			}
+			// "-" is mangled as "_".
+			abi = strings.Replace(id.ascii, "_", "-", -1)
+		}
+	}
+	if unsafe {
+		d.print("unsafe ")
+	}
+	if abi != "" {
+		d.print("extern \"" + abi + "\" ")
+	}
+	d.print("fn(")
+	d.list(d.typ, ", ")
+	d.print(")")
+	// A () result isn't printed.
+	if !d.eat('u') {
+		d.print(" -> ")
+		d.typ()
+	}
+}
+
+func (d *rustDemangler) dynTrait() {
+	open := d.pathMaybeOpenGenerics()
+	for d.eat('p') {
+		if !open {
+			d.print("<")
+			open = true
+		} else {
+			d.print(", ")
+		}
+		d.print(d.ident().String() + " = ")
+		d.typ()
+	}
+	if open {
+		d.print(">")
+	}
+}
+
+// pathMaybeOpenGenerics prints a trait's path, leaving its generic
+// arguments open for associated type bindings to follow.  It reports
+// whether it left them open.
+func (d *rustDemangler) pathMaybeOpenGenerics() bool {
+	switch {
+	case d.eat('B'):
+		open := false
+		d.backref(func() { open = d.pathMaybeOpenGenerics() })
+		return open
+	case d.eat('I'):
+		d.path(false)
+		d.print("<")
+		d.list(d.genericArg, ", ")
+		return true
+	}
+	d.path(false)
+	return false
+}
+
+// constant prints a constant.  Outside of an expression, anything but
+// a literal is put in braces.
+func (d *rustDemangler) constant(inValue bool) {
+	tag := d.next()
+	d.push()
+	braced := false
+	openBrace := func() {
+		if !inValue {
+			braced = true
+			d.print("{")
+		}
+	}
+	switch tag {
+	case 'p':
+		d.print("_")
+	case 'h', 't', 'm', 'y', 'o', 'j':
+		d.constUint()
+	case 'a', 's', 'l', 'x', 'n', 'i':
+		if d.eat('n') {
+			d.print("-")
+		}
+		d.constUint()
+	case 'b':
+		switch v, ok := parseHexUint(d.hexNibbles()); {
+		case ok && v == 0:
+			d.print("false")
+		case ok && v == 1:
+			d.print("true")
+		default:
+			fail("bad bool")
+		}
+	case 'c':
+		v, ok := parseHexUint(d.hexNibbles())
+		if !ok || v > utf8.MaxRune || !utf8.ValidRune(rune(v)) {
+			fail("bad char")
+		}
+		d.print(quoteRust('\'', []rune{rune(v)}))
+	case 'e':
+		// A string literal is a &str, so the str is *"...".
+		openBrace()
+		d.print("*")
+		d.strLiteral()
+	case 'R', 'Q':
+		if tag == 'R' && d.eat('e') {
+			d.strLiteral()
+			break
+		}
+		openBrace()
+		d.print("&")
+		if tag == 'Q' {
+			d.print("mut ")
+		}
+		d.constant(true)
+	case 'A':
+		openBrace()
+		d.print("[")
+		d.list(func() { d.constant(true) }, ", ")
+		d.print("]")
+	case 'T':
+		openBrace()
+		d.print("(")
+		if d.list(func() { d.constant(true) }, ", ") == 1 {
+			d.print(",")
+		}
+		d.print(")")
+	case 'V':
+		// A value of a struct or enum variant.
+		openBrace()
+		d.path(true)
+		switch d.next() {
+		case 'U':
+		case 'T':
+			d.print("(")
+			d.list(func() { d.constant(true) }, ", ")
+			d.print(")")
+		case 'S':
+			d.print(" { ")
+			d.list(func() {
+				d.disambiguator()
+				d.print(d.ident().String() + ": ")
+				d.constant(true)
+			}, ", ")
+			d.print(" }")
+		default:
+			fail("bad constant fields")
+		}
+	case 'B':
+		d.backref(func() { d.constant(inValue) })
+	default:
+		fail("bad constant")
+	}
+	if braced {
+		d.print("}")
+	}
+	d.pop()
+}
+
+// constUint prints an integer constant, in hex if it doesn't fit in
+// 64 bits.
+func (d *rustDemangler) constUint() {
+	hex := d.hexNibbles()
+	if v, ok := parseHexUint(hex); ok {
+		d.print(strconv.FormatUint(v, 10))
+	} else {
+		d.print("0x" + hex)
+	}
+}
+
+func parseHexUint(hex string) (uint64, bool) {
+	hex = strings.TrimLeft(hex, "0")
+	if len(hex) > 16 {
+		return 0, false
+	}
+	if hex == "" {
+		return 0, true
+	}
+	v, err := strconv.ParseUint(hex, 16, 64)
+	return v, err == nil
+}
+
+// strLiteral prints a string constant, which is mangled as the hex of
+// its UTF-8.
+func (d *rustDemangler) strLiteral() {
+	hex := d.hexNibbles()
+	if len(hex)%2 != 0 {
+		fail("odd string length")
+	}
+	b := make([]byte, len(hex)/2)
+	for i := range b {
+		v, _ := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		b[i] = byte(v)
+	}
+	if !utf8.Valid(b) {
+		fail("bad UTF-8 in string")
+	}
+	d.print(quoteRust('"', []rune(string(b))))
+}
+
+// quoteRust quotes chars as Rust's {:?} does.  The other kind of quote
+// doesn't need escaping.
+func quoteRust(quote rune, chars []rune) string {
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, c := range chars {
+		switch {
+		case c == '\'' || c == '"':
+			if c == quote {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString(`\0`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\\':
+			b.WriteString(`\\`)
+		case unicode.In(c, unicode.Mn, unicode.Me, unicode.Other_Grapheme_Extend) || !unicode.IsPrint(c):
+			b.WriteString(`\u{` + strconv.FormatInt(int64(c), 16) + `}`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteRune(quote)
+	return b.String()
+}
@@ -0,0 +1,92 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Expected output is what rustc-demangle prints with "{:#}".
+var rustDemangleTests = []struct{ in, out string }{
+	{"_ZN3std2rt10lang_start17h0123456789abcdefE",
+		"std::rt::lang_start"},
+	{"_ZN3std2rt10lang_start17h0123456789abcdefE.llvm.1234ABCD",
+		"std::rt::lang_start"},
+	{"_ZN4core3ptr85drop_in_place$LT$std..rt..lang_start$LT$$LP$$RP$$GT$..$u7b$$u7b$closure$u7d$$u7d$$GT$17h0123456789abcdefE",
+		"core::ptr::drop_in_place<std::rt::lang_start<()>::{{closure}}>"},
+	{"_ZN10hyper_util6client6legacy4pool17Pool$LT$T$C$K$GT$3new17h83a914faf883d7d5E",
+		"hyper_util::client::legacy::pool::Pool<T,K>::new"},
+	{"_RNvCs1234_7mycrate3foo",
+		"mycrate::foo"},
+	{"_RINvNtC3std3mem8align_ofjEC3foo",
+		"std::mem::align_of::<usize>"},
+	{"_RNCNvCs1_4test4main0B3_",
+		"test::main::{closure#0}"},
+	{"_RNvXs_NtCsj1THtJSy6pr_12regex_syntax3hirNtB4_3HirNtNtCs5GmCzIpY9Qj_4core3fmt5Debug3fmt",
+		"<regex_syntax::hir::Hir as core::fmt::Debug>::fmt"},
+	{"_RNvMC4testINtB2_3FooFG_RL0_hEuE3bar",
+		"<test::Foo<for<'a> fn(&'a u8)>>::bar"},
+	{"_RINvC1a1fKj5_KRe68656c6c6f_KVNtC1a1bSs_1xb1_EE",
+		"a::f::<5, \"hello\", {a::b { x: true }}>"},
+	{"_RINvC1a1hKc1f600_Kan1_E",
+		"a::h::<'😀', -1>"},
+	{"_RINvC1a1gDG_INtC1a2FnTRL0_hEEp6OutputuEL_E",
+		"a::g::<dyn for<'a> a::Fn<(&'a u8,), Output = ()>>"},
+	{"_RNvC4testu8gdel_5qa",
+		"test::gödel"},
+}
+
+func TestRustDemangle(t *testing.T) {
+	d := NewRustDemangler()
+	for _, test := range rustDemangleTests {
+		got, err := d.Demangle(test.in)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if got != test.out {
+			t.Errorf("%s:\n got %s\nwant %s", test.in, got, test.out)
+		}
+	}
+}
+
+func TestRustDemangleErrors(t *testing.T) {
+	d := NewRustDemangler()
+	deep := "_RINvC1a1f" + strings.Repeat("S", 600) + "uE"
+	for _, name := range []string{"_R", "_RNvC1a", "_RB_", "_RNvC1a1bjunk", "_RNvC1a1b$x", "_ZN3fooE3bar", deep} {
+		if got, err := d.Demangle(name); err == nil {
+			t.Errorf("%.40s: got %q, want an error", name, got)
+		}
+	}
+}
+
+func TestRemoveTypes(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{"std::vector<int, std::allocator<int> >::push_back(int&&)", "std::vector::push_back"},
+		{"std::basic_ostream<char, std::char_traits<char> >& std::operator<< <std::char_traits<char> >(std::basic_ostream<char, std::char_traits<char> >&, char const*)",
+			"std::basic_ostream& std::operator<< "},
+		{"bool std::operator<=>(int, int)", "bool std::operator"},
+		{"<regex_syntax::hir::Hir as core::fmt::Debug>::fmt", "regex_syntax::hir::Hir::fmt"},
+		{"std::mem::align_of::<usize>", "std::mem::align_of"},
+		{"<test::Foo<for<'a> fn(&'a u8)>>::bar", "test::Foo::bar"},
+		{"<alloc::vec::Vec<<I as core::iter::Iterator>::Item> as core::ops::Drop>::drop", "alloc::vec::Vec::drop"},
+		{"<<A as B>::C as D>::f", "A::C::f"},
+	} {
+		if got := RemoveTypes(test.in); got != test.out {
+			t.Errorf("%s:\n got %q\nwant %q", test.in, got, test.out)
+		}
+	}
+}
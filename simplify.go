@@ -0,0 +1,250 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// This file shortens demangled names for display.  Rewrite rules run on
+// a name first, then it's cut down to the chosen level of detail, from
+// its parse tree where the demangler gives one.  Rules files have a
+// rewrite per line,
+//   regexp => replacement
+// with $1 and the like in the replacement naming the regexp's groups.
+// Blank lines and lines starting with '#' are ignored.
+
+// How much of a demangled name to keep.
+type simplifyLevel int
+
+const (
+	// Everything, as in "std::vector<int>::push_back(int&&)".
+	simplifyFull simplifyLevel = iota
+	// No parameter lists, as in "std::vector<int>::push_back".
+	simplifyNoParams
+	// No parameter lists or template arguments, as in
+	// "std::vector::push_back".
+	simplifyNoTemplates
+)
+
+var simplifyLevels = []simplifyLevel{simplifyFull, simplifyNoParams, simplifyNoTemplates}
+
+var simplifyLevelNames = []string{"full", "noparams", "notemplates"}
+
+func (l simplifyLevel) String() string {
+	return simplifyLevelNames[l]
+}
+
+func parseSimplifyLevel(s string) (simplifyLevel, error) {
+	for _, l := range simplifyLevels {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("bad simplification level %q; want one of %s", s, strings.Join(simplifyLevelNames, ", "))
+}
+
+type rewriteRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// Rules hp always applies, before any from -rules.  They undo the
+// spelling out of typedefs that demanglers can't know about, where
+// template arguments are shown.
+var defaultRules = `
+std::__cxx11:: => std::
+std::__1:: => std::
+std::basic_string<char, std::char_traits<char>, std::allocator<char> ?> => std::string
+std::basic_string<wchar_t, std::char_traits<wchar_t>, std::allocator<wchar_t> ?> => std::wstring
+std::basic_(i|o|io)stream<char, std::char_traits<char> ?> => std::${1}stream
+std::basic_ostringstream<char, std::char_traits<char>, std::allocator<char> ?> => std::ostringstream
+`
+
+func parseRules(r io.Reader, file string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		// Look for " =>" followed by a space or the end of the line, so
+		// that the separator can't be confused with "operator<=>".
+		sep := -1
+		for i := 0; i+3 <= len(text); i++ {
+			if text[i:i+3] == " =>" && (i+3 == len(text) || text[i+3] == ' ') {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 {
+			return nil, fmt.Errorf("%s:%d: no ' => ' in rule", file, line)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(text[:sep]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line, err)
+		}
+		rules = append(rules, rewriteRule{re, strings.TrimSpace(text[sep+3:])})
+	}
+	return rules, s.Err()
+}
+
+// LoadRules returns the default rules followed by those in path, if any.
+func LoadRules(path string) ([]rewriteRule, error) {
+	rules, err := parseRules(strings.NewReader(defaultRules), "default rules")
+	check(err)
+	if len(path) == 0 {
+		return rules, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	more, err := parseRules(f, path)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, more...), nil
+}
+
+// Simplify rewrites a demangled name with rules and cuts it down to
+// level, for names there's no parse tree of.  Rewriting comes first, so
+// that rules can match template arguments that level leaves out.
+func Simplify(name string, level simplifyLevel, rules []rewriteRule) string {
+	name = Rewrite(name, rules)
+	if level >= simplifyNoParams {
+		name = RemoveParams(name)
+	}
+	if level >= simplifyNoTemplates {
+		name = removeTemplates(name)
+	}
+	return name
+}
+
+// Rewrite applies rules to name in turn.
+func Rewrite(name string, rules []rewriteRule) string {
+	for _, rule := range rules {
+		name = rule.re.ReplaceAllString(name, rule.repl)
+	}
+	return name
+}
+
+// Operators whose names contain brackets, longest first.
+var bracketOperators = []string{"<=>", "<<=", ">>=", "->*", "<<", ">>", "<=", ">=", "->", "()", "[]", "<", ">"}
+
+// Qualifiers that can follow a parameter list.
+var paramQualifiers_re *regexp.Regexp = regexp.MustCompile(`^(?: const| volatile| &&| &| noexcept)*`)
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// RemoveParams removes the parameter lists, and the qualifiers after
+// them, from a demangled name, leaving template arguments alone.
+func RemoveParams(name string) string {
+	var b strings.Builder
+	angles, braces := 0, 0
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if strings.HasPrefix(name[i:], "operator") && (i == 0 || !isIdentChar(name[i-1])) {
+			// The brackets in "operator<<" and "operator()" don't nest.
+			j := i + len("operator")
+			for _, op := range bracketOperators {
+				if strings.HasPrefix(name[j:], op) {
+					j += len(op)
+					break
+				}
+			}
+			b.WriteString(name[i:j])
+			i = j - 1
+			continue
+		}
+		switch c {
+		case '-':
+			// Rust's "fn() -> T" inside template arguments.
+			if strings.HasPrefix(name[i:], "->") {
+				b.WriteString("->")
+				i++
+				continue
+			}
+		case '<':
+			angles++
+		case '>':
+			angles--
+		case '{':
+			braces++
+		case '}':
+			braces--
+		case '(':
+			if angles != 0 || braces != 0 || strings.HasPrefix(name[i:], "(anonymous namespace)") {
+				break
+			}
+			depth := 0
+			j := i
+			for ; j < len(name); j++ {
+				if name[j] == '(' {
+					depth++
+				} else if name[j] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j == len(name) {
+				// Unbalanced; leave the rest be.
+				b.WriteString(name[i:])
+				return b.String()
+			}
+			j++
+			j += len(paramQualifiers_re.FindString(name[j:]))
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// wrapLabel breaks name into lines of about width characters, preferring
+// to break after "::", ", " or a space.
+func wrapLabel(name string, width int) []string {
+	var lines []string
+	for len(name) > width {
+		cut := -1
+		for _, sep := range []string{"::", ", ", " "} {
+			if i := strings.LastIndex(name[:width], sep); i > 0 {
+				cut = i + len(sep)
+				break
+			}
+		}
+		if cut < 0 {
+			cut = width
+			if cut > 1 && name[cut-1] == ':' && name[cut] == ':' {
+				cut--
+			}
+		}
+		lines = append(lines, name[:cut])
+		name = name[cut:]
+	}
+	return append(lines, name)
+}
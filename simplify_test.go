@@ -0,0 +1,114 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoveParams(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{"std::vector<int, std::allocator<int> >::push_back(int&&)", "std::vector<int, std::allocator<int> >::push_back"},
+		{"foo::bar(int) const &&", "foo::bar"},
+		{"bool std::operator<=>(int, int)", "bool std::operator<=>"},
+		{"std::ostream& std::operator<< <std::char_traits<char> >(std::ostream&, char const*)",
+			"std::ostream& std::operator<< <std::char_traits<char> >"},
+		{"A::operator()(int) const", "A::operator()"},
+		{"std::function<void (int)>::operator()(int) const", "std::function<void (int)>::operator()"},
+		{"(anonymous namespace)::f(int)", "(anonymous namespace)::f"},
+		{"f(int)::{lambda(int)#1}::operator()(int) const", "f::{lambda(int)#1}::operator()"},
+		{"<test::Foo<fn(u8) -> u8>>::bar", "<test::Foo<fn(u8) -> u8>>::bar"},
+		{"my_operator<int>(int)", "my_operator<int>"},
+		{"unbalanced(int", "unbalanced(int"},
+	} {
+		if got := RemoveParams(test.in); got != test.out {
+			t.Errorf("%s:\n got %q\nwant %q", test.in, got, test.out)
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, err := parseRules(strings.NewReader(`
+# Drop anonymous namespaces.
+\(anonymous namespace\)::  =>
+operator<=>\(int, int\) => spaceship($1)
+`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = append(rules, more...)
+
+	name := "std::map<std::__cxx11::basic_string<char, std::char_traits<char>, std::allocator<char> >, int>::find((anonymous namespace)::Key const&)"
+	for _, test := range []struct {
+		level simplifyLevel
+		out   string
+	}{
+		{simplifyFull, "std::map<std::string, int>::find(Key const&)"},
+		{simplifyNoParams, "std::map<std::string, int>::find"},
+		{simplifyNoTemplates, "std::map::find"},
+	} {
+		if got := Simplify(name, test.level, rules); got != test.out {
+			t.Errorf("%s:\n got %q\nwant %q", test.level, got, test.out)
+		}
+	}
+	// Rules matching template arguments apply before they're cut.
+	if got := Simplify("std::basic_string<char, std::char_traits<char>, std::allocator<char> >::size() const", simplifyNoTemplates, rules); got != "std::string::size" {
+		t.Errorf("got %q", got)
+	}
+	if got := Simplify("bool operator<=>(int, int)", simplifyFull, rules); got != "bool spaceship()" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, rules := range []string{"no separator", "a=>b", "(unclosed => x"} {
+		if _, err := parseRules(strings.NewReader(rules), "test"); err == nil {
+			t.Errorf("%q: want an error", rules)
+		}
+	}
+}
+
+func TestParseSimplifyLevel(t *testing.T) {
+	for _, l := range simplifyLevels {
+		if got, err := parseSimplifyLevel(l.String()); err != nil || got != l {
+			t.Errorf("%s: got %v, %v", l, got, err)
+		}
+	}
+	if _, err := parseSimplifyLevel("some"); err == nil {
+		t.Errorf("want an error for a bad level")
+	}
+}
+
+func TestWrapLabel(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		out []string
+	}{
+		{"short", []string{"short"}},
+		{"std::vector<int>::push_back", []string{"std::", "vector<int>", "::push_back"}},
+		{"std::map<int, long>", []string{"std::", "map<int, ", "long>"}},
+		{"abcdefghijklmnop", []string{"abcdefghijkl", "mnop"}},
+	} {
+		if got := wrapLabel(test.in, 12); !reflect.DeepEqual(got, test.out) {
+			t.Errorf("%s: got %q, want %q", test.in, got, test.out)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// This file writes the shown stacks as a speedscope file, of the
+// "sampled" kind described at
+// https://github.com/jlfwong/speedscope/wiki/Importing-from-custom-sources,
+// with a profile for each metric.
+
+type speedscopeFile struct {
+	Schema             string              `json:"$schema"`
+	Shared             speedscopeShared    `json:"shared"`
+	Profiles           []speedscopeProfile `json:"profiles"`
+	Name               string              `json:"name"`
+	ActiveProfileIndex int                 `json:"activeProfileIndex"`
+	Exporter           string              `json:"exporter"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+	// The library the function is in.
+	File string `json:"file,omitempty"`
+}
+
+type speedscopeProfile struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Unit       string `json:"unit"`
+	StartValue int    `json:"startValue"`
+	EndValue   int    `json:"endValue"`
+	// Stacks of indexes into the shared frames, outermost caller first.
+	Samples [][]int `json:"samples"`
+	Weights []int   `json:"weights"`
+}
+
+// Speedscope writes the shown stacks as a speedscope file called name,
+// opening on the s.Params.Metric profile.
+func (s *state) Speedscope(w io.Writer, name string) error {
+	file := speedscopeFile{
+		Schema:   "https://www.speedscope.app/file-format-schema.json",
+		Shared:   speedscopeShared{Frames: []speedscopeFrame{}},
+		Name:     name,
+		Exporter: "hp",
+	}
+
+	// Frames, and each stack's indexes into them.
+	frames := make(map[uint64]int)
+	stacks := make([][]int, len(s.stacks))
+	for i, stack := range s.stacks {
+		indexes := make([]int, len(stack.Stack))
+		for j, addr := range stack.Stack {
+			index, ok := frames[addr]
+			if !ok {
+				index = len(file.Shared.Frames)
+				frames[addr] = index
+				frame := speedscopeFrame{Name: s.addrLabel(addr)}
+				if e := s.Profile.maps.Search(addr); e != nil && addr < inlineAddrBase {
+					frame.File = e.path
+				}
+				file.Shared.Frames = append(file.Shared.Frames, frame)
+			}
+			indexes[len(indexes)-1-j] = index
+		}
+		stacks[i] = indexes
+	}
+
+	for _, m := range metrics {
+		p := speedscopeProfile{Type: "sampled", Name: m.String(), Unit: "none", Samples: [][]int{}, Weights: []int{}}
+		if m.Unit() != 1 {
+			p.Unit = "bytes"
+		}
+		for i, stack := range s.stacks {
+			if weight := stack.Stats.Get(m); weight > 0 {
+				p.Samples = append(p.Samples, stacks[i])
+				p.Weights = append(p.Weights, weight)
+				p.EndValue += weight
+			}
+		}
+		if m == s.Params.Metric {
+			file.ActiveProfileIndex = len(file.Profiles)
+		}
+		file.Profiles = append(file.Profiles, p)
+	}
+	return json.NewEncoder(w).Encode(file)
+}
@@ -0,0 +1,79 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpeedscope(t *testing.T) {
+	s := flameState("")
+	s.Params.Metric = metricInuseObjects
+	var out bytes.Buffer
+	if err := s.Speedscope(&out, "heap.prof"); err != nil {
+		t.Fatal(err)
+	}
+	var file speedscopeFile
+	if err := json.Unmarshal(out.Bytes(), &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Schema != "https://www.speedscope.app/file-format-schema.json" || file.Name != "heap.prof" {
+		t.Errorf("file %+v", file)
+	}
+
+	var stacks []string
+	for _, sample := range file.Profiles[0].Samples {
+		var names []string
+		for _, i := range sample {
+			f := file.Shared.Frames[i]
+			names = append(names, f.Name+"@"+f.File)
+		}
+		stacks = append(stacks, strings.Join(names, ";"))
+	}
+	want := []string{
+		"main@/bin/app;base::Widget::Run@/bin/app;malloc@/lib/libc.so.6",
+		"main@/bin/app;parse@/bin/app;malloc@/lib/libc.so.6",
+		"main@/bin/app;parse@/bin/app;malloc@/lib/libc.so.6",
+		"main@/bin/app;base::Widget::Run@/bin/app",
+	}
+	if !reflect.DeepEqual(stacks, want) {
+		t.Errorf("stacks\n%q\nwant\n%q", stacks, want)
+	}
+
+	var profiles []string
+	for _, p := range file.Profiles {
+		profiles = append(profiles, strings.Join([]string{p.Type, p.Name, p.Unit}, " "))
+		if !reflect.DeepEqual(p.Samples, file.Profiles[0].Samples) && len(p.Samples) != 0 {
+			t.Errorf("%s: samples %v", p.Name, p.Samples)
+		}
+	}
+	if want := []string{"sampled inuse_space bytes", "sampled inuse_objects none", "sampled alloc_space bytes", "sampled alloc_objects none"}; !reflect.DeepEqual(profiles, want) {
+		t.Errorf("profiles %v, want %v", profiles, want)
+	}
+	if p := file.Profiles[0]; !reflect.DeepEqual(p.Weights, []int{100, 200, 300, 400}) || p.EndValue != 1000 {
+		t.Errorf("inuse_space weights %v, end %d", p.Weights, p.EndValue)
+	}
+	// The stacks have no allocations, so those profiles are empty.
+	if p := file.Profiles[2]; len(p.Samples) != 0 || len(p.Weights) != 0 || p.EndValue != 0 {
+		t.Errorf("alloc_space profile %+v", p)
+	}
+	if file.ActiveProfileIndex != 1 {
+		t.Errorf("active profile %d, want inuse_objects'", file.ActiveProfileIndex)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// This file implements "hp symbolize", which writes a profile with its
+// symbols embedded in a section like the one pprof uses:
+//   --- symbol
+//   binary=/path/to/binary
+//   0x0000000000401200+0x34 _ZN3foo3barEv
+//   0x0000000000401234 _ZN3foo3bazEv--_ZN3foo3barEv
+//   0x0000000000401235+0x1b _ZN3foo3barEv
+//   ---
+//   --- heap
+//   heap profile: ...
+// Each function the profile's stacks pass through is written as address
+// ranges, "start+size", covering all of it.  Addresses with functions
+// inlined at them get a line, and a byte, of their own, listing those
+// functions before the one they were inlined into, separated by "--".
+
+var symbolSection = []byte("--- symbol")
+
+// staticInlined is the inlining recorded for one address in a symbol
+// section.
+type staticInlined []string
+
+func (s staticInlined) Inlined(pc uint64) []string {
+	return s[:len(s):len(s)]
+}
+
+// readSymbolSection reads the body of a symbol section, up to and
+// including the header line of the profile section that follows it.
+func readSymbolSection(r *bufio.Reader) *Symbols {
+	var syms []Symbol
+	for {
+		line, err := mustReadLine(r)
+		check(err)
+		if bytes.Equal(line, []byte("---")) {
+			break
+		}
+		if bytes.HasPrefix(line, []byte("binary=")) || len(line) == 0 {
+			continue
+		}
+		fields := strings.SplitN(string(line), " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "0x") {
+			panic("bad symbol line '" + string(line) + "'")
+		}
+		names := strings.Split(fields[1], "--")
+		sym := Symbol{size: 1, name: names[len(names)-1]}
+		addr, size, sized := strings.Cut(fields[0][2:], "+")
+		sym.addr = parseAddr([]byte(addr))
+		if sized {
+			if !strings.HasPrefix(size, "0x") {
+				panic("bad symbol line '" + string(line) + "'")
+			}
+			sym.size = parseAddr([]byte(size[2:]))
+		}
+		if len(names) > 1 {
+			sym.inl = staticInlined(names[:len(names)-1])
+		}
+		syms = append(syms, sym)
+	}
+
+	line, err := mustReadLine(r)
+	check(err)
+	if !bytes.HasPrefix(line, []byte("--- ")) {
+		panic("expected profile section after symbols, got '" + string(line) + "'")
+	}
+
+	return NewSymbols(syms)
+}
+
+// WriteSymbolized writes the raw profile text, prefixed by a symbol
+// section naming every address in the profile's stacks.  It fails,
+// writing nothing, if syms has none of them.
+func WriteSymbolized(w io.Writer, binary string, profile *Profile, syms *Symbols, raw []byte) error {
+	seen := make(map[uint64]bool)
+	var addrs []uint64
+	for _, stack := range profile.stacks {
+		for _, addr := range stack.Stack {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	// The symbols found, in address order, and the addresses within
+	// each that have functions inlined at them.
+	var found []int
+	inlined := make(map[int][]uint64)
+	symbolized := 0
+	for _, addr := range addrs {
+		i := syms.Find(addr)
+		if i < 0 {
+			continue
+		}
+		symbolized++
+		if _, seen := inlined[i]; !seen {
+			found = append(found, i)
+			inlined[i] = nil
+		}
+		if len(syms.At(i).Inlined(addr)) > 0 {
+			inlined[i] = append(inlined[i], addr)
+		}
+	}
+	sort.Ints(found)
+	if symbolized == 0 {
+		return fmt.Errorf("none of the profile's %d addresses are in the symbols", len(addrs))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\n", symbolSection)
+	fmt.Fprintf(bw, "binary=%s\n", binary)
+	for _, i := range found {
+		sym := syms.At(i)
+		start := sym.addr
+		writeRange := func(end uint64) {
+			if end > start {
+				fmt.Fprintf(bw, "0x%016x+0x%x %s\n", start, end-start, sym.name)
+			}
+		}
+		for _, addr := range inlined[i] {
+			writeRange(addr)
+			names := append(sym.Inlined(addr), sym.name)
+			fmt.Fprintf(bw, "0x%016x %s\n", addr, strings.Join(names, "--"))
+			start = addr + 1
+		}
+		writeRange(sym.addr + sym.size)
+	}
+	fmt.Fprintf(bw, "---\n")
+	fmt.Fprintf(bw, "--- heap\n")
+	if _, err := bw.Write(raw); err != nil {
+		return err
+	}
+	log.Printf("symbolized %d of %d addresses", symbolized, len(addrs))
+	return bw.Flush()
+}
+
+// symbolizeMain implements "hp symbolize binary [library...] profile".
+func symbolizeMain(args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s symbolize binary [library...] profile", os.Args[0])
+	}
+	binaries, profilePath := args[:len(args)-1], args[len(args)-1]
+
+	raw, err := os.ReadFile(profilePath)
+	check(err)
+	if bytes.HasPrefix(raw, symbolSection) {
+		log.Fatalf("%s is already symbolized", profilePath)
+	}
+	profile := ParseHeap(bufio.NewReader(bytes.NewReader(raw)))
+
+	var sets []*Symbols
+	for _, path := range binaries {
+		log.Printf("reading symbols from %s", path)
+		sets = append(sets, LoadSymsRelocated(path, profile.maps))
+	}
+	if len(*flag_syms) > 0 {
+		mapSyms, err := loadSymsFlag()
+		if err != nil {
+			log.Fatalf("reading symbol map: %s", err)
+		}
+		sets = append(sets, mapSyms)
+	}
+	if len(*flag_breakpad) > 0 {
+		breakpadSyms, err := LoadBreakpadSyms(strings.Split(*flag_breakpad, ","), profile.maps)
+		if err != nil {
+			log.Fatalf("reading breakpad symbols: %s", err)
+		}
+		sets = append(sets, breakpadSyms)
+	}
+	if len(sets) == 0 {
+		log.Fatalf("usage: %s symbolize binary [library...] profile   (or -syms or -breakpad)", os.Args[0])
+	}
+
+	binary := ""
+	if len(binaries) > 0 {
+		binary = binaries[0]
+	}
+	if err := WriteSymbolized(os.Stdout, binary, profile, MergeSyms(sets...), raw); err != nil {
+		log.Fatalf("symbolizing %s: %s", profilePath, err)
+	}
+}
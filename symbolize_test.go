@@ -0,0 +1,97 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// pcInliner inlines the functions it maps a pc to.
+type pcInliner map[uint64][]string
+
+func (p pcInliner) Inlined(pc uint64) []string {
+	return p[pc]
+}
+
+func TestSymbolizedRoundTrip(t *testing.T) {
+	// Stacks hold return addresses, so the inlining is at the call.
+	inl := pcInliner{0x103f: {"inner", "outer"}}
+	syms := NewSymbols([]Symbol{
+		{addr: 0x1000, size: 0x100, name: "f", inl: inl},
+		{addr: 0x2000, size: 0x10, name: "g"},
+		{addr: 0x3000, size: 0x10, name: "unused"},
+	})
+	profile := &Profile{stacks: []*Stack{
+		{Stack: []uint64{0x1040, 0x2004}},
+		{Stack: []uint64{0x1080, 0x4000}},
+	}}
+	raw := []byte("heap profile: 1: 2 [3: 4] @ heapprofile\n")
+
+	var buf bytes.Buffer
+	if err := WriteSymbolized(&buf, "app", profile, syms, raw); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&buf)
+	if line, err := mustReadLine(r); err != nil || !bytes.Equal(line, symbolSection) {
+		t.Fatalf("got %q, %v; want the symbol section", line, err)
+	}
+	got := readSymbolSection(r)
+	if rest, _ := io.ReadAll(r); !bytes.Equal(rest, raw) {
+		t.Errorf("got profile %q, want %q", rest, raw)
+	}
+
+	for _, test := range []struct {
+		addr    uint64
+		name    string
+		inlined []string
+	}{
+		{0x1000, "f", nil},
+		{0x1040, "f", []string{"inner", "outer"}},
+		{0x1041, "f", nil},
+		// Not in the profile, but in a function that is.
+		{0x10ff, "f", nil},
+		{0x1100, "", nil},
+		{0x200f, "g", nil},
+		{0x2010, "", nil},
+		{0x3000, "", nil},
+	} {
+		sym := got.Lookup(test.addr)
+		if sym == nil {
+			if test.name != "" {
+				t.Errorf("%#x: no symbol, want %s", test.addr, test.name)
+			}
+			continue
+		}
+		if sym.name != test.name || !reflect.DeepEqual(sym.Inlined(test.addr), test.inlined) {
+			t.Errorf("%#x: got %s with %q inlined, want %s with %q", test.addr, sym.name, sym.Inlined(test.addr), test.name, test.inlined)
+		}
+	}
+}
+
+func TestSymbolizedNothingFound(t *testing.T) {
+	syms := NewSymbols([]Symbol{{addr: 0x1000, size: 0x10, name: "f"}})
+	profile := &Profile{stacks: []*Stack{{Stack: []uint64{0x4000}}}}
+	var buf bytes.Buffer
+	if err := WriteSymbolized(&buf, "app", profile, syms, nil); err == nil {
+		t.Errorf("want an error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q", buf.String())
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// This file persists symbol tables on disk with -symbol-cache, keyed by
+// the binary's build id, so that loading the symbols of a huge binary is
+// only slow once.  Files that don't check out are ignored, and the
+// symbols are read from the binary again.
+// The file holds the columns of a Symbols table as little-endian arrays:
+//   magic, then uint32 counts: symbols, files, name bytes, flags
+//   addrs [n]uint64, sizes [n]uint32, nameOffs [n]uint32, nameLens [n]uint32
+//   if flags&cacheHasFiles: fileIdx [n]uint32, lines [n]int32,
+//     then each file as a uint32 length and its bytes
+//   if flags&cacheHasGoInline: [n]byte, 1 where the pclntab has inlining,
+//     then the address of go:func.* as a uint64
+//   the interned names
+// Go inlining can't be stored, so it is reattached from the binary's
+// pclntab, without reading its symbol table.
+// Caching is opt-in as it leaves a file the size of the symbol table in
+// the user's cache directory for every binary looked at.
+
+var symbolCacheMagic = []byte("hpsyms3\n")
+
+const (
+	cacheHasFiles = 1 << iota
+	cacheHasGoInline
+)
+
+func symbolCachePath(buildID []byte) string {
+	if !*flag_symbol_cache || len(buildID) == 0 {
+		return ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hp", fmt.Sprintf("%x.syms", buildID))
+}
+
+func writeSymbolCache(syms *Symbols, buildID []byte) {
+	path := symbolCachePath(buildID)
+	if path == "" {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("not caching symbols: %s", err)
+		return
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "syms")
+	if err != nil {
+		log.Printf("not caching symbols: %s", err)
+		return
+	}
+	err = encodeSymbolCache(f, syms)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		log.Printf("not caching symbols: %s", err)
+		os.Remove(f.Name())
+		return
+	}
+	log.Printf("cached symbols in %s", path)
+}
+
+// encodeSymbolCache writes syms in the cache's format, failing if they
+// have inlining it can't restore.
+func encodeSymbolCache(out io.Writer, syms *Symbols) error {
+	var flags uint32
+	if syms.fileIdx != nil {
+		flags |= cacheHasFiles
+	}
+	var goInline []byte
+	var gofunc uint64
+	if syms.inls != nil {
+		flags |= cacheHasGoInline
+		goInline = make([]byte, syms.Len())
+		for i, inl := range syms.inls {
+			switch inl := inl.(type) {
+			case nil:
+			case *goInlineTable:
+				goInline[i] = 1
+				gofunc = inl.gofuncAddr
+			default:
+				return fmt.Errorf("can't cache inlining from %T", inl)
+			}
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	le := binary.LittleEndian
+	w.Write(symbolCacheMagic)
+	binary.Write(w, le, [4]uint32{uint32(syms.Len()), uint32(len(syms.files)), uint32(len(syms.names)), flags})
+	binary.Write(w, le, syms.addrs)
+	binary.Write(w, le, syms.sizes)
+	binary.Write(w, le, syms.nameOffs)
+	binary.Write(w, le, syms.nameLens)
+	if flags&cacheHasFiles != 0 {
+		binary.Write(w, le, syms.fileIdx)
+		binary.Write(w, le, syms.lines)
+		for _, file := range syms.files {
+			binary.Write(w, le, uint32(len(file)))
+			w.WriteString(file)
+		}
+	}
+	if flags&cacheHasGoInline != 0 {
+		w.Write(goInline)
+		binary.Write(w, le, gofunc)
+	}
+	w.WriteString(syms.names)
+	return w.Flush()
+}
+
+// readSymbolCache returns the cached symbols for f, or nil.
+func readSymbolCache(f *elf.File, buildID []byte) *Symbols {
+	path := symbolCachePath(buildID)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	syms, err := decodeSymbolCache(f, data)
+	if err != nil {
+		log.Printf("ignoring symbol cache %s: %s", path, err)
+		return nil
+	}
+	return syms
+}
+
+// decodeSymbolCache checks and decodes a cache file for f.
+func decodeSymbolCache(f *elf.File, data []byte) (*Symbols, error) {
+	if !bytes.HasPrefix(data, symbolCacheMagic) {
+		return nil, fmt.Errorf("bad magic")
+	}
+	r := bytes.NewReader(data[len(symbolCacheMagic):])
+	le := binary.LittleEndian
+
+	var header [4]uint32
+	if err := binary.Read(r, le, &header); err != nil {
+		return nil, err
+	}
+	n, nfiles, nnames, flags := int(header[0]), int(header[1]), int(header[2]), header[3]
+	if n > len(data) || nfiles > len(data) || nnames > len(data) {
+		return nil, fmt.Errorf("truncated")
+	}
+
+	s := &Symbols{
+		addrs:    make([]uint64, n),
+		sizes:    make([]uint32, n),
+		nameOffs: make([]uint32, n),
+		nameLens: make([]uint32, n),
+	}
+	for _, col := range []interface{}{s.addrs, s.sizes, s.nameOffs, s.nameLens} {
+		if err := binary.Read(r, le, col); err != nil {
+			return nil, err
+		}
+	}
+	if flags&cacheHasFiles != 0 {
+		s.fileIdx = make([]uint32, n)
+		s.lines = make([]int32, n)
+		if err := binary.Read(r, le, s.fileIdx); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, le, s.lines); err != nil {
+			return nil, err
+		}
+		for i := 0; i < nfiles; i++ {
+			var length uint32
+			if err := binary.Read(r, le, &length); err != nil {
+				return nil, err
+			}
+			if int(length) > r.Len() {
+				return nil, fmt.Errorf("truncated")
+			}
+			file := make([]byte, length)
+			io.ReadFull(r, file)
+			s.files = append(s.files, string(file))
+		}
+		for _, idx := range s.fileIdx {
+			if int(idx) > nfiles {
+				return nil, fmt.Errorf("file out of range")
+			}
+		}
+	} else if nfiles != 0 {
+		return nil, fmt.Errorf("files without file indexes")
+	}
+	if flags&cacheHasGoInline != 0 {
+		goInline := make([]byte, n)
+		if _, err := io.ReadFull(r, goInline); err != nil {
+			return nil, err
+		}
+		var gofunc uint64
+		if err := binary.Read(r, le, &gofunc); err != nil {
+			return nil, err
+		}
+		var inl inliner
+		if sect, text := f.Section(".gopclntab"), f.Section(".text"); sect != nil && text != nil {
+			pclntab, err := sect.Data()
+			if err != nil {
+				return nil, err
+			}
+			if t := newGoInlineTable(f, pclntab, text.Addr, gofunc); t != nil {
+				inl = t
+			}
+		}
+		if inl == nil {
+			return nil, fmt.Errorf("no Go inlining in the binary")
+		}
+		s.inls = make([]inliner, n)
+		for i, has := range goInline {
+			if has != 0 {
+				s.inls[i] = inl
+			}
+		}
+	}
+	if r.Len() != nnames {
+		return nil, fmt.Errorf("expected %d bytes of names, have %d", nnames, r.Len())
+	}
+	s.names = string(data[len(data)-nnames:])
+	for i := range s.nameOffs {
+		if uint64(s.nameOffs[i])+uint64(s.nameLens[i]) > uint64(nnames) {
+			return nil, fmt.Errorf("name out of range")
+		}
+		// Lookups binary search the addresses.
+		if i > 0 && s.addrs[i] < s.addrs[i-1] {
+			return nil, fmt.Errorf("addresses out of order")
+		}
+	}
+	return s, nil
+}
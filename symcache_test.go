@@ -0,0 +1,89 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func cacheTestSyms() *Symbols {
+	return NewSymbols([]Symbol{
+		{addr: 0x1000, size: 0x10, name: "main", file: "main.cc", line: 3},
+		{addr: 0x1010, size: 0x20, name: "_ZN4base6Widget3RunEv", file: "widget.cc", line: 12},
+		{addr: 0x1030, size: 0x8, name: "main"},
+	})
+}
+
+func encodeTestCache(t *testing.T, syms *Symbols) []byte {
+	var buf bytes.Buffer
+	if err := encodeSymbolCache(&buf, syms); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSymbolCacheRoundTrip(t *testing.T) {
+	for _, syms := range []*Symbols{cacheTestSyms(), NewSymbols([]Symbol{{addr: 0x2000, size: 4, name: "f"}}), NewSymbols(nil)} {
+		got, err := decodeSymbolCache(nil, encodeTestCache(t, syms))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Len() != syms.Len() {
+			t.Fatalf("got %d symbols, want %d", got.Len(), syms.Len())
+		}
+		for i := 0; i < syms.Len(); i++ {
+			if g, w := got.At(i), syms.At(i); !reflect.DeepEqual(g, w) {
+				t.Errorf("symbol %d: got %+v, want %+v", i, g, w)
+			}
+		}
+	}
+}
+
+func TestSymbolCacheCorrupt(t *testing.T) {
+	data := encodeTestCache(t, cacheTestSyms())
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeSymbolCache(nil, data[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: want an error", i)
+		}
+	}
+
+	// Offsets of the columns of the 3 symbols.
+	const n = 3
+	header := len(symbolCacheMagic)
+	addrs := header + 16
+	nameOffs := addrs + n*8 + n*4
+	fileIdx := nameOffs + n*4 + n*4
+	le := binary.LittleEndian
+	for _, test := range []struct {
+		what    string
+		corrupt func(data []byte)
+	}{
+		{"magic", func(data []byte) { data[0] = 'x' }},
+		{"symbol count", func(data []byte) { le.PutUint32(data[header:], 1<<30) }},
+		{"name offset", func(data []byte) { le.PutUint32(data[nameOffs+4:], 1<<20) }},
+		{"file index", func(data []byte) { le.PutUint32(data[fileIdx+4:], 3) }},
+		{"address order", func(data []byte) { le.PutUint64(data[addrs:], 0x9000) }},
+		{"flags", func(data []byte) { le.PutUint32(data[header+12:], 0) }},
+	} {
+		bad := append([]byte{}, data...)
+		test.corrupt(bad)
+		if _, err := decodeSymbolCache(nil, bad); err == nil {
+			t.Errorf("%s: want an error", test.what)
+		}
+	}
+}
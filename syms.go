@@ -15,109 +15,778 @@
 package main
 
 import (
+	"fmt"
+	"bytes"
+	"runtime"
 	"debug/elf"
+	"math"
 	"regexp"
 	"sort"
 	"strings"
 	"os"
 	"bufio"
 	"io"
+	"log"
+	"path/filepath"
 	"strconv"
 )
 
 type Symbol struct {
 	addr, size uint64
 	name       string
+
+	// Source position of the function, when the symbol source knows it.
+	file string
+	line int
+
+	// Inlining information, or nil.
+	inl inliner
+}
+
+// An inliner knows which functions were inlined at a pc.
+type inliner interface {
+	Inlined(pc uint64) []string
+}
+
+// biasedInliner adjusts pcs for an inliner of a relocated object.
+type biasedInliner struct {
+	inliner
+	bias uint64
 }
-type Symbols []*Symbol
 
-func (s Symbols) Len() int           { return len(s) }
-func (s Symbols) Less(i, j int) bool { return s[i].addr < s[j].addr }
-func (s Symbols) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (b biasedInliner) Inlined(pc uint64) []string {
+	return b.inliner.Inlined(pc - b.bias)
+}
 
-func stripDotted(name string) string {
-	// Sometimes symbols have suffixes like ".part.123" or ".isra.134".
-	// Strip it.
-	ofs := strings.Index(name, ".")
-	if ofs >= 0 {
-		return name[:ofs]
+func (b biasedInliner) Lines(pc uint64) []srcLine {
+	if l, ok := b.inliner.(liner); ok {
+		return l.Lines(pc - b.bias)
 	}
-	return name
+	return nil
+}
+
+// A srcLine is a position in the source, or the zero srcLine if unknown.
+type srcLine struct {
+	file string
+	line int
+}
+
+// A liner is an inliner that also knows the source position of a pc in
+// each function inlined there, innermost first, and then in the
+// function containing it.
+type liner interface {
+	Lines(pc uint64) []srcLine
 }
 
-func LoadSyms(path string) Symbols {
+// Symbols is a symbol table sorted by address.  Tables for large
+// binaries hold millions of symbols, so rather than a slice of Symbol
+// it is stored as parallel columns with every name interned into one
+// string, which keeps it compact and makes lookups touch little memory.
+// A nil *Symbols is an empty table.
+type Symbols struct {
+	addrs    []uint64
+	sizes    []uint32
+	nameOffs []uint32 // Name i is names[nameOffs[i]:][:nameLens[i]].
+	nameLens []uint32
+	names    string
+
+	// Optional columns, left nil when no symbol has the information.
+	fileIdx []uint32 // 1-based index into files, or 0.
+	files   []string
+	lines   []int32
+	inls    []inliner
+}
+
+// NewSymbols builds a table from symbols in any order.  It sorts list.
+func NewSymbols(list []Symbol) *Symbols {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].addr < list[j].addr })
+
+	s := &Symbols{
+		addrs:    make([]uint64, len(list)),
+		sizes:    make([]uint32, len(list)),
+		nameOffs: make([]uint32, len(list)),
+		nameLens: make([]uint32, len(list)),
+	}
+	var names strings.Builder
+	interned := make(map[string]uint32)
+	fileIdx := make(map[string]uint32)
+	for i := range list {
+		sym := &list[i]
+		s.addrs[i] = sym.addr
+		if sym.size > math.MaxUint32 {
+			s.sizes[i] = math.MaxUint32
+		} else {
+			s.sizes[i] = uint32(sym.size)
+		}
+
+		off, known := interned[sym.name]
+		if !known {
+			off = uint32(names.Len())
+			names.WriteString(sym.name)
+			interned[sym.name] = off
+		}
+		s.nameOffs[i] = off
+		s.nameLens[i] = uint32(len(sym.name))
+
+		if sym.file != "" || sym.line != 0 {
+			if s.fileIdx == nil {
+				s.fileIdx = make([]uint32, len(list))
+				s.lines = make([]int32, len(list))
+			}
+			if sym.file != "" {
+				idx, known := fileIdx[sym.file]
+				if !known {
+					s.files = append(s.files, sym.file)
+					idx = uint32(len(s.files))
+					fileIdx[sym.file] = idx
+				}
+				s.fileIdx[i] = idx
+			}
+			s.lines[i] = int32(sym.line)
+		}
+		if sym.inl != nil {
+			if s.inls == nil {
+				s.inls = make([]inliner, len(list))
+			}
+			s.inls[i] = sym.inl
+		}
+	}
+	s.names = names.String()
+	return s
+}
+
+func (s *Symbols) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.addrs)
+}
+
+// At returns a copy of the i'th symbol.
+func (s *Symbols) At(i int) *Symbol {
+	sym := &Symbol{
+		addr: s.addrs[i],
+		size: uint64(s.sizes[i]),
+		name: s.names[s.nameOffs[i]:][:s.nameLens[i]],
+	}
+	if s.fileIdx != nil {
+		if idx := s.fileIdx[i]; idx > 0 {
+			sym.file = s.files[idx-1]
+		}
+		sym.line = int(s.lines[i])
+	}
+	if s.inls != nil {
+		sym.inl = s.inls[i]
+	}
+	return sym
+}
+
+// Find returns the index of the symbol containing addr, or -1.
+func (s *Symbols) Find(addr uint64) int {
+	if s == nil {
+		return -1
+	}
+	i := sort.Search(len(s.addrs), func(i int) bool {
+		return s.addrs[i] > addr
+	})
+	if i > 0 && s.addrs[i-1]+uint64(s.sizes[i-1]) > addr {
+		return i - 1
+	}
+	return -1
+}
+
+func (s *Symbols) Lookup(addr uint64) *Symbol {
+	i := s.Find(addr)
+	if i < 0 {
+		return nil
+	}
+	return s.At(i)
+}
+
+// Relocate moves every symbol by bias.
+func (s *Symbols) Relocate(bias uint64) {
+	for i := range s.addrs {
+		s.addrs[i] += bias
+	}
+	for i, inl := range s.inls {
+		if inl != nil {
+			s.inls[i] = biasedInliner{inl, bias}
+		}
+	}
+}
+
+// Compilers split functions into fragments named after the parent plus
+// a suffix: GCC's ".cold", ".part.N", ".isra.N" and ".constprop.N", and
+// Clang's ".llvm.<hash>" for promoted locals under ThinLTO.  Several can
+// stack up, as in "foo.isra.0.cold".
+var re_clone_suffix *regexp.Regexp = regexp.MustCompile(`\.(cold|part|isra|constprop|llvm|lto_priv)(\.[0-9]+)?$`)
+
+// splitCloneSuffix splits a symbol name into the name of the function it
+// was split from and its clone suffixes, outermost first.  A bare
+// ".cold" could be part of a Go name like "foo.cold", so it's only split
+// from mangled C++ names, or from other clones as in "foo.isra.0.cold".
+func splitCloneSuffix(name string) (string, []string) {
+	numbered := func(loc []int) bool { return loc != nil && loc[0] > 0 && loc[4] >= 0 }
+	var suffixes []string
+	for {
+		loc := re_clone_suffix.FindStringSubmatchIndex(name)
+		if loc == nil || loc[0] == 0 {
+			return name, suffixes
+		}
+		if !numbered(loc) && !strings.HasPrefix(name, "_Z") && !numbered(re_clone_suffix.FindStringSubmatchIndex(name[:loc[0]])) {
+			return name, suffixes
+		}
+		suffixes = append([]string{name[loc[0]:]}, suffixes...)
+		name = name[:loc[0]]
+	}
+}
+
+// elfSymbolRank orders ELF symbols that share an address; lower is
+// better.  Global beats weak beats local, functions beat IFUNC resolvers
+// beat untyped labels beat data, and unversioned names beat versioned
+// ones.
+func elfSymbolRank(sym *elf.Symbol) [3]int {
+	var bind, typ, versioned int
+	switch elf.ST_BIND(sym.Info) {
+	case elf.STB_GLOBAL:
+		bind = 0
+	case elf.STB_WEAK:
+		bind = 1
+	default:
+		bind = 2
+	}
+	switch elf.ST_TYPE(sym.Info) {
+	case elf.STT_FUNC:
+		typ = 0
+	case elf.STT_GNU_IFUNC:
+		typ = 1
+	case elf.STT_NOTYPE:
+		typ = 2
+	case elf.STT_OBJECT:
+		typ = 3
+	default:
+		typ = 4
+	}
+	if sym.Version != "" || strings.Contains(sym.Name, "@") {
+		versioned = 1
+	}
+	return [3]int{bind, typ, versioned}
+}
+
+// betterElfSymbol reports whether a should be preferred over b as the
+// name for their shared address.  Ties go to the shortest (mangled) name,
+// then alphabetically, so the choice is deterministic.
+func betterElfSymbol(a, b *elf.Symbol) bool {
+	ra, rb := elfSymbolRank(a), elfSymbolRank(b)
+	if ra != rb {
+		for i := range ra {
+			if ra[i] != rb[i] {
+				return ra[i] < rb[i]
+			}
+		}
+	}
+	if len(a.Name) != len(b.Name) {
+		return len(a.Name) < len(b.Name)
+	}
+	return a.Name < b.Name
+}
+
+// usefulElfSymbol reports whether sym can name code addresses.
+// Zero-size symbols are kept only for code, as assembly often doesn't
+// bother to set sizes.
+func usefulElfSymbol(f *elf.File, sym *elf.Symbol) bool {
+	if sym.Value == 0 || sym.Name == "" || strings.HasPrefix(sym.Name, ".L") || sym.Name[0] == '$' {
+		return false
+	}
+	switch elf.ST_TYPE(sym.Info) {
+	case elf.STT_SECTION, elf.STT_FILE, elf.STT_TLS:
+		return false
+	}
+	if sym.Size > 0 {
+		return true
+	}
+	if sym.Section >= elf.SHN_LORESERVE || int(sym.Section) >= len(f.Sections) {
+		return false
+	}
+	return f.Sections[sym.Section].Flags&elf.SHF_EXECINSTR != 0
+}
+
+// resolveSectionSyms picks the best symbol at each address within one
+// section, and extends symbols without a size that no sized symbol
+// covers to the next symbol or the end of the section.
+func resolveSectionSyms(sect *elf.Section, elfsyms []*elf.Symbol) []Symbol {
+	// Aliases, local copies, IFUNC resolvers and versioned names often
+	// share an address, and Lookup would otherwise return an arbitrary
+	// one of them.
+	best := make(map[uint64]*elf.Symbol)
+	sizes := make(map[uint64]uint64)
+	for _, sym := range elfsyms {
+		if cur := best[sym.Value]; cur == nil || betterElfSymbol(sym, cur) {
+			best[sym.Value] = sym
+		}
+		if sym.Size > sizes[sym.Value] {
+			sizes[sym.Value] = sym.Size
+		}
+	}
+
+	list := make([]Symbol, 0, len(best))
+	for addr, sym := range best {
+		list = append(list, Symbol{addr: addr, size: sizes[addr], name: sym.Name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].addr < list[j].addr })
+
+	// Labels within a function, like the targets of jumps in assembly,
+	// would otherwise take over the rest of it.
+	kept := list[:0]
+	var end uint64
+	for _, sym := range list {
+		if sym.size == 0 && sym.addr < end {
+			continue
+		}
+		if sym.addr+sym.size > end {
+			end = sym.addr + sym.size
+		}
+		kept = append(kept, sym)
+	}
+	list = kept
+
+	for i := range list {
+		sym := &list[i]
+		if sym.size != 0 || sect == nil {
+			continue
+		}
+		limit := sect.Addr + sect.Size
+		if i+1 < len(list) && list[i+1].addr < limit {
+			limit = list[i+1].addr
+		}
+		sym.size = limit - sym.addr
+	}
+	return list
+}
+
+// readElfSymbols reads f's symbol table as f.Symbols does, but decoding
+// it in parallel, as in huge binaries it holds millions of symbols.
+func readElfSymbols(f *elf.File) ([]elf.Symbol, error) {
+	sect := f.SectionByType(elf.SHT_SYMTAB)
+	if sect == nil {
+		return nil, elf.ErrNoSymbols
+	}
+	data, err := sect.Data()
+	if err != nil {
+		return nil, err
+	}
+	if int(sect.Link) >= len(f.Sections) {
+		return nil, fmt.Errorf("symbol table's string table %d out of range", sect.Link)
+	}
+	strtab, err := f.Sections[sect.Link].Data()
+	if err != nil {
+		return nil, err
+	}
+	entSize := elf.Sym64Size
+	if f.Class == elf.ELFCLASS32 {
+		entSize = elf.Sym32Size
+	}
+	if len(data)%entSize != 0 {
+		return nil, fmt.Errorf("symbol table size %d isn't a multiple of %d", len(data), entSize)
+	}
+	if len(data) == 0 {
+		return nil, elf.ErrNoSymbols
+	}
+	// The first entry is the undefined symbol, which f.Symbols skips.
+	data = data[entSize:]
+	syms := make([]elf.Symbol, len(data)/entSize)
+
+	bo := f.ByteOrder
+	decode := func(lo, hi int) error {
+		for i := lo; i < hi; i++ {
+			ent := data[i*entSize:][:entSize]
+			sym := &syms[i]
+			var name uint32
+			if f.Class == elf.ELFCLASS32 {
+				name = bo.Uint32(ent[0:])
+				sym.Value = uint64(bo.Uint32(ent[4:]))
+				sym.Size = uint64(bo.Uint32(ent[8:]))
+				sym.Info, sym.Other = ent[12], ent[13]
+				sym.Section = elf.SectionIndex(bo.Uint16(ent[14:]))
+			} else {
+				name = bo.Uint32(ent[0:])
+				sym.Info, sym.Other = ent[4], ent[5]
+				sym.Section = elf.SectionIndex(bo.Uint16(ent[6:]))
+				sym.Value = bo.Uint64(ent[8:])
+				sym.Size = bo.Uint64(ent[16:])
+			}
+			if name != 0 {
+				if int(name) >= len(strtab) {
+					return fmt.Errorf("symbol %d's name out of range", i+1)
+				}
+				str := strtab[name:]
+				if end := bytes.IndexByte(str, 0); end >= 0 {
+					str = str[:end]
+				}
+				sym.Name = string(str)
+			}
+		}
+		return nil
+	}
+
+	chunks := runtime.GOMAXPROCS(0)
+	chunk := (len(syms) + chunks - 1) / chunks
+	errs := make(chan error, chunks)
+	for lo := 0; lo < len(syms); lo += chunk {
+		go func(lo, hi int) {
+			errs <- decode(lo, hi)
+		}(lo, min(lo+chunk, len(syms)))
+	}
+	for lo := 0; lo < len(syms); lo += chunk {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return syms, err
+}
+
+func LoadSyms(path string) *Symbols {
 	f, err := elf.Open(path)
 	check(err)
-	elfsyms, err := f.Symbols()
-	check(err)
-	f.Close()
+	defer f.Close()
+	return loadElfSyms(path, f)
+}
 
-	syms := make(Symbols, 0, len(elfsyms))
-	for _, sym := range elfsyms {
-		if sym.Value > 0 && sym.Size > 0 {
-			syms = append(syms, &Symbol{addr: sym.Value, size: sym.Size, name: stripDotted(sym.Name)})
+// loadElfSyms reads the symbols of f, the ELF file at path.
+func loadElfSyms(path string, f *elf.File) *Symbols {
+	buildID := elfBuildID(f)
+	if syms := readSymbolCache(f, buildID); syms != nil {
+		log.Printf("loaded %d syms for %s from cache", syms.Len(), path)
+		return syms
+	}
+
+	elfsyms, err := readElfSymbols(f)
+	if err == elf.ErrNoSymbols {
+		// Stripped; the dynamic symbols are better than nothing.
+		elfsyms, err = f.DynamicSymbols()
+	}
+	if err != elf.ErrNoSymbols {
+		check(err)
+	}
+
+	// Go binaries (including cgo ones) have a pclntab that describes
+	// their Go functions better than the ELF symbol table does.
+	goList := loadGoSyms(f, elfsyms)
+	if goList != nil {
+		log.Printf("loaded %d Go syms from pclntab", len(goList))
+	}
+	goSyms := NewSymbols(append([]Symbol{}, goList...))
+
+	// Resolve each section's symbols in parallel.
+	bySection := make(map[elf.SectionIndex][]*elf.Symbol)
+	for i := range elfsyms {
+		sym := &elfsyms[i]
+		if usefulElfSymbol(f, sym) && goSyms.Find(sym.Value) < 0 {
+			bySection[sym.Section] = append(bySection[sym.Section], sym)
+		}
+	}
+	results := make(chan []Symbol)
+	for idx, sectSyms := range bySection {
+		var sect *elf.Section
+		if idx < elf.SHN_LORESERVE && int(idx) < len(f.Sections) {
+			sect = f.Sections[idx]
 		}
+		go func(sect *elf.Section, sectSyms []*elf.Symbol) {
+			results <- resolveSectionSyms(sect, sectSyms)
+		}(sect, sectSyms)
 	}
-	sort.Sort(syms)
+	list := goList
+	for range bySection {
+		list = append(list, <-results...)
+	}
+
+	syms := NewSymbols(list)
+	writeSymbolCache(syms, buildID)
 	return syms
 }
 
-func LoadSymsMap(path string) Symbols {
+// A symsMapFormat is a format of symbol map files understood by
+// LoadSymsMap.
+type symsMapFormat int
+
+const (
+	// Guessed from the file, failing if it could be more than one.
+	symsMapAuto symsMapFormat = iota
+	// hp's own "hexaddr decimalsize name".
+	symsMapHp
+	// `nm -S --defined-only`: "hexaddr hexsize type name", with a
+	// "file:" line before each file's symbols when there are several.
+	symsMapNm
+	// Linux perf JIT map: "hexaddr hexsize name".
+	symsMapPerf
+)
+
+var symsMapFormatNames = []string{"auto", "hp", "nm", "perf"}
+
+func (f symsMapFormat) String() string {
+	return symsMapFormatNames[f]
+}
+
+func parseSymsMapFormat(s string) (symsMapFormat, error) {
+	for i, name := range symsMapFormatNames {
+		if name == s {
+			return symsMapFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("bad symbol map format %q; want one of %s", s, strings.Join(symsMapFormatNames, ", "))
+}
+
+var re_nm_line *regexp.Regexp = regexp.MustCompile(`^([0-9a-fA-F]+) (?:([0-9a-fA-F]+) )?[a-zA-Z?-] (.+)$`)
+var re_nm_file *regexp.Regexp = regexp.MustCompile(`^\S+:$`)
+var re_perf_map *regexp.Regexp = regexp.MustCompile(`(^|/)perf-\d+\.map$`)
+
+// detectSymsMapFormat works out the format of a symbol map from its path
+// and contents.  hp's format and perf maps only differ in the base of
+// their sizes, so unless some size has a hex digit, or the file is
+// named as perf names its maps, there's no telling them apart.
+func detectSymsMapFormat(path string, lines []string) (symsMapFormat, error) {
+	nm := false
+	hexSizes := false
+	for _, line := range lines {
+		if re_nm_file.MatchString(line) {
+			continue
+		}
+		if !re_nm_line.MatchString(line) {
+			nm = false
+			break
+		}
+		nm = true
+	}
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) > 1 && strings.ContainsAny(fields[1], "abcdefABCDEFx") {
+			hexSizes = true
+		}
+	}
+	switch {
+	case nm:
+		return symsMapNm, nil
+	case hexSizes || re_perf_map.MatchString(path):
+		return symsMapPerf, nil
+	}
+	return 0, fmt.Errorf("%s: can't tell whether sizes are decimal, as in hp's format, or hex, as in perf maps; set -syms-format", path)
+}
+
+func parseHex(str string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimPrefix(str, "0x"), 16, 64)
+}
+
+// LoadSymsMap reads symbols from a text file in the given format.
+func LoadSymsMap(path string, format symsMapFormat) (*Symbols, error) {
 	f, err := os.Open(path)
-	check(err)
-	r := bufio.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSymsMap(bufio.NewReader(f), path, format)
+}
 
-	var syms Symbols
+// ReadSymsMap reads symbols in the given format from r, which was read
+// from path.
+func ReadSymsMap(r *bufio.Reader, path string, format symsMapFormat) (*Symbols, error) {
+	var lines []string
 	for {
-		s, err := r.ReadSlice(' ')
+		line, err := r.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); len(line) > 0 {
+			lines = append(lines, line)
+		}
 		if err == io.EOF {
 			break
 		}
-		check(err)
-		addr := parseAddr(s[:len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		s, err = r.ReadSlice(' ')
-		check(err)
-		size, err := strconv.ParseUint(string(s[:len(s)-1]), 10, 64)
-		check(err)
+	if format == symsMapAuto {
+		var err error
+		format, err = detectSymsMapFormat(path, lines)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		name, err := r.ReadSlice('\n')
-		check(err)
+	var syms []Symbol
+	for _, line := range lines {
+		var addr, size uint64
+		var name string
+		var err, sizeErr error
+		switch format {
+		case symsMapNm:
+			if re_nm_file.MatchString(line) {
+				continue
+			}
+			match := re_nm_line.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("%s: bad nm line %q", path, line)
+			}
+			if match[2] == "" {
+				continue // No size; can't tell what it covers.
+			}
+			addr, err = parseHex(match[1])
+			size, sizeErr = parseHex(match[2])
+			name = match[3]
+		default:
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s: bad %s symbol map line %q", path, format, line)
+			}
+			addr, err = parseHex(fields[0])
+			if format == symsMapPerf {
+				size, sizeErr = parseHex(fields[1])
+			} else {
+				size, sizeErr = strconv.ParseUint(fields[1], 10, 64)
+			}
+			name = fields[2]
+		}
+		if err == nil {
+			err = sizeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad %s symbol map line %q: %s", path, format, line, err)
+		}
+		syms = append(syms, Symbol{addr: addr, size: size, name: name})
+	}
+	return NewSymbols(syms), nil
+}
 
-		syms = append(syms, &Symbol{addr, size, stripDotted(string(name[:len(name)-1]))})
+// LoadSymsRelocated loads the symbols of an ELF file and, if it is
+// position-independent, relocates them to where the profile's maps say
+// it was loaded.  The file is matched to its mapping by base name.
+func LoadSymsRelocated(path string, maps Maps) *Symbols {
+	f, err := elf.Open(path)
+	check(err)
+	defer f.Close()
+	syms := loadElfSyms(path, f)
+	if f.Type != elf.ET_DYN {
+		return syms
+	}
+
+	for _, e := range maps {
+		if filepath.Base(e.path) != filepath.Base(path) {
+			continue
+		}
+		for _, prog := range f.Progs {
+			if prog.Type != elf.PT_LOAD || e.offset < prog.Off || e.offset >= prog.Off+prog.Filesz {
+				continue
+			}
+			// The file offset that is mapped at e.start was linked at
+			// prog.Vaddr + (e.offset - prog.Off).
+			bias := e.start - (prog.Vaddr + e.offset - prog.Off)
+			log.Printf("relocating %s by 0x%x", path, bias)
+			syms.Relocate(bias)
+			return syms
+		}
 	}
+	log.Printf("warning: %s is position-independent but not in the profile's maps", path)
 	return syms
 }
 
-func (syms Symbols) Lookup(addr uint64) *Symbol {
-	i := sort.Search(len(syms), func(i int) bool {
-		return syms[i].addr > addr
-	})
-	if i < len(syms) && i > 0 {
-		sym := syms[i-1]
-		if sym.addr <= addr && sym.addr+uint64(sym.size) > addr {
-			return sym
+// MergeSyms combines symbols from multiple sources into one table.
+func MergeSyms(sets ...*Symbols) *Symbols {
+	var nonEmpty []*Symbols
+	total := 0
+	for _, set := range sets {
+		if set.Len() > 0 {
+			nonEmpty = append(nonEmpty, set)
+			total += set.Len()
 		}
 	}
-	return nil
+	switch len(nonEmpty) {
+	case 0:
+		return nil
+	case 1:
+		return nonEmpty[0]
+	}
+	list := make([]Symbol, 0, total)
+	for _, set := range nonEmpty {
+		for i := 0; i < set.Len(); i++ {
+			list = append(list, *set.At(i))
+		}
+	}
+	return NewSymbols(list)
 }
 
-func replaceAll(re *regexp.Regexp, str string) string {
+// elfBuildID returns the contents of the GNU build-id note, if any.
+func elfBuildID(f *elf.File) []byte {
+	sect := f.Section(".note.gnu.build-id")
+	if sect == nil {
+		return nil
+	}
+	data, err := sect.Data()
+	if err != nil || len(data) < 16 {
+		return nil
+	}
+	// Note layout: namesz, descsz, type, then the padded name and desc.
+	namesz := f.ByteOrder.Uint32(data[0:4])
+	descsz := f.ByteOrder.Uint32(data[4:8])
+	ofs := 12 + (namesz+3)&^3
+	if uint32(len(data)) < ofs+descsz {
+		return nil
+	}
+	return data[ofs : ofs+descsz]
+}
+
+// Inlined returns the names of the functions inlined at addr within the
+// symbol, innermost first.
+func (s *Symbol) Inlined(addr uint64) []string {
+	if s.inl == nil {
+		return nil
+	}
+	// Stacks hold return addresses, so look at the call instruction.
+	return s.inl.Inlined(addr - 1)
+}
+
+// Lines returns the source positions at addr, one for each function
+// Inlined returns and then one within the symbol itself.  Positions the
+// symbol source doesn't know are the zero srcLine.
+func (s *Symbol) Lines(addr uint64) []srcLine {
+	inlined := s.Inlined(addr)
+	if l, ok := s.inl.(liner); ok {
+		if lines := l.Lines(addr - 1); len(lines) == len(inlined)+1 {
+			return lines
+		}
+	}
+	return make([]srcLine, len(inlined)+1)
+}
+
+func replaceAll(re *regexp.Regexp, str, repl string) string {
 	for {
-		newstr := re.ReplaceAllString(str, "")
+		newstr := re.ReplaceAllString(str, repl)
 		if newstr == str {
 			return str
 		}
 		str = newstr
 	}
-	return str
 }
 
 var paren_re *regexp.Regexp = regexp.MustCompile(`\([^()]*\)`)
-var template_re *regexp.Regexp = regexp.MustCompile(`<[^<>]*>`)
+// Rust puts "::" before generic arguments in expressions.
+var template_re *regexp.Regexp = regexp.MustCompile(`([^<])(::)?<[^<>]*>`)
+// Rust qualifies paths with the type they're for, as in
+// "<Foo as core::fmt::Debug>::fmt" and "<Foo>::new".  These start a
+// name, or a path inside another.
+var qualified_re *regexp.Regexp = regexp.MustCompile(`(^|<)<([^<>]*?)(?: as [^<>]*)?>`)
 
 func RemoveTypes(name string) string {
-	name = replaceAll(paren_re, name)
-	name = replaceAll(template_re, name)
-	return name
+	return removeTemplates(replaceAll(paren_re, name, ""))
+}
+
+// removeTemplates removes the template arguments from a name with no
+// parameter lists.
+func removeTemplates(name string) string {
+	for {
+		// Each can nest in the other, as in "Vec<<T as Iterator>::Item>".
+		newname := replaceAll(template_re, name, "$1")
+		newname = replaceAll(qualified_re, newname, "$1$2")
+		if newname == name {
+			return name
+		}
+		name = newname
+	}
 }
@@ -0,0 +1,173 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveSectionSyms(t *testing.T) {
+	sect := &elf.Section{SectionHeader: elf.SectionHeader{Addr: 0x1000, Size: 0x300}}
+	sym := func(name string, typ elf.SymType, addr, size uint64) *elf.Symbol {
+		return &elf.Symbol{Name: name, Info: elf.ST_INFO(elf.STB_GLOBAL, typ), Value: addr, Size: size}
+	}
+	syms := NewSymbols(resolveSectionSyms(sect, []*elf.Symbol{
+		sym("f", elf.STT_FUNC, 0x1000, 0x100),
+		// A label inside f.
+		sym("loop", elf.STT_NOTYPE, 0x1040, 0),
+		// An assembly function with no size.
+		sym("asm_start", elf.STT_NOTYPE, 0x1100, 0),
+		sym("g", elf.STT_FUNC, 0x1200, 0x10),
+		sym("g_alias", elf.STT_NOTYPE, 0x1200, 0),
+		sym("tail", elf.STT_NOTYPE, 0x1280, 0),
+	}))
+	for _, test := range []struct {
+		addr uint64
+		name string
+	}{
+		{0x1000, "f"},
+		{0x1040, "f"},
+		{0x10ff, "f"},
+		{0x1100, "asm_start"},
+		{0x11ff, "asm_start"},
+		{0x1208, "g"},
+		{0x1240, ""},
+		{0x12ff, "tail"},
+		{0x1300, ""},
+	} {
+		name := ""
+		if sym := syms.Lookup(test.addr); sym != nil {
+			name = sym.name
+		}
+		if name != test.name {
+			t.Errorf("%#x: got %q, want %q", test.addr, name, test.name)
+		}
+	}
+}
+
+func TestReadElfSymbols(t *testing.T) {
+	f, err := elf.Open("testdata/sample.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readElfSymbols(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d symbols, want %d as debug/elf reads them", len(got), len(want))
+	}
+}
+
+func TestReadSymsMap(t *testing.T) {
+	for _, test := range []struct {
+		path   string
+		format symsMapFormat
+		text   string
+		// The size of the second symbol, helper, whose base is
+		// the format's.
+		helperSize uint64
+	}{
+		{"app.syms", symsMapHp, "1000 16 main\n1010 32 helper\n", 32},
+		{"app.nm", symsMapAuto, "0000000000001000 0000000000000010 T main\n0000000000001010 0000000000000020 t helper\n", 0x20},
+		// nm's output for several files, and symbols without sizes.
+		{"lib.nm", symsMapAuto, "\na.o:\n0000000000001000 0000000000000010 T main\n0000000000000000 r .Lstr\n\nb.o:\n0000000000001010 0000000000000020 t helper\n", 0x20},
+		{"/tmp/perf-42.map", symsMapAuto, "1000 10 main\n1010 20 helper\n", 0x20},
+		{"jit.map", symsMapAuto, "1000 10 main\n1010 2a LazyCompile:*helper app.js:1\n", 0x2a},
+		{"jit.map", symsMapPerf, "1000 10 main\n1010 20 helper\n", 0x20},
+	} {
+		syms, err := ReadSymsMap(bufio.NewReader(strings.NewReader(test.text)), test.path, test.format)
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		if syms.Len() != 2 {
+			t.Errorf("%s: got %d symbols, want 2", test.path, syms.Len())
+			continue
+		}
+		if main := syms.At(0); main.addr != 0x1000 || main.size != 16 || main.name != "main" {
+			t.Errorf("%s: got %+v", test.path, main)
+		}
+		if helper := syms.At(1); helper.addr != 0x1010 || helper.size != test.helperSize {
+			t.Errorf("%s: got %+v, want size %d", test.path, helper, test.helperSize)
+		}
+	}
+
+	for _, test := range []struct {
+		path   string
+		format symsMapFormat
+		text   string
+	}{
+		// hp's format or a perf map?
+		{"app.map", symsMapAuto, "1000 10 main\n1010 20 helper\n"},
+		{"app.syms", symsMapHp, "1000 1a main\n"},
+		{"app.syms", symsMapHp, "1000 main\n"},
+		{"app.syms", symsMapHp, "xyz 10 main\n"},
+		{"app.nm", symsMapNm, "a.o:\nnot an nm line\n"},
+	} {
+		if _, err := ReadSymsMap(bufio.NewReader(strings.NewReader(test.text)), test.path, test.format); err == nil {
+			t.Errorf("%s as %s, %q: want an error", test.path, test.format, test.text)
+		}
+	}
+}
+
+func TestParseSymsMapFormat(t *testing.T) {
+	for _, f := range []symsMapFormat{symsMapAuto, symsMapHp, symsMapNm, symsMapPerf} {
+		if got, err := parseSymsMapFormat(f.String()); err != nil || got != f {
+			t.Errorf("%s: got %v, %v", f, got, err)
+		}
+	}
+	if _, err := parseSymsMapFormat("elf"); err == nil {
+		t.Errorf("want an error for a bad format")
+	}
+}
+
+func TestSplitCloneSuffix(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		name   string
+		clones []string
+	}{
+		{"_ZN4base6Widget3RunEv", "_ZN4base6Widget3RunEv", nil},
+		{"_ZN4base6Widget3RunEv.cold", "_ZN4base6Widget3RunEv", []string{".cold"}},
+		{"_Z3fooi.isra.0.cold", "_Z3fooi", []string{".isra.0", ".cold"}},
+		{"_Z3fooi.constprop.2.llvm.123", "_Z3fooi", []string{".constprop.2", ".llvm.123"}},
+		{"_Z3fooi.lto_priv.0", "_Z3fooi", []string{".lto_priv.0"}},
+		{"_Z3fooi.unknown", "_Z3fooi.unknown", nil},
+		// Dots are part of other names.
+		{"main.cold", "main.cold", nil},
+		{"runtime.mallocgc", "runtime.mallocgc", nil},
+		// C's clones have no mangling to go by.
+		{"foo.isra.0", "foo", []string{".isra.0"}},
+		{"malloc_consolidate.part.0", "malloc_consolidate", []string{".part.0"}},
+		{"foo.isra.0.cold", "foo", []string{".isra.0", ".cold"}},
+		{"main.part", "main.part", nil},
+		{".cold", ".cold", nil},
+	} {
+		name, clones := splitCloneSuffix(test.in)
+		if name != test.name || !reflect.DeepEqual(clones, test.clones) {
+			t.Errorf("%s: got %q, %q; want %q, %q", test.in, name, clones, test.name, test.clones)
+		}
+	}
+}
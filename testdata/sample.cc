@@ -0,0 +1,92 @@
+// Sample C++ for linux_mangle_test.go, exercising a spread of mangling
+// features.  Rebuild testdata/sample.o with:
+//   g++ -std=c++17 -O0 -c -o testdata/sample.o testdata/sample.cc
+
+#include <functional>
+#include <map>
+#include <memory>
+#include <string>
+#include <tuple>
+#include <vector>
+
+namespace sample {
+
+struct Widget {
+  Widget();
+  virtual ~Widget();
+  virtual int Size() const;
+  int operator()(int x) const { return x + n; }
+  Widget& operator+=(const Widget& w);
+  bool operator<(const Widget& w) const { return n < w.n; }
+  explicit operator bool() const { return n != 0; }
+  static int count;
+  int n = 0;
+};
+
+Widget::Widget() { ++count; }
+Widget::~Widget() { --count; }
+int Widget::Size() const { return n; }
+Widget& Widget::operator+=(const Widget& w) {
+  n += w.n;
+  return *this;
+}
+int Widget::count;
+
+template <typename T, int N>
+struct Array {
+  T elems[N];
+  const T& operator[](int i) const { return elems[i]; }
+};
+
+template <typename... Ts>
+std::size_t CountArgs(Ts&&...) {
+  return sizeof...(Ts);
+}
+
+template <typename T>
+auto Twice(T t) -> decltype(t + t) {
+  return t + t;
+}
+
+template <typename F>
+int Apply(F f, int x) {
+  static int calls;
+  ++calls;
+  return f(x);
+}
+
+namespace {
+int Hidden(const char* s, ...) { return s[0]; }
+}  // namespace
+
+int Local() {
+  struct Counter {
+    int Next() { return ++n; }
+    int n = 0;
+  };
+  Counter c;
+  return c.Next();
+}
+
+int Use(std::map<std::string, std::vector<Widget>>& m,
+        std::unique_ptr<Widget[]> p, std::function<int(int)> f,
+        void (Widget::*method)(), int Widget::*field,
+        const volatile int* cv, int (&arr)[4]) {
+  Array<double, 3> a{};
+  std::tuple<int, char, long> t{1, 'a', 2};
+  int total = static_cast<int>(a[0]) + std::get<0>(t) + f(1);
+  total += static_cast<int>(CountArgs(1, 'x', 2.0, "s"));
+  total += static_cast<int>(Twice(1.5f)) + Twice(3);
+  total += Apply([&](int x) { return x + total; }, 2);
+  total += Apply(Widget(), 3);
+  total += Hidden("h", 1) + Local() + *cv + arr[0];
+  Widget w;
+  (w.*method)();
+  total += w.*field + static_cast<bool>(w);
+  m["x"].push_back(w);
+  return total + p[0].Size();
+}
+
+}  // namespace sample
+
+extern "C" int sample_c_function(int x) { return x; }
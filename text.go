@@ -0,0 +1,78 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Text writes a table of the s.Params.NodeKeepCount biggest functions,
+// by flat size or, if byCum is set, cumulative size, in the manner of
+// pprof's "top".  Percentages are of what's shown.
+func (s *state) Text(w io.Writer, byCum bool) {
+	m := s.Params.Metric
+	nodes := make([]*Node, 0, len(s.Graph.nodes))
+	for _, n := range s.Graph.nodes {
+		if n.cur.Get(m) != 0 || n.cum.Get(m) != 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	key := func(n *Node) (int, int) {
+		flat, cum := abs(n.cur.Get(m)), abs(n.cum.Get(m))
+		if byCum {
+			return cum, flat
+		}
+		return flat, cum
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a1, a2 := key(nodes[i])
+		b1, b2 := key(nodes[j])
+		if a1 != b1 {
+			return a1 > b1
+		}
+		if a2 != b2 {
+			return a2 > b2
+		}
+		return nodes[i].addr < nodes[j].addr
+	})
+
+	total := s.Shown.Get(m)
+	shown := nodes
+	if len(shown) > s.Params.NodeKeepCount {
+		shown = shown[:s.Params.NodeKeepCount]
+	}
+	fmt.Fprintf(w, "%s %s total, showing %d of %d functions\n", m.Format(total, false), m, len(shown), len(nodes))
+
+	percent := func(n int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total) * 100
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat\tflat%%\tsum%%\tcum\tcum%%\t name\n")
+	sum := 0
+	for _, n := range shown {
+		flat, cum := n.cur.Get(m), n.cum.Get(m)
+		sum += flat
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.1f%%\t%s\t%.1f%%\t %s\n",
+			m.Format(flat, s.Graph.diff), percent(flat), percent(sum),
+			m.Format(cum, s.Graph.diff), percent(cum), s.Label(n))
+	}
+	tw.Flush()
+}
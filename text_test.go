@@ -0,0 +1,78 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestText(t *testing.T) {
+	stack := func(kb, objects int, addrs ...uint64) *Stack {
+		return &Stack{Stats: &Stats{InuseObjects: objects, InuseBytes: kb << 10}, Stack: addrs}
+	}
+	for _, test := range []struct {
+		metric metric
+		byCum  bool
+		keep   int
+		focus  string
+		want   string
+	}{
+		{metricInuseBytes, false, 10, "", `
+1000k inuse_space total, showing 4 of 4 functions
+ flat flat%   sum%   cum   cum% name
+ 600k 60.0%  60.0%  600k  60.0% Parse
+ 300k 30.0%  90.0% 1000k 100.0% main
+ 100k 10.0% 100.0%  100k  10.0% Read
+   0k  0.0% 100.0%  700k  70.0% Load
+`},
+		{metricInuseBytes, true, 2, "", `
+1000k inuse_space total, showing 2 of 4 functions
+ flat flat%  sum%   cum   cum% name
+ 300k 30.0% 30.0% 1000k 100.0% main
+   0k  0.0% 30.0%  700k  70.0% Load
+`},
+		{metricInuseObjects, false, 10, "", `
+13 inuse_objects total, showing 4 of 4 functions
+ flat flat%   sum% cum   cum% name
+   10 76.9%  76.9%  10  76.9% Read
+    2 15.4%  92.3%  13 100.0% main
+    1  7.7% 100.0%   1   7.7% Parse
+    0  0.0% 100.0%  11  84.6% Load
+`},
+		{metricInuseBytes, false, 10, "Read", `
+100k inuse_space total, showing 3 of 3 functions
+ flat  flat%   sum%  cum   cum% name
+ 100k 100.0% 100.0% 100k 100.0% Read
+   0k   0.0% 100.0% 100k 100.0% Load
+   0k   0.0% 100.0% 100k 100.0% main
+`},
+	} {
+		s := testState(&params{NodeKeepCount: test.keep, Metric: test.metric, Focus: test.focus},
+			map[uint64]string{1: "Parse", 2: "Load", 3: "Read", 4: "main"},
+			stack(600, 1, 1, 2, 4),
+			stack(100, 10, 3, 2, 4),
+			stack(300, 2, 4),
+		)
+		if err := s.Analyze(); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		s.Text(&out, test.byCum)
+		if got := "\n" + out.String(); got != test.want {
+			t.Errorf("%s, by cum %v, top %d, focus %q: got%s\nwant%s", test.metric, test.byCum, test.keep, test.focus, got, test.want)
+		}
+	}
+}
@@ -24,6 +24,13 @@ func check(e error) {
 	}
 }
 
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 type sortableSlice struct {
 	xs  []interface{}
 	key func(interface{}) int
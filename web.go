@@ -20,10 +20,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"log"
-	"fmt"
 	"text/template"
 	"runtime"
 	"strconv"
+	"sync"
 )
 
 func SpawnBrowser(url string) {
@@ -57,15 +57,21 @@ func loadTemplate() *template.Template {
 	// This seems pretty suboptimal, but I can't figure out how else
 	// to define functions before loading a template.
 	return template.Must(template.New("page").Funcs(template.FuncMap{
-		"kb": func(n int) string {
-			return fmt.Sprintf("%dkb", n/1024)
-		},
 		"firstn": func(n int, xs []int) []int {
 			if len(xs) < n {
 				return xs
 			}
 			return xs[:n]
 		},
+		"simplifyLevels": func() []simplifyLevel {
+			return simplifyLevels
+		},
+		"groupBys": func() []groupBy {
+			return groupBys
+		},
+		"metrics": func() []metric {
+			return metrics
+		},
 		"json": func(x interface{}) (string, error) {
 			js, err := json.Marshal(x)
 			return string(js), err
@@ -74,7 +80,12 @@ func loadTemplate() *template.Template {
 }
 
 func (s *state) ServeHttp(addr string) {
+	// Guards s, which POSTs reanalyze, and graph.png, which they rewrite.
+	var mu sync.Mutex
+
 	http.HandleFunc("/graph.png", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
 		http.ServeFile(w, req, "graph.png")
 	})
 
@@ -83,6 +94,8 @@ func (s *state) ServeHttp(addr string) {
 			http.NotFound(w, req)
 			return
 		}
+		mu.Lock()
+		defer mu.Unlock()
 
 		if req.Method == "POST" {
 			nodeCount := 100
@@ -91,8 +104,48 @@ func (s *state) ServeHttp(addr string) {
 				check(err)
 				nodeCount = int(nc)
 			}
+			simplify := s.Params.Simplify
+			if ss := req.FormValue("simplify"); len(ss) > 0 {
+				var err error
+				simplify, err = parseSimplifyLevel(ss)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			group := s.Params.Group
+			if gs := req.FormValue("group"); len(gs) > 0 {
+				var err error
+				group, err = parseGroupBy(gs)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			metric := s.Params.Metric
+			if ms := req.FormValue("metric"); len(ms) > 0 {
+				var err error
+				metric, err = parseMetric(ms)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			old := s.Params
 			s.Params = &params{
 				NodeKeepCount: nodeCount,
+				Metric: metric,
+				Simplify: simplify,
+				Group: group,
+				Focus: req.FormValue("focus"),
+				Ignore: req.FormValue("ignore"),
+			}
+			if s.Params.Focus != old.Focus || s.Params.Ignore != old.Ignore || s.Params.Metric != old.Metric {
+				if err := s.Analyze(); err != nil {
+					s.Params = old
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
 			s.WritePng()
 			http.Redirect(w, req, "/", 303)